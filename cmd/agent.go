@@ -0,0 +1,302 @@
+/*
+Package cmd agent run an ephemeral ssh-agent holding karbon keys
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agentKey is a cluster key/cert handed over to the detached agent process
+type agentKey struct {
+	Cluster string    `json:"cluster"`
+	SSH     sshConfig `json:"ssh"`
+}
+
+// newAgentCmd returns the agent command
+func newAgentCmd(p *plugin) *cobra.Command {
+	agentCmd := &cobra.Command{
+		Use:   "agent [cluster...]",
+		Short: "Start an ephemeral ssh-agent holding the SSH key/cert of k8s clusters",
+		Long: `Start an in-process ssh-agent on a private Unix socket, load the Karbon SSH key/cert of the clusters,
+and print the SSH_AUTH_SOCK and SSH_AGENT_PID variables to use with eval, like ssh-agent does.
+
+The agent runs in the background and exits when all the certs are expired, or when it receives SIGTERM.
+Use it where no ssh-agent is available, the private keys are never written to disk.`,
+		Example: `  eval $(kubectl karbon agent mycluster)
+  kubectl karbon ssh mycluster`,
+		PreRun: func(cmd *cobra.Command, args []string) {
+
+			p.viper.BindPFlag("server", cmd.Flags().Lookup("server"))
+			p.viper.BindPFlag("user", cmd.Flags().Lookup("user"))
+			p.viper.BindPFlag("port", cmd.Flags().Lookup("port"))
+			p.viper.BindPFlag("insecure", cmd.Flags().Lookup("insecure"))
+			p.viper.BindPFlag("keyring", cmd.Flags().Lookup("keyring"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			socket, _ := cmd.Flags().GetString("socket")
+			foreground, _ := cmd.Flags().GetBool("foreground")
+			serve, _ := cmd.Flags().GetBool("serve")
+
+			if serve {
+				return p.runDetachedAgent(cmd, socket)
+			}
+
+			nutanixCluster, err := p.newNutanixCluster(cmd)
+			if err != nil {
+				return err
+			}
+
+			karbonClusters := args
+			if len(karbonClusters) == 0 {
+				selected, err := nutanixCluster.selectCluster()
+				if err != nil {
+					return err
+				}
+				for _, cluster := range selected {
+					karbonClusters = append(karbonClusters, cluster.Name)
+				}
+			}
+
+			var keys []agentKey
+			for _, karbonCluster := range karbonClusters {
+				karbonSSH, err := nutanixCluster.getSSHConfig(karbonCluster)
+				if err != nil {
+					return err
+				}
+				keys = append(keys, agentKey{Cluster: karbonCluster, SSH: *karbonSSH})
+			}
+
+			if foreground {
+				err = p.serveAgent(keys, socket, func(socket string) {
+					printAgentEnv(p.out, socket, os.Getpid())
+				})
+				if err != nil {
+					return err
+				}
+				return nil
+			}
+
+			socket, pid, err := startDetachedAgent(keys, socket)
+			if err != nil {
+				return err
+			}
+
+			printAgentEnv(p.out, socket, pid)
+			return nil
+		},
+	}
+
+	user, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+
+	agentCmd.Flags().String("server", "", "Address of the PC to authenticate against")
+
+	agentCmd.Flags().StringP("user", "u", user.Username, "Username to authenticate")
+
+	agentCmd.Flags().Int("port", 9440, "Port to run Application server on")
+
+	agentCmd.Flags().BoolP("insecure", "k", false, "Skip certificate verification (this is insecure)")
+
+	agentCmd.Flags().Bool("keyring", false, "Use keyring to store and retrieve credential")
+
+	agentCmd.Flags().String("socket", "", "Unix socket of the agent (default in a private temporary directory)")
+	agentCmd.Flags().Bool("foreground", false, "Run the agent in the foreground instead of detaching it")
+
+	// used by the detached agent process
+	agentCmd.Flags().Bool("serve", false, "Serve the keys read on stdin")
+	agentCmd.Flags().MarkHidden("serve")
+
+	return agentCmd
+}
+
+// printAgentEnv prints the agent variables in the ssh-agent sh syntax
+func printAgentEnv(out io.Writer, socket string, pid int) {
+	fmt.Fprintf(out, "SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;\n", shellQuote(socket))
+	fmt.Fprintf(out, "SSH_AGENT_PID=%d; export SSH_AGENT_PID;\n", pid)
+	fmt.Fprintf(out, "echo Agent pid %d;\n", pid)
+}
+
+// startDetachedAgent starts the agent in a detached process, the keys are written to its stdin,
+// and returns the socket and pid once it serves them
+func startDetachedAgent(keys []agentKey, socket string) (string, int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", 0, err
+	}
+
+	child := exec.Command(executable, "agent", "--serve", "--socket", socket)
+	child.SysProcAttr = detachedSysProcAttr()
+
+	stdin, err := child.StdinPipe()
+	if err != nil {
+		return "", 0, err
+	}
+
+	stdout, err := child.StdoutPipe()
+	if err != nil {
+		return "", 0, err
+	}
+
+	err = child.Start()
+	if err != nil {
+		return "", 0, err
+	}
+
+	err = json.NewEncoder(stdin).Encode(keys)
+	stdin.Close()
+	if err != nil {
+		child.Process.Kill()
+		return "", 0, err
+	}
+
+	// the agent answers "ok <socket>" or "error <message>" on its first line
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		child.Process.Kill()
+		return "", 0, err
+	}
+
+	status, message, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if status != "ok" {
+		child.Wait()
+		if message == "" {
+			message = "agent exited before serving"
+		}
+		return "", 0, errors.New(message)
+	}
+
+	pid := child.Process.Pid
+	return message, pid, child.Process.Release()
+}
+
+// runDetachedAgent reads the keys on stdin and serves them, the status is reported on stdout
+func (p *plugin) runDetachedAgent(cmd *cobra.Command, socket string) error {
+	var keys []agentKey
+
+	err := json.NewDecoder(p.In).Decode(&keys)
+	if err == nil {
+		err = p.serveAgent(keys, socket, func(socket string) {
+			fmt.Fprintf(p.Out, "ok %s\n", socket)
+			if closer, ok := p.Out.(io.Closer); ok {
+				closer.Close()
+			}
+		})
+	}
+
+	if err != nil {
+		fmt.Fprintf(p.Out, "error %s\n", err)
+		return exitWithCode(cmd, 1)
+	}
+
+	return nil
+}
+
+// serveAgent serves the keys on a Unix socket until all of them are expired or a signal is received,
+// ready is called with the socket once it accepts connections
+func (p *plugin) serveAgent(keys []agentKey, socket string, ready func(socket string)) error {
+	keyring := agent.NewKeyring()
+
+	var lastExpiry time.Time
+	for _, key := range keys {
+		addedKey, expiry, err := p.agentAddedKey(key.Cluster, key.SSH, false)
+		if err != nil {
+			return err
+		}
+
+		err = keyring.Add(addedKey)
+		if err != nil {
+			return err
+		}
+
+		if expiry.After(lastExpiry) {
+			lastExpiry = expiry
+		}
+	}
+
+	if len(keys) == 0 {
+		return fmt.Errorf("no cluster key to serve")
+	}
+
+	if socket == "" {
+		dir, err := os.MkdirTemp("", "kubectl-karbon-agent-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		socket = filepath.Join(dir, "agent.sock")
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	err = os.Chmod(socket, 0600)
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	expired := time.NewTimer(time.Until(lastExpiry))
+	defer expired.Stop()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	ready(socket)
+
+	select {
+	case <-signals:
+	case <-expired.C:
+	}
+
+	return nil
+}
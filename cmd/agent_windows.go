@@ -0,0 +1,30 @@
+//go:build windows
+
+/*
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"syscall"
+)
+
+// detachedProcess is the DETACHED_PROCESS process creation flag
+const detachedProcess = 0x00000008
+
+// detachedSysProcAttr starts the agent without console, in its own process group
+func detachedSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: detachedProcess | syscall.CREATE_NEW_PROCESS_GROUP}
+}
@@ -16,34 +16,49 @@ limitations under the License.
 package cmd
 
 import (
-	"crypto/tls"
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"net"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
-	"syscall"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/ktr0731/go-fuzzyfinder"
+	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
+	"github.com/spf13/pflag"
 	"github.com/zalando/go-keyring"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
-	"golang.org/x/term"
 	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
+var errNoTerminal = errors.New("stdin is not a terminal, clusters cannot be selected interactively")
+
+var errInvalidCredentials = errors.New("invalid client credentials")
+
+var errNoHomeDir = errors.New("home directory unknown, HOME environment variable not set")
+
 type nutanixCluster struct {
+	*plugin
+
 	server   string
 	login    string
 	password string
 	port     int
 	timeout  int
 	insecure bool
+	route    prismRoute
 }
 
 type karbonCluster struct {
@@ -68,7 +83,12 @@ type sshConfig struct {
 	Username    string `json:"username"`
 }
 
-func (nutanix *nutanixCluster) selectCluster() ([]string, error) {
+// selectCluster lets the user choose clusters with the fuzzy finder
+func (nutanix *nutanixCluster) selectCluster() ([]karbonCluster, error) {
+	if _, ok := nutanix.inTerminal(); !ok {
+		return nil, errNoTerminal
+	}
+
 	clusters, err := nutanix.listKarbonClusters()
 	if err != nil {
 		return nil, err
@@ -95,13 +115,12 @@ func (nutanix *nutanixCluster) selectCluster() ([]string, error) {
 	)
 
 	if err != nil {
-		fmt.Printf("Prompt failed %v\n", err)
-		return nil, err
+		return nil, fmt.Errorf("prompt failed: %w", err)
 	}
 
-	var selectedClusters []string
+	var selectedClusters []karbonCluster
 	for _, idx := range idxs {
-		selectedClusters = append(selectedClusters, clusters[idx].Name)
+		selectedClusters = append(selectedClusters, clusters[idx])
 	}
 
 	return selectedClusters, nil
@@ -112,12 +131,12 @@ func (nutanix *nutanixCluster) listKarbonClusters() ([]karbonCluster, error) {
 	karbonListUrl := "/karbon/v1-beta.1/k8s/clusters"
 	method := "GET"
 
-	if verbose {
-		fmt.Printf("Retrieve cluster list\n")
-	}
+	nutanix.logger.Info("retrieve cluster list", "server", nutanix.server)
 
 	ResponseJSON, err := nutanix.clusterRequest(method, karbonListUrl, nil)
-	cobra.CheckErr(err)
+	if err != nil {
+		return nil, err
+	}
 
 	var clusters []karbonCluster
 
@@ -129,159 +148,307 @@ func (nutanix *nutanixCluster) listKarbonClusters() ([]karbonCluster, error) {
 	return clusters, nil
 }
 
-func saveKeyFile(cluster string, ssh sshConfig, force bool) error {
+// getKarbonCluster retrieves the cluster object of a karbon cluster
+func (nutanix *nutanixCluster) getKarbonCluster(cluster string) (*karbonCluster, error) {
+	clusterJSON, err := nutanix.getClusterObject(cluster)
+	if err != nil {
+		return nil, err
+	}
 
-	privateKey := []byte(ssh.PrivateKey)
-	certificate := []byte(ssh.Certificate)
+	var karbonCluster karbonCluster
 
-	userHomeDir, err := os.UserHomeDir()
-	cobra.CheckErr(err)
+	err = json.Unmarshal(clusterJSON, &karbonCluster)
+	if err != nil {
+		return nil, err
+	}
 
-	sshDir := filepath.Join(userHomeDir, ".ssh")
+	return &karbonCluster, nil
+}
 
-	// Create the directory if it does not exist
-	err = os.MkdirAll(sshDir, 0700)
-	cobra.CheckErr(err)
+// getKubeconfig retrieves the kubeconfig of a karbon cluster
+func (nutanix *nutanixCluster) getKubeconfig(cluster string) (*kubeConfig, error) {
+	nutanix.logger.Info("retrieve kubeconfig", "server", nutanix.server, "port", nutanix.port, "cluster", cluster)
 
-	// Write the private key
-	privateKeyFile := filepath.Join(sshDir, cluster)
+	karbonKubeconfigPath := fmt.Sprintf("/karbon/v1/k8s/clusters/%s/kubeconfig", cluster)
+	method := "GET"
 
-	_, err = os.Stat(privateKeyFile)
-	if err == nil && !force {
-		return fmt.Errorf("file %s already exist, use force option to overwrite it", privateKeyFile)
+	kubeconfigResponseJSON, err := nutanix.clusterRequest(method, karbonKubeconfigPath, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	err = os.WriteFile(privateKeyFile, privateKey, 0600)
-	cobra.CheckErr(err)
+	var kubeconfigResponse kubeConfig
 
-	// Write the certificate
-	certificateFile := filepath.Join(sshDir, fmt.Sprintf("%s-cert.pub", cluster))
+	err = json.Unmarshal(kubeconfigResponseJSON, &kubeconfigResponse)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err = os.Stat(certificateFile)
-	if err == nil && !force {
-		return fmt.Errorf("file %s already exist, use force option to overwrite it", certificateFile)
+	return &kubeconfigResponse, nil
+}
+
+// getSSHConfig retrieves the SSH key/cert of a karbon cluster
+func (nutanix *nutanixCluster) getSSHConfig(cluster string) (*sshConfig, error) {
+	nutanix.logger.Info("retrieve SSH key/cert", "server", nutanix.server, "port", nutanix.port, "cluster", cluster)
+
+	karbonSSHPath := fmt.Sprintf("/karbon/v1/k8s/clusters/%s/ssh", cluster)
+	method := "GET"
+
+	karbonSSHJSON, err := nutanix.clusterRequest(method, karbonSSHPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var karbonSSH sshConfig
+
+	err = json.Unmarshal(karbonSSHJSON, &karbonSSH)
+	if err != nil {
+		return nil, err
 	}
 
-	err = os.WriteFile(certificateFile, certificate, 0600)
-	cobra.CheckErr(err)
+	return &karbonSSH, nil
+}
 
-	if verbose {
-		fmt.Printf("privateKey file %s successfully written\n", privateKeyFile)
-		fmt.Printf("certificate file %s successfully written\n", certificateFile)
+// kubeconfigFile returns the kubeconfig file to use for a cluster, depending on the kubie mode
+func (p *plugin) kubeconfigFile(cluster string) (string, error) {
+	kubeconfig := p.viper.GetString("kubeconfig")
+
+	if p.viper.GetBool("kubie") {
+		kubiePath := p.viper.GetString("kubie-path")
+		clusterFile := fmt.Sprintf("%s.yaml", cluster)
+		kubeconfig = filepath.Join(kubiePath, clusterFile)
 	}
-	return nil
 
+	return p.expandHome(kubeconfig)
 }
 
-func deleteKeyFile(cluster string) error {
-	userHomeDir, err := os.UserHomeDir()
-	if err != nil {
-		return err
+// homeDir returns the home directory of the options
+func (p *plugin) homeDir() (string, error) {
+	if p.HomeDir == "" {
+		return "", errNoHomeDir
 	}
+	return p.HomeDir, nil
+}
 
-	sshDir := filepath.Join(userHomeDir, ".ssh")
+// expandHome replaces a leading ~/ by the user home directory
+func (p *plugin) expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
 
-	privateKeyFile := filepath.Join(sshDir, cluster)
-	err = os.Remove(privateKeyFile)
+	userHomeDir, err := p.homeDir()
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	certificateFile := filepath.Join(sshDir, fmt.Sprintf("%s-cert.pub", cluster))
-	err = os.Remove(certificateFile)
+	return filepath.Join(userHomeDir, path[2:]), nil
+}
+
+// kubeconfigExpiry returns the expiration time of the token embedded in a karbon kubeconfig
+func kubeconfigExpiry(kubeconfigResponse *kubeConfig) (time.Time, error) {
+	config, err := clientcmd.Load([]byte(kubeconfigResponse.KubeConfig))
 	if err != nil {
-		return err
+		return time.Time{}, err
 	}
 
-	if verbose {
-		fmt.Printf("privateKey file %s successfully deleted\n", privateKeyFile)
-		fmt.Printf("certificate file %s successfully deleted\n", certificateFile)
+	for _, authInfo := range config.AuthInfos {
+		parts := strings.Split(authInfo.Token, ".")
+		if len(parts) != 3 {
+			continue
+		}
+
+		payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		var claims struct {
+			Exp int64 `json:"exp"`
+		}
+		err = json.Unmarshal(payload, &claims)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if claims.Exp != 0 {
+			return time.Unix(claims.Exp, 0), nil
+		}
 	}
 
-	return nil
+	return time.Time{}, fmt.Errorf("no token expiration found in kubeconfig")
+}
+
+// expiryTimeLayouts are the accepted layouts of the expiry_time returned with the SSH cert,
+// times without zone are UTC
+var expiryTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
 }
 
-func addKeyAgent(cluster string, sshConfig sshConfig) error {
+// parseExpiryTime parses the expiry_time returned with the SSH cert
+func parseExpiryTime(expiryTime string) (time.Time, error) {
+	expiryTime = strings.TrimSpace(expiryTime)
+
+	for _, layout := range expiryTimeLayouts {
+		t, err := time.Parse(layout, expiryTime)
+		if err == nil {
+			return t, nil
+		}
+	}
 
-	expiryTime := sshConfig.ExpiryTime
-	privateKey := []byte(sshConfig.PrivateKey)
-	certificate := []byte(sshConfig.Certificate)
+	return time.Time{}, fmt.Errorf("invalid SSH cert expiry time %q", expiryTime)
+}
 
-	// Get the ssh agent
-	socket := os.Getenv("SSH_AUTH_SOCK")
+// sshCertExpiry returns the expiry time of the SSH cert, from expiry_time or else from the cert itself
+func sshCertExpiry(karbonSSH sshConfig) (time.Time, error) {
+	expiry, err := parseExpiryTime(karbonSSH.ExpiryTime)
+	if err == nil {
+		return expiry, nil
+	}
 
-	if socket == "" {
-		fmt.Println("SSH_AUTH_SOCK environment variable not set")
+	sshCert, certErr := unmarshalCert([]byte(karbonSSH.Certificate))
+	if certErr != nil {
+		return time.Time{}, err
 	}
 
-	conn, err := net.Dial("unix", socket)
-	cobra.CheckErr(err)
+	return time.Unix(int64(sshCert.ValidBefore), 0), nil
+}
 
-	agentClient := agent.NewClient(conn)
+// sshKeyFileData is the data of the ssh-file-name template
+type sshKeyFileData struct {
+	Cluster string
+	Profile string
+	Server  string
+}
+
+// configuredSSHKeyFiles returns the private key and certificate files of a cluster from the ssh-dir and
+// ssh-file-name settings, the certificate file is the private key file with a -cert.pub suffix like OpenSSH
+func (p *plugin) configuredSSHKeyFiles(cluster string) (string, string, error) {
+	sshDir := p.viper.GetString("ssh-dir")
+	if sshDir == "" {
+		sshDir = "~/.ssh"
+	}
 
-	parsedKey, err := ssh.ParseRawPrivateKey(privateKey)
-	cobra.CheckErr(err)
+	sshDir, err := p.expandHome(sshDir)
+	if err != nil {
+		return "", "", err
+	}
 
-	sshCert, err := unmarshalCert(certificate)
-	cobra.CheckErr(err)
+	fileName := p.viper.GetString("ssh-file-name")
+	if fileName == "" {
+		fileName = "{{.Cluster}}"
+	}
 
-	now := time.Now()
-	layout := "2006-01-02T15:04:05.000Z"
-	futureDate, err := time.Parse(layout, expiryTime)
-	cobra.CheckErr(err)
-	diff := futureDate.Sub(now)
+	tmpl, err := template.New("ssh-file-name").Option("missingkey=error").Parse(fileName)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid ssh-file-name template: %w", err)
+	}
 
-	err = agentClient.Add(agent.AddedKey{
-		PrivateKey:   parsedKey,
-		Certificate:  sshCert,
-		Comment:      fmt.Sprintf("karbon cluster %s", cluster),
-		LifetimeSecs: uint32(diff.Seconds()),
+	var name strings.Builder
+	err = tmpl.Execute(&name, sshKeyFileData{
+		Cluster: cluster,
+		Profile: p.viper.GetString("profile"),
+		Server:  p.viper.GetString("server"),
 	})
-	cobra.CheckErr(err)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid ssh-file-name template: %w", err)
+	}
 
-	if verbose {
-		fmt.Printf("SSH key for cluster '%s' added to ssh-agent\n", cluster)
+	if !filepath.IsLocal(name.String()) {
+		return "", "", fmt.Errorf("invalid SSH file name %q, it must be relative to the SSH directory", name.String())
+	}
+
+	privateKeyFile := filepath.Join(sshDir, name.String())
+
+	return privateKeyFile, privateKeyFile + "-cert.pub", nil
+}
+
+// sshKeyFiles returns the private key and certificate files of a cluster logged in from server,
+// as recorded in the state at login or else from the current settings
+func (p *plugin) sshKeyFiles(server string, cluster string) (string, string, error) {
+	entry, err := p.lookupState(server, cluster)
+	if err != nil {
+		return "", "", err
 	}
-	return nil
 
+	if entry != nil && len(entry.SSHFiles) == 2 {
+		return entry.SSHFiles[0], entry.SSHFiles[1], nil
+	}
+
+	return p.configuredSSHKeyFiles(cluster)
 }
 
-func deleteKeyAgent(cluster string) error {
+func (p *plugin) saveKeyFile(privateKeyFile string, certificateFile string, ssh sshConfig, force bool) error {
+
+	privateKey := []byte(ssh.PrivateKey)
+	certificate := []byte(ssh.Certificate)
+
+	// Create the directory if it does not exist
+	err := p.Fs.MkdirAll(filepath.Dir(privateKeyFile), 0700)
+	if err != nil {
+		return err
+	}
 
-	// Get the ssh agent
-	socket := os.Getenv("SSH_AUTH_SOCK")
+	// Write the private key
 
-	if socket == "" {
-		fmt.Println("SSH_AUTH_SOCK environment variable not set")
+	_, err = p.Fs.Stat(privateKeyFile)
+	if err == nil && !force {
+		return fmt.Errorf("file %s already exist, use force option to overwrite it", privateKeyFile)
 	}
 
-	conn, err := net.Dial("unix", socket)
+	err = afero.WriteFile(p.Fs, privateKeyFile, privateKey, 0600)
 	if err != nil {
 		return err
 	}
 
-	agentClient := agent.NewClient(conn)
+	// Write the certificate
+	_, err = p.Fs.Stat(certificateFile)
+	if err == nil && !force {
+		return fmt.Errorf("file %s already exist, use force option to overwrite it", certificateFile)
+	}
 
-	keyList, err := agentClient.List()
+	err = afero.WriteFile(p.Fs, certificateFile, certificate, 0600)
 	if err != nil {
 		return err
 	}
 
-	searchString := fmt.Sprintf("karbon cluster %s", cluster)
+	p.logger.Info("SSH key/cert files written", "key", privateKeyFile, "cert", certificateFile)
+	return nil
 
-	for _, key := range keyList {
-		if key.Comment == searchString {
-			err = agentClient.Remove(key)
-			if err != nil {
-				return err
-			}
-			if verbose {
-				fmt.Printf("SSH key for cluster '%s' deleted from ssh-agent\n", cluster)
-			}
+}
+
+// deleteKeyFile removes the SSH key/cert files of a cluster logged in from server, a file already removed is not an error
+func (p *plugin) deleteKeyFile(server string, cluster string) ([]string, error) {
+	privateKeyFile, certificateFile, err := p.sshKeyFiles(server, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.removeKeyFiles(privateKeyFile, certificateFile)
+}
+
+// removeKeyFiles removes all the files it can, ignoring missing ones, and returns the removed files and the other errors
+func (p *plugin) removeKeyFiles(files ...string) ([]string, error) {
+	var removed []string
+	var errs []error
+
+	for _, file := range files {
+		err := p.Fs.Remove(file)
+		if os.IsNotExist(err) {
+			continue
 		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, file)
+
+		p.logger.Info("SSH file deleted", "file", file)
 	}
 
-	return nil
+	return removed, errors.Join(errs...)
 }
 
 func unmarshalCert(bytes []byte) (*ssh.Certificate, error) {
@@ -296,94 +463,163 @@ func unmarshalCert(bytes []byte) (*ssh.Certificate, error) {
 	return cert, nil
 }
 
-func getCredentials(server string) (string, string) {
-	userArg := viper.GetString("user")
-	keyringFlag := viper.GetBool("keyring")
+// passwordFdEnv is the file descriptor a parent plugin process, the ui, passes the password on
+const passwordFdEnv = "KARBON_PASSWORD_FD"
+
+// inheritedPassword is the password read once from the file descriptor of passwordFdEnv
+type inheritedPassword struct {
+	once     sync.Once
+	password string
+	ok       bool
+}
+
+// inheritedPassword returns the password passed by the parent process on an inherited pipe,
+// the variable is removed so that the processes started by this one do not read the descriptor
+func (p *plugin) inheritedPassword() (string, bool) {
+	p.inherited.once.Do(func() {
+		fd, ok := os.LookupEnv(passwordFdEnv)
+		if !ok {
+			return
+		}
+		os.Unsetenv(passwordFdEnv)
+
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			p.logger.Warn("invalid password file descriptor", "fd", fd)
+			return
+		}
+
+		file := os.NewFile(uintptr(n), "password")
+		defer file.Close()
+
+		data, err := io.ReadAll(file)
+		if err != nil {
+			p.logger.Warn("failed to read the password file descriptor", "error", err)
+			return
+		}
+		p.inherited.password, p.inherited.ok = string(data), true
+	})
+
+	return p.inherited.password, p.inherited.ok
+}
+
+// lookupPassword returns the password from the environment, the parent process or the keyring, without prompting the user
+func (p *plugin) lookupPassword(server string, userArg string) (string, bool) {
+	keyringFlag := p.viper.GetBool("keyring")
 
-	var password string
-	var ok bool
-	var err error
-	password, ok = os.LookupEnv("KARBON_PASSWORD")
+	password, ok := os.LookupEnv("KARBON_PASSWORD")
+	if !ok {
+		password, ok = p.inheritedPassword()
+	}
 
 	if keyringFlag {
-		password, err = keyring.Get("kubectl-karbon "+server, userArg)
-		if err == keyring.ErrNotFound && verbose {
-			fmt.Printf("No password found in keyring for user %s\n", userArg)
+		keyringPassword, err := keyring.Get("kubectl-karbon "+server, userArg)
+		if err == keyring.ErrNotFound {
+			p.logger.Info("no password found in keyring", "user", userArg)
 		}
 		if err == nil {
+			password = keyringPassword
 			ok = true
 		}
 	}
 
-	if !ok {
-		fmt.Printf("Enter %s password:\n", userArg)
-		bytePassword, err := term.ReadPassword(int(syscall.Stdin))
-		cobra.CheckErr(err)
+	return password, ok
+}
 
-		password = string(bytePassword)
+func (p *plugin) getCredentials(server string, userArg string) (string, error) {
+	password, ok := p.lookupPassword(server, userArg)
 
-		if keyringFlag {
-			err = savePasswordKeyring(server, userArg, password)
-			cobra.CheckErr(err)
+	if !ok {
+		var err error
+		password, err = p.Prompter.PromptPassword(fmt.Sprintf("Enter %s password:", userArg))
+		if err != nil {
+			return "", err
+		}
+
+		if p.viper.GetBool("keyring") {
+			err = p.savePasswordKeyring(server, userArg, password)
+			if err != nil {
+				return "", err
+			}
 		}
 	}
-	return userArg, password
+	return password, nil
 }
 
-func savePasswordKeyring(server string, user string, password string) error {
+func (p *plugin) savePasswordKeyring(server string, user string, password string) error {
 	err := keyring.Set("kubectl-karbon "+server, user, password)
 	if err != nil {
 		return err
 	}
-	if verbose {
-		fmt.Printf("Password saved in keyring for user %s\n", user)
-	}
+	p.logger.Info("password saved in keyring", "user", user)
 	return nil
 }
 
-func deletePasswordKeyring(c *nutanixCluster) error {
+func (c *nutanixCluster) deletePasswordKeyring() error {
 	err := keyring.Delete("kubectl-karbon "+c.server, c.login)
+	if err == keyring.ErrNotFound {
+		// already deleted, by a concurrent request of the same login
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	if verbose {
-		fmt.Printf("Password deleted from keyring for user %s\n", c.login)
-	}
+	c.logger.Info("password deleted from keyring", "user", c.login)
 	return nil
 }
 
-func newNutanixCluster() (*nutanixCluster, error) {
-	server := viper.GetString("server")
+// newNutanixCluster returns the Prism Central of the settings, the usage of cmd is printed without server
+func (p *plugin) newNutanixCluster(cmd *cobra.Command) (*nutanixCluster, error) {
+	server := p.viper.GetString("server")
 	if server == "" {
-		return nil, fmt.Errorf("error: required flag \"server\" not set")
+		cmd.Usage()
+		return nil, fmt.Errorf("required flag \"server\" not set")
 	}
 
-	userArg, password := getCredentials(server)
+	userArg := p.viper.GetString("user")
+
+	// a replayed session does not connect to Prism Central
+	password := ""
+	if p.viper.GetString("replay") == "" {
+		var err error
+		password, err = p.getCredentials(server, userArg)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	c := nutanixCluster{
+		plugin:   p,
 		server:   server,
 		login:    userArg,
 		password: password,
-		port:     viper.GetInt("port"),
-		timeout:  viper.GetInt("timeout"),
-		insecure: viper.GetBool("insecure"),
+		port:     p.viper.GetInt("port"),
+		timeout:  p.viper.GetInt("request-timeout"),
+		insecure: p.viper.GetBool("insecure"),
+		route:    p.configuredPrismRoute(),
 	}
 	return &c, nil
 }
 
 func (c *nutanixCluster) clusterRequest(method string, path string, payload []byte) ([]byte, error) {
-	customTransport := http.DefaultTransport.(*http.Transport).Clone()
-	customTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: c.insecure}
+	transport, err := c.transport()
+	if err != nil {
+		return nil, err
+	}
 
-	client := &http.Client{Transport: customTransport, Timeout: time.Second * time.Duration(c.timeout)}
+	client := &http.Client{Transport: transport, Timeout: time.Second * time.Duration(c.timeout)}
 	requestUrl := fmt.Sprintf("https://%s:%d/%s", c.server, c.port, path)
-	req, err := http.NewRequest(method, requestUrl, nil)
+	req, err := http.NewRequest(method, requestUrl, bytes.NewReader(payload))
 	if err != nil {
 		return nil, err
 	}
 
 	req.SetBasicAuth(c.login, c.password)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
+	start := time.Now()
 	res, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -396,19 +632,20 @@ func (c *nutanixCluster) clusterRequest(method string, path string, payload []by
 		return nil, err
 	}
 
-	if debug {
-		fmt.Printf("req: %s %s\n", method, requestUrl)
-		fmt.Printf("res.StatusCode: %d\n", res.StatusCode)
-		fmt.Printf("res.Body: %s\n", body)
+	if c.logger.Enabled(context.Background(), slog.LevelDebug) {
+		c.logger.Debug("http request", "method", method, "url", requestUrl, "status", res.StatusCode,
+			"duration", time.Since(start).Round(time.Millisecond), "request", redactBody(payload), "response", redactBody(body))
 	}
 
 	switch res.StatusCode {
 	case 401:
-		if viper.GetBool("keyring") {
-			err = deletePasswordKeyring(c)
-			cobra.CheckErr(err)
+		if c.viper.GetBool("keyring") {
+			err = c.deletePasswordKeyring()
+			if err != nil {
+				return nil, fmt.Errorf("%w, failed to delete the password from keyring: %v", errInvalidCredentials, err)
+			}
 		}
-		return nil, fmt.Errorf("invalid client credentials")
+		return nil, errInvalidCredentials
 	case 403:
 		return nil, fmt.Errorf("authorization failure, only system roles are supported with NKE")
 	case 404:
@@ -421,39 +658,135 @@ func (c *nutanixCluster) clusterRequest(method string, path string, payload []by
 
 }
 
+// kubeconfigOptions are the customizations applied to a karbon kubeconfig before it is written
+type kubeconfigOptions struct {
+	ContextName string
+	Profile     string
+	Namespace   string
+	ProxyURL    string
+}
+
+// contextNameData is the data available in the context-name template
+type contextNameData struct {
+	Cluster string
+	Profile string
+	Server  string
+	Context string
+}
+
+// clusterSetting returns a setting for a cluster, looking first at the command line flag,
+// then at the clusters.<cluster> entry of the config file, then at the global setting
+func (p *plugin) clusterSetting(flags *pflag.FlagSet, cluster string, key string) string {
+	if flag := flags.Lookup(key); flag != nil && flag.Changed {
+		return flag.Value.String()
+	}
+
+	clusters := p.viper.GetStringMap("clusters")
+	if entry, ok := clusters[strings.ToLower(cluster)].(map[string]interface{}); ok {
+		if value, ok := entry[key]; ok {
+			return fmt.Sprint(value)
+		}
+	}
+
+	return p.viper.GetString(key)
+}
+
+// customizeKubeConfig renames the context, sets the default namespace and the proxy of a karbon kubeconfig
+func customizeKubeConfig(kubeconfigResponse *kubeConfig, cluster string, server string, options kubeconfigOptions) error {
+	if options.ContextName == "" && options.Namespace == "" && options.ProxyURL == "" {
+		return nil
+	}
+
+	config, err := clientcmd.Load([]byte(kubeconfigResponse.KubeConfig))
+	if err != nil {
+		return fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+
+	currentContext := config.CurrentContext
+	context, ok := config.Contexts[currentContext]
+	if !ok {
+		return fmt.Errorf("context %s not found in kubeconfig", currentContext)
+	}
+
+	if options.Namespace != "" {
+		context.Namespace = options.Namespace
+	}
+
+	if options.ProxyURL != "" {
+		clusterEntry, ok := config.Clusters[context.Cluster]
+		if !ok {
+			return fmt.Errorf("cluster %s not found in kubeconfig", context.Cluster)
+		}
+		clusterEntry.ProxyURL = options.ProxyURL
+	}
+
+	if options.ContextName != "" {
+		tmpl, err := template.New("context-name").Option("missingkey=error").Parse(options.ContextName)
+		if err != nil {
+			return fmt.Errorf("invalid context-name template: %w", err)
+		}
+
+		var name strings.Builder
+		err = tmpl.Execute(&name, contextNameData{
+			Cluster: cluster,
+			Profile: options.Profile,
+			Server:  server,
+			Context: currentContext,
+		})
+		if err != nil {
+			return fmt.Errorf("invalid context-name template: %w", err)
+		}
+
+		delete(config.Contexts, currentContext)
+		config.Contexts[name.String()] = context
+		config.CurrentContext = name.String()
+	}
+
+	data, err := clientcmd.Write(*config)
+	if err != nil {
+		return err
+	}
+	kubeconfigResponse.KubeConfig = string(data)
+
+	return nil
+}
+
 // SaveKubeConfig handles writing the kubeconfig to the file system.
 // It considers options like force and merge.
-func SaveKubeConfig(kubeconfig string, kubeconfigResponse *kubeConfig) error {
-	force := viper.GetBool("force")
-	merge := viper.GetBool("merge")
-	verbose := viper.GetBool("verbose")
+func (p *plugin) SaveKubeConfig(kubeconfig string, kubeconfigResponse *kubeConfig) error {
+	force := p.viper.GetBool("force")
+	merge := p.viper.GetBool("merge")
 
-	_, err := os.Stat(kubeconfig)
+	_, err := p.Fs.Stat(kubeconfig)
 
 	if err == nil && merge {
-		return MergeKubeConfig(kubeconfig, kubeconfigResponse)
+		return p.MergeKubeConfig(kubeconfig, kubeconfigResponse)
 	}
 
 	if err == nil && !force {
 		return fmt.Errorf("file %s already exists, use force option to overwrite it, or merge option to add the configuration as a new context", kubeconfig)
 	}
 
-	err = os.WriteFile(kubeconfig, []byte(kubeconfigResponse.KubeConfig), 0600)
+	err = afero.WriteFile(p.Fs, kubeconfig, []byte(kubeconfigResponse.KubeConfig), 0600)
 	if err != nil {
 		return fmt.Errorf("failed to write kubeconfig file: %w", err)
 	}
 
-	if verbose {
-		fmt.Printf("Kubeconfig file %s successfully written\n", kubeconfig)
-	}
+	p.logger.Info("kubeconfig file written", "file", kubeconfig)
 
 	return nil
 }
 
 // MergeKubeconfig merges an existing kubeconfig file with the new kubeconfig
 // from the API response.
-func MergeKubeConfig(kubeconfig string, kubeconfigResponse *kubeConfig) error {
-	existingKubeconfig, err := clientcmd.LoadFromFile(kubeconfig)
+func (p *plugin) MergeKubeConfig(kubeconfig string, kubeconfigResponse *kubeConfig) error {
+	return p.mergeKubeConfig(kubeconfig, kubeconfigResponse, true)
+}
+
+// mergeKubeConfig merges the new kubeconfig into an existing kubeconfig file,
+// switchContext defines if the new context becomes the current one.
+func (p *plugin) mergeKubeConfig(kubeconfig string, kubeconfigResponse *kubeConfig, switchContext bool) error {
+	existingKubeconfig, err := p.loadKubeconfigFile(kubeconfig)
 	if err != nil {
 		return fmt.Errorf("failed to load existing kubeconfig: %w", err)
 	}
@@ -475,12 +808,60 @@ func MergeKubeConfig(kubeconfig string, kubeconfigResponse *kubeConfig) error {
 	}
 
 	// Set the newKubeConfig's current context as the default context
-	existingKubeconfig.CurrentContext = newKubeconfig.CurrentContext
+	if switchContext {
+		existingKubeconfig.CurrentContext = newKubeconfig.CurrentContext
+	}
 
-	err = clientcmd.WriteToFile(*existingKubeconfig, kubeconfig)
+	err = p.writeKubeconfigFile(*existingKubeconfig, kubeconfig)
 	if err != nil {
 		return fmt.Errorf("failed to write merged kubeconfig: %w", err)
 	}
 
 	return nil
 }
+
+// loadKubeconfigFile reads a kubeconfig file, like clientcmd.LoadFromFile
+func (p *plugin) loadKubeconfigFile(kubeconfig string) (*clientcmdapi.Config, error) {
+	data, err := afero.ReadFile(p.Fs, kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return clientcmd.Load(data)
+}
+
+// writeKubeconfigFile writes a kubeconfig file and its directory, like clientcmd.WriteToFile
+func (p *plugin) writeKubeconfigFile(config clientcmdapi.Config, kubeconfig string) error {
+	data, err := clientcmd.Write(config)
+	if err != nil {
+		return err
+	}
+
+	err = p.Fs.MkdirAll(filepath.Dir(kubeconfig), 0700)
+	if err != nil {
+		return err
+	}
+
+	return afero.WriteFile(p.Fs, kubeconfig, data, 0600)
+}
+
+// forEachParallel calls fn for every item with at most parallel concurrent calls and waits for all of them
+func forEachParallel[T any](items []T, parallel int, fn func(i int, item T)) {
+	semaphore := make(chan struct{}, parallel)
+
+	var wg sync.WaitGroup
+
+	for i, item := range items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			fn(i, item)
+		}()
+	}
+
+	wg.Wait()
+}
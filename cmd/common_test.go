@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// testKubeconfig returns a karbon like kubeconfig whose token expires at exp
+func testKubeconfig(cluster string, exp time.Time) *kubeConfig {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix())))
+
+	return &kubeConfig{KubeConfig: fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: %[1]s
+  cluster:
+    server: https://10.0.0.1:443
+contexts:
+- name: %[1]s-context
+  context:
+    cluster: %[1]s
+    user: %[1]s-user
+current-context: %[1]s-context
+users:
+- name: %[1]s-user
+  user:
+    token: header.%[2]s.signature
+`, cluster, payload)}
+}
+
+func TestKubeconfigExpiry(t *testing.T) {
+	expiry, err := kubeconfigExpiry(testKubeconfig("a", testNow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiry.Equal(testNow) {
+		t.Errorf("expiry = %s, want %s", expiry, testNow)
+	}
+}
+
+func TestParseExpiryTime(t *testing.T) {
+	for _, expiryTime := range []string{
+		"2024-03-01T12:00:00Z",
+		"2024-03-01T12:00:00",
+		"2024-03-01 12:00:00Z",
+		"2024-03-01 13:00:00+01:00",
+		" 2024-03-01 12:00:00.000000 ",
+	} {
+		got, err := parseExpiryTime(expiryTime)
+		if err != nil {
+			t.Errorf("parseExpiryTime(%q): %v", expiryTime, err)
+			continue
+		}
+		if !got.Equal(testNow) {
+			t.Errorf("parseExpiryTime(%q) = %s, want %s", expiryTime, got, testNow)
+		}
+	}
+
+	if _, err := parseExpiryTime("tomorrow"); err == nil {
+		t.Error("invalid expiry time accepted")
+	}
+}
+
+func TestCustomizeKubeConfig(t *testing.T) {
+	kubeconfig := testKubeconfig("a", testNow)
+	err := customizeKubeConfig(kubeconfig, "a", "pc.example.com", kubeconfigOptions{ContextName: "{{.Profile}}-{{.Cluster}}", Profile: "prod", Namespace: "apps"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := clientcmd.Load([]byte(kubeconfig.KubeConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	context, ok := config.Contexts["prod-a"]
+	if !ok || config.CurrentContext != "prod-a" {
+		t.Fatalf("context not renamed: %+v", config.Contexts)
+	}
+	if context.Namespace != "apps" {
+		t.Errorf("namespace = %s, want apps", context.Namespace)
+	}
+}
+
+func TestSaveKubeConfig(t *testing.T) {
+	o, _, _ := testOptions(t)
+	p := newPlugin(o)
+
+	const path = "/home/test/.kube/config"
+
+	err := p.SaveKubeConfig(path, testKubeconfig("a", testNow))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.SaveKubeConfig(path, testKubeconfig("b", testNow))
+	if err == nil {
+		t.Error("existing kubeconfig overwritten without force")
+	}
+
+	p.viper.Set("merge", true)
+	err = p.SaveKubeConfig(path, testKubeconfig("b", testNow))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := p.loadKubeconfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Contexts) != 2 || config.CurrentContext != "b-context" {
+		t.Errorf("merged contexts = %v, current %s", config.Contexts, config.CurrentContext)
+	}
+
+	p.viper.Set("merge", false)
+	p.viper.Set("force", true)
+	err = p.SaveKubeConfig(path, testKubeconfig("c", testNow))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err = p.loadKubeconfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Contexts) != 1 || config.CurrentContext != "c-context" {
+		t.Errorf("forced contexts = %v, current %s", config.Contexts, config.CurrentContext)
+	}
+}
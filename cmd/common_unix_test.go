@@ -0,0 +1,43 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestInheritedPassword(t *testing.T) {
+	o, _, _ := testOptions(t)
+	p := newPlugin(o)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString("secret")
+	w.Close()
+
+	// the plugin closes the descriptor it reads, it must not be the one of r
+	fd, err := syscall.Dup(int(r.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	t.Setenv(passwordFdEnv, strconv.Itoa(fd))
+
+	password, ok := p.lookupPassword("pc", "admin")
+	if !ok || password != "secret" {
+		t.Errorf("password = %q %v, want the one of the pipe", password, ok)
+	}
+	if _, ok := os.LookupEnv(passwordFdEnv); ok {
+		t.Errorf("%s left for the child processes", passwordFdEnv)
+	}
+
+	// read once, the descriptor is closed
+	if password, ok := p.lookupPassword("pc", "admin"); !ok || password != "secret" {
+		t.Errorf("second lookup = %q %v", password, ok)
+	}
+}
@@ -0,0 +1,361 @@
+/*
+Package cmd cp copy files to and from karbon nodes
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+// copyPath is a cp argument, either a local path or <cluster>:<node>:<path>
+type copyPath struct {
+	cluster string
+	node    string
+	path    string
+	remote  bool
+}
+
+// cpResult is the outcome of the copy on a node, also its JSON result
+type cpResult struct {
+	Node  string   `json:"node"`
+	Files []string `json:"files"`
+	Error string   `json:"error,omitempty"`
+}
+
+// newCpCmd returns the cp command
+func newCpCmd(p *plugin) *cobra.Command {
+	cpCmd := &cobra.Command{
+		Use:   "cp <src> <dst>",
+		Short: "Copy files to and from the nodes of a k8s cluster",
+		Long: `Copy files and directories to and from the nodes of a Karbon cluster over SFTP, using the Karbon SSH certificate.
+
+Remote paths are written <cluster>:<node>:<path>, use * as node to copy to or from all the nodes.
+When downloading from several nodes, files are stored in a <dst>/<node>/ directory per node.
+With --output json the result lists the files written, locally or on the node, per node.`,
+		Example: `  kubectl karbon cp mycluster:mycluster-worker-0:/var/lib/kubelet/config.yaml ./
+  kubectl karbon cp -r 'mycluster:*:/etc/kubernetes/' ./kubernetes
+  kubectl karbon cp ./script.sh 'mycluster:*:/tmp/'`,
+		Args: cobra.ExactArgs(2),
+		PreRun: func(cmd *cobra.Command, args []string) {
+
+			p.viper.BindPFlag("server", cmd.Flags().Lookup("server"))
+			p.viper.BindPFlag("user", cmd.Flags().Lookup("user"))
+			p.viper.BindPFlag("port", cmd.Flags().Lookup("port"))
+			p.viper.BindPFlag("insecure", cmd.Flags().Lookup("insecure"))
+			p.viper.BindPFlag("keyring", cmd.Flags().Lookup("keyring"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			recursive, _ := cmd.Flags().GetBool("recursive")
+			parallel, _ := cmd.Flags().GetInt("parallel")
+
+			if parallel < 1 {
+				return fmt.Errorf("parallel must be at least 1")
+			}
+
+			src := parseCopyPath(args[0])
+			dst := parseCopyPath(args[1])
+
+			if src.remote == dst.remote {
+				return fmt.Errorf("exactly one of source and destination must be a remote <cluster>:<node>:<path>")
+			}
+
+			remote := src
+			if dst.remote {
+				remote = dst
+			}
+
+			nutanixCluster, err := p.newNutanixCluster(cmd)
+			if err != nil {
+				return err
+			}
+
+			nodes, err := nutanixCluster.listKarbonNodes(remote.cluster)
+			if err != nil {
+				return err
+			}
+
+			if remote.node != "*" {
+				node, err := findNode(nodes, remote.node)
+				if err != nil {
+					return err
+				}
+				nodes = []karbonNode{node}
+			}
+
+			config, err := nutanixCluster.clusterSSHClientConfig(remote.cluster)
+			if err != nil {
+				return err
+			}
+			route := nutanixCluster.nodeRoute(remote.cluster)
+
+			fanOut := remote.node == "*"
+			errs := make([]error, len(nodes))
+			results := make([]cpResult, len(nodes))
+
+			forEachParallel(nodes, parallel, func(i int, node karbonNode) {
+				results[i] = cpResult{Node: node.Hostname, Files: []string{}}
+
+				client, err := p.dialNode(route, node, config)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				defer client.Close()
+
+				sftpClient, err := sftp.NewClient(client)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				defer sftpClient.Close()
+
+				var files []string
+				if src.remote {
+					local := dst.path
+					if fanOut {
+						local = filepath.Join(dst.path, node.Hostname)
+						err = p.Fs.MkdirAll(local, 0700)
+						if err != nil {
+							errs[i] = err
+							return
+						}
+					}
+					files, errs[i] = downloadPath(p.Fs, sftpClient, src.path, local, recursive)
+				} else {
+					files, errs[i] = uploadPath(p.Fs, sftpClient, src.path, dst.path, recursive)
+				}
+				results[i].Files = append(results[i].Files, files...)
+			})
+
+			failed := 0
+			for i, node := range nodes {
+				if errs[i] != nil {
+					failed++
+					results[i].Error = errs[i].Error()
+					fmt.Fprintf(p.ErrOut, "%s: %s\n", node.Hostname, errs[i])
+				} else {
+					p.logger.Info("copy successful", "node", node.Hostname)
+				}
+			}
+
+			if p.jsonOutputEnabled() {
+				p.printJSONOutput(commandOutput{Command: commandName(cmd), Success: failed == 0, Result: results})
+			}
+
+			if failed > 0 {
+				fmt.Fprintf(p.ErrOut, "Copy failed on %d/%d node(s)\n", failed, len(nodes))
+				return exitWithCode(cmd, 1)
+			}
+			return nil
+		},
+	}
+
+	p.jsonOutputCommand(cpCmd)
+
+	user, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+
+	cpCmd.Flags().String("server", "", "Address of the PC to authenticate against")
+
+	cpCmd.Flags().StringP("user", "u", user.Username, "Username to authenticate")
+
+	cpCmd.Flags().Int("port", 9440, "Port to run Application server on")
+
+	cpCmd.Flags().BoolP("insecure", "k", false, "Skip certificate verification (this is insecure)")
+
+	cpCmd.Flags().Bool("keyring", false, "Use keyring to store and retrieve credential")
+
+	cpCmd.Flags().BoolP("recursive", "r", false, "Copy directories recursively")
+	cpCmd.Flags().Int("parallel", 5, "Maximum number of nodes copying at the same time")
+
+	return cpCmd
+}
+
+// parseCopyPath splits a <cluster>:<node>:<path> argument, anything else is a local path
+func parseCopyPath(arg string) copyPath {
+	parts := strings.SplitN(arg, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return copyPath{path: arg}
+	}
+
+	return copyPath{
+		cluster: parts[0],
+		node:    parts[1],
+		path:    parts[2],
+		remote:  true,
+	}
+}
+
+// downloadPath copies a remote file or directory to a local path, into it if it is an existing directory,
+// and returns the local files written
+func downloadPath(localFs afero.Fs, client *sftp.Client, remote string, local string, recursive bool) ([]string, error) {
+	info, err := client.Stat(remote)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", remote, err)
+	}
+
+	target := local
+	if localInfo, err := localFs.Stat(local); err == nil && localInfo.IsDir() {
+		target = filepath.Join(local, path.Base(remote))
+	}
+
+	if !info.IsDir() {
+		err = downloadFile(localFs, client, remote, target, info.Mode())
+		if err != nil {
+			return nil, err
+		}
+		return []string{target}, nil
+	}
+
+	if !recursive {
+		return nil, fmt.Errorf("%s is a directory, use --recursive", remote)
+	}
+
+	var files []string
+
+	walker := client.Walk(remote)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return files, err
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), remote), "/")
+		dest := filepath.Join(target, filepath.FromSlash(rel))
+
+		if walker.Stat().IsDir() {
+			err = localFs.MkdirAll(dest, walker.Stat().Mode().Perm()|0700)
+		} else {
+			err = downloadFile(localFs, client, walker.Path(), dest, walker.Stat().Mode())
+			if err == nil {
+				files = append(files, dest)
+			}
+		}
+		if err != nil {
+			return files, err
+		}
+	}
+
+	return files, nil
+}
+
+func downloadFile(localFs afero.Fs, client *sftp.Client, remote string, local string, mode fs.FileMode) error {
+	src, err := client.Open(remote)
+	if err != nil {
+		return fmt.Errorf("%s: %w", remote, err)
+	}
+	defer src.Close()
+
+	dst, err := localFs.OpenFile(local, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		return fmt.Errorf("%s: %w", remote, err)
+	}
+
+	return dst.Close()
+}
+
+// uploadPath copies a local file or directory to a remote path, into it if it is an existing directory,
+// and returns the remote files written
+func uploadPath(localFs afero.Fs, client *sftp.Client, local string, remote string, recursive bool) ([]string, error) {
+	info, err := localFs.Stat(local)
+	if err != nil {
+		return nil, err
+	}
+
+	target := remote
+	if remoteInfo, err := client.Stat(remote); err == nil && remoteInfo.IsDir() {
+		target = path.Join(remote, filepath.Base(local))
+	}
+
+	if !info.IsDir() {
+		err = uploadFile(localFs, client, local, target, info.Mode())
+		if err != nil {
+			return nil, err
+		}
+		return []string{target}, nil
+	}
+
+	if !recursive {
+		return nil, fmt.Errorf("%s is a directory, use --recursive", local)
+	}
+
+	var files []string
+
+	err = afero.Walk(localFs, local, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(local, p)
+		if err != nil {
+			return err
+		}
+		dest := path.Join(target, filepath.ToSlash(rel))
+
+		if info.IsDir() {
+			return client.MkdirAll(dest)
+		}
+
+		err = uploadFile(localFs, client, p, dest, info.Mode())
+		if err != nil {
+			return err
+		}
+		files = append(files, dest)
+		return nil
+	})
+
+	return files, err
+}
+
+func uploadFile(localFs afero.Fs, client *sftp.Client, local string, remote string, mode fs.FileMode) error {
+	src, err := localFs.Open(local)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := client.OpenFile(remote, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	if err != nil {
+		return fmt.Errorf("%s: %w", remote, err)
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		return fmt.Errorf("%s: %w", remote, err)
+	}
+
+	return client.Chmod(remote, mode.Perm())
+}
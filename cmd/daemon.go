@@ -0,0 +1,500 @@
+/*
+Package cmd daemon keeping credentials of logged-in karbon clusters fresh
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// defaultCredentialLifetime is used when the expiration of a credential can't be determined
+const defaultCredentialLifetime = 12 * time.Hour
+
+type daemonClusterStatus struct {
+	Name             string    `json:"name"`
+	Server           string    `json:"server"`
+	Kubeconfig       string    `json:"kubeconfig"`
+	KubeconfigExpiry time.Time `json:"kubeconfig_expiry,omitempty"`
+	SSHExpiry        time.Time `json:"ssh_expiry,omitempty"`
+	LastRefresh      time.Time `json:"last_refresh,omitempty"`
+	LastError        string    `json:"last_error,omitempty"`
+}
+
+type daemonStatus struct {
+	PID      int                   `json:"pid"`
+	Started  time.Time             `json:"started"`
+	Clusters []daemonClusterStatus `json:"clusters"`
+}
+
+type karbonDaemon struct {
+	*plugin
+
+	mu          sync.Mutex
+	clusters    []string
+	renewBefore time.Duration
+	prisms      map[string]*nutanixCluster
+	status      daemonStatus
+	// last refresh and error of the clusters by stateKey
+	refreshed map[string]time.Time
+	errors    map[string]string
+}
+
+// newDaemonCmd returns the daemon command
+func newDaemonCmd(p *plugin) *cobra.Command {
+	daemonCmd := &cobra.Command{
+		Use:   "daemon",
+		Short: "Keep kubeconfig and SSH key/cert of logged-in clusters fresh",
+		Long: `Run in the foreground and keep credentials of logged-in Karbon clusters fresh.
+
+Clusters logged in with the login command are tracked, kubeconfig and SSH key/cert are retrieved again
+shortly before they expire and SSH keys are added back to the ssh-agent.
+The daemon state is exposed on a local Unix socket, use "kubectl karbon daemon status" to display it.`,
+		PreRun: func(cmd *cobra.Command, args []string) {
+
+			p.viper.BindPFlag("cluster", cmd.Flags().Lookup("cluster"))
+			p.viper.BindPFlag("keyring", cmd.Flags().Lookup("keyring"))
+			p.viper.BindPFlag("daemon-socket", cmd.Flags().Lookup("socket"))
+			p.viper.BindPFlag("renew-before", cmd.Flags().Lookup("renew-before"))
+			p.viper.BindPFlag("check-interval", cmd.Flags().Lookup("check-interval"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			// the daemon always reports its activity
+			if p.logLevel.Level() > slog.LevelInfo {
+				p.logLevel.Set(slog.LevelInfo)
+			}
+
+			socket, err := p.daemonSocketPath()
+			if err != nil {
+				return err
+			}
+
+			listener, err := listenDaemonSocket(socket)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(socket)
+			defer listener.Close()
+
+			d := &karbonDaemon{
+				plugin:      p,
+				clusters:    p.viper.GetStringSlice("cluster"),
+				renewBefore: p.viper.GetDuration("renew-before"),
+				prisms:      map[string]*nutanixCluster{},
+				status:      daemonStatus{PID: os.Getpid(), Started: p.Clock.Now()},
+				refreshed:   map[string]time.Time{},
+				errors:      map[string]string{},
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			go d.serve(listener)
+
+			p.logger.Info("daemon started", "socket", socket, "renew_before", d.renewBefore)
+
+			interval := p.viper.GetDuration("check-interval")
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				d.refresh()
+
+				select {
+				case <-ctx.Done():
+					p.logger.Info("daemon stopped")
+					return nil
+				case <-ticker.C:
+				}
+			}
+		},
+	}
+
+	var clusters []string
+
+	daemonCmd.Flags().StringSliceVar(&clusters, "cluster", nil, "Only refresh these Karbon cluster(s) (default all logged-in clusters)")
+	daemonCmd.Flags().Bool("keyring", false, "Use keyring to store and retrieve credential")
+	daemonCmd.Flags().Duration("renew-before", time.Hour, "Refresh credentials this long before they expire")
+	daemonCmd.Flags().Duration("check-interval", time.Minute, "Interval between two expiration checks")
+
+	daemonCmd.PersistentFlags().String("socket", "", "Path of the daemon Unix socket (default ~/.kube/kubectl-karbon.sock)")
+
+	daemonCmd.AddCommand(newDaemonStatusCmd(p))
+
+	return daemonCmd
+}
+
+// newDaemonStatusCmd returns the daemon status command
+func newDaemonStatusCmd(p *plugin) *cobra.Command {
+	daemonStatusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Display the state of the running daemon",
+		Long:  `Connect to the local Unix socket of the running daemon and display the credentials it keeps fresh`,
+		PreRun: func(cmd *cobra.Command, args []string) {
+
+			p.viper.BindPFlag("daemon-socket", cmd.Flags().Lookup("socket"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			socket, err := p.daemonSocketPath()
+			if err != nil {
+				return err
+			}
+
+			conn, err := net.DialTimeout("unix", socket, 5*time.Second)
+			if err != nil {
+				return fmt.Errorf("unable to reach the daemon on %s: %w", socket, err)
+			}
+			defer conn.Close()
+
+			var status daemonStatus
+			err = json.NewDecoder(conn).Decode(&status)
+			if err != nil {
+				return err
+			}
+
+			if p.jsonOutputEnabled() {
+				return p.printJSONOutput(commandOutput{Command: commandName(cmd), Success: true, Result: status})
+			}
+
+			fmt.Fprintf(p.out, "Daemon running with pid %d since %s\n\n", status.PID, status.Started.Format(time.RFC3339))
+
+			w := new(tabwriter.Writer)
+			w.Init(p.out, 8, 8, 0, '\t', 0)
+
+			defer w.Flush()
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t", "NAME", "SERVER", "KUBECONFIG EXPIRY", "SSH EXPIRY", "LAST REFRESH", "ERROR")
+
+			for _, cluster := range status.Clusters {
+				fmt.Fprintf(w, "\n%s\t%s\t%s\t%s\t%s\t%s\t",
+					cluster.Name,
+					cluster.Server,
+					formatTime(cluster.KubeconfigExpiry),
+					formatTime(cluster.SSHExpiry),
+					formatTime(cluster.LastRefresh),
+					cluster.LastError)
+			}
+			fmt.Fprintf(w, "\n")
+			return nil
+		},
+	}
+
+	p.jsonOutputCommand(daemonStatusCmd)
+
+	return daemonStatusCmd
+}
+
+func (p *plugin) daemonSocketPath() (string, error) {
+	if socket := p.viper.GetString("daemon-socket"); socket != "" {
+		return p.expandHome(socket)
+	}
+
+	userHomeDir, err := p.homeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(userHomeDir, ".kube", "kubectl-karbon.sock"), nil
+}
+
+// listenDaemonSocket listens on the daemon socket, removing a stale socket left by a previous run
+func listenDaemonSocket(socket string) (net.Listener, error) {
+	if _, err := os.Stat(socket); err == nil {
+		conn, err := net.DialTimeout("unix", socket, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("a daemon is already running on %s", socket)
+		}
+		err = os.Remove(socket)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(socket), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(socket, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// serve sends the daemon status to every client connecting on the socket
+func (d *karbonDaemon) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		d.mu.Lock()
+		err = json.NewEncoder(conn).Encode(d.status)
+		d.mu.Unlock()
+		if err != nil {
+			d.logger.Warn("failed to send status", "error", err)
+		}
+		conn.Close()
+	}
+}
+
+// refresh checks every tracked cluster and renews the credentials about to expire
+func (d *karbonDaemon) refresh() {
+	state, err := d.loadState()
+	if err != nil {
+		d.logger.Error("failed to load state", "error", err)
+		return
+	}
+
+	var clusters []daemonClusterStatus
+
+	for _, key := range state.keys() {
+		entry := state.Clusters[key]
+		if len(d.clusters) > 0 && !slices.Contains(d.clusters, entry.Name) {
+			continue
+		}
+
+		err := d.refreshCluster(entry)
+		if err != nil {
+			d.logger.Error("refresh failed", "cluster", entry.Name, "server", entry.Server, "error", err)
+			d.errors[key] = err.Error()
+		} else {
+			delete(d.errors, key)
+		}
+
+		clusters = append(clusters, daemonClusterStatus{
+			Name:             entry.Name,
+			Server:           entry.Server,
+			Kubeconfig:       entry.Kubeconfig,
+			KubeconfigExpiry: entry.KubeconfigExpiry,
+			SSHExpiry:        entry.SSHExpiry,
+			LastRefresh:      d.refreshed[key],
+			LastError:        d.errors[key],
+		})
+	}
+
+	d.mu.Lock()
+	d.status.Clusters = clusters
+	d.mu.Unlock()
+}
+
+// refreshCluster renews kubeconfig and SSH key/cert of a cluster if they are about to expire
+func (d *karbonDaemon) refreshCluster(entry *clusterState) error {
+	now := d.Clock.Now()
+
+	kubeconfigDue := credentialDue(entry.KubeconfigExpiry, entry.UpdateTime, d.renewBefore, now)
+	sshDue := (entry.SSHFile || entry.SSHAgent) && credentialDue(entry.SSHExpiry, entry.UpdateTime, d.renewBefore, now)
+
+	if !kubeconfigDue && !sshDue {
+		return nil
+	}
+
+	nutanix, err := d.prism(entry)
+	if err != nil {
+		return err
+	}
+
+	if kubeconfigDue {
+		kubeconfigResponse, err := nutanix.getKubeconfig(entry.Name)
+		if err != nil {
+			d.forgetPrism(entry, err)
+			return err
+		}
+
+		options := kubeconfigOptions{
+			ContextName: entry.ContextTemplate,
+			Profile:     entry.Profile,
+			Namespace:   entry.Namespace,
+		}
+		// states written before the template was recorded only have the rendered name
+		if options.ContextName == "" {
+			options.ContextName = entry.ContextName
+		}
+		if entry.KubeconfigProxy {
+			options.ProxyURL = entry.ProxyURL
+		}
+
+		err = customizeKubeConfig(kubeconfigResponse, entry.Name, entry.Server, options)
+		if err != nil {
+			return err
+		}
+		if config, err := clientcmd.Load([]byte(kubeconfigResponse.KubeConfig)); err == nil && options.ContextName != "" {
+			entry.ContextName = config.CurrentContext
+		}
+
+		if entry.Merge {
+			err = d.mergeKubeConfig(entry.Kubeconfig, kubeconfigResponse, false)
+		} else {
+			err = afero.WriteFile(d.Fs, entry.Kubeconfig, []byte(kubeconfigResponse.KubeConfig), 0600)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write kubeconfig: %w", err)
+		}
+
+		entry.KubeconfigExpiry, _ = kubeconfigExpiry(kubeconfigResponse)
+		d.logger.Info("kubeconfig refreshed", "cluster", entry.Name, "kubeconfig", entry.Kubeconfig, "expiry", entry.KubeconfigExpiry)
+	}
+
+	if sshDue {
+		karbonSSH, err := nutanix.getSSHConfig(entry.Name)
+		if err != nil {
+			d.forgetPrism(entry, err)
+			return err
+		}
+
+		if entry.SSHFile {
+			privateKeyFile, certificateFile, err := d.sshKeyFiles(entry.Server, entry.Name)
+			if err != nil {
+				return err
+			}
+			err = d.saveKeyFile(privateKeyFile, certificateFile, *karbonSSH, true)
+			if err != nil {
+				return err
+			}
+			entry.SSHFiles = []string{privateKeyFile, certificateFile}
+		}
+
+		if entry.SSHAgent {
+			err = d.addKeyAgent(entry.Name, *karbonSSH, entry.SSHAgentConfirm)
+			if err != nil {
+				return err
+			}
+		}
+
+		if karbonSSH.Username != "" {
+			entry.SSHUsername = karbonSSH.Username
+		}
+		entry.SSHExpiry, _ = sshCertExpiry(*karbonSSH)
+		d.logger.Info("ssh key/cert refreshed", "cluster", entry.Name, "expiry", entry.SSHExpiry)
+	}
+
+	entry.UpdateTime = now
+	d.refreshed[stateKey(entry.Server, entry.Name)] = now
+
+	// only the refreshed fields are merged, into the state file read again as a login or logout may have changed it
+	return d.changeState(func(state *karbonState) error {
+		s, ok := state.Clusters[stateKey(entry.Server, entry.Name)]
+		if !ok {
+			d.logger.Info("cluster logged out during the refresh", "cluster", entry.Name, "server", entry.Server)
+			return nil
+		}
+
+		if kubeconfigDue {
+			s.ContextName = entry.ContextName
+			s.KubeconfigExpiry = entry.KubeconfigExpiry
+		}
+		if sshDue {
+			if entry.SSHFile {
+				s.SSHFiles = entry.SSHFiles
+			}
+			s.SSHUsername = entry.SSHUsername
+			s.SSHExpiry = entry.SSHExpiry
+		}
+		s.UpdateTime = now
+
+		return nil
+	})
+}
+
+// prism returns a Prism Central client for the cluster entry, retrieving the password once per server and user
+func (d *karbonDaemon) prism(entry *clusterState) (*nutanixCluster, error) {
+	key := prismKey(entry)
+
+	if nutanix, ok := d.prisms[key]; ok {
+		return nutanix, nil
+	}
+
+	password, ok := d.lookupPassword(entry.Server, entry.User)
+	if !ok {
+		if _, ok := d.inTerminal(); !ok {
+			return nil, fmt.Errorf("no password available for %s, use keyring option or KARBON_PASSWORD environment variable", key)
+		}
+		var err error
+		password, err = d.getCredentials(entry.Server, entry.User)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	nutanix := &nutanixCluster{
+		plugin:   d.plugin,
+		server:   entry.Server,
+		login:    entry.User,
+		password: password,
+		port:     entry.Port,
+		timeout:  d.viper.GetInt("request-timeout"),
+		insecure: entry.Insecure,
+		route:    prismRoute{proxyURL: entry.ProxyURL, sshJump: entry.SSHJump, sshJumpKey: entry.SSHJumpKey},
+	}
+	d.prisms[key] = nutanix
+
+	return nutanix, nil
+}
+
+// forgetPrism drops the cached Prism Central client when its credentials have been rejected
+func (d *karbonDaemon) forgetPrism(entry *clusterState, err error) {
+	if errors.Is(err, errInvalidCredentials) {
+		delete(d.prisms, prismKey(entry))
+	}
+}
+
+// prismKey identifies the Prism Central client of a cluster entry, by user, server and route
+func prismKey(entry *clusterState) string {
+	return fmt.Sprintf("%s@%s:%d %s %s %s", entry.User, entry.Server, entry.Port, entry.ProxyURL, entry.SSHJump, entry.SSHJumpKey)
+}
+
+// credentialDue reports if a credential must be renewed, falling back on its issue time when its expiry is unknown
+func credentialDue(expiry time.Time, issued time.Time, renewBefore time.Duration, now time.Time) bool {
+	if expiry.IsZero() {
+		return now.Sub(issued) >= defaultCredentialLifetime
+	}
+	return !now.Before(expiry.Add(-renewBefore))
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
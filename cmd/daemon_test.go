@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nutanix/kubectl-karbon/karbontest"
+	"github.com/spf13/afero"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func TestDaemonRefreshContextTemplate(t *testing.T) {
+	server := karbontest.NewServer(karbontest.Cluster{Name: "a"})
+	defer server.Close()
+
+	o, _, _ := testOptions(t)
+	t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+	err := executeCommand(t, o, append([]string{"login", "--cluster", "a", "--context-name", "{{.Cluster}}-{{.Server}}"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newPlugin(o)
+
+	entry, err := p.lookupState(server.Host(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContext := "a-" + server.Host()
+	if entry.ContextName != wantContext || entry.ContextTemplate != "{{.Cluster}}-{{.Server}}" {
+		t.Fatalf("state = %+v", entry)
+	}
+
+	// the template is rendered again with the profile of the login
+	entry.ContextTemplate = "{{.Profile}}-{{.Cluster}}"
+	entry.Profile = "prod"
+	entry.KubeconfigExpiry = time.Time{}
+	entry.UpdateTime = testNow.Add(-48 * time.Hour)
+
+	d := &karbonDaemon{
+		plugin:      p,
+		renewBefore: time.Hour,
+		prisms:      map[string]*nutanixCluster{},
+		refreshed:   map[string]time.Time{},
+	}
+	err = d.refreshCluster(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := afero.ReadFile(o.Fs, entry.Kubeconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := clientcmd.Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.CurrentContext != "prod-a" {
+		t.Errorf("current context = %s, want prod-a", config.CurrentContext)
+	}
+
+	entry, err = p.lookupState(server.Host(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.ContextName != "prod-a" {
+		t.Errorf("state context name = %s, want prod-a", entry.ContextName)
+	}
+}
+
+func TestDaemonRefreshKeepsConcurrentLogin(t *testing.T) {
+	server := karbontest.NewServer(karbontest.Cluster{Name: "a"})
+	defer server.Close()
+
+	o, _, _ := testOptions(t)
+	t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+	err := executeCommand(t, o, append([]string{"login", "--cluster", "a"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newPlugin(o)
+
+	entry, err := p.lookupState(server.Host(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.KubeconfigExpiry = time.Time{}
+	entry.UpdateTime = testNow.Add(-48 * time.Hour)
+
+	// a login with another namespace finishes while the daemon refreshes the entry read before
+	err = p.updateState(server.Host(), "a", func(s *clusterState) {
+		s.Namespace = "prod"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &karbonDaemon{
+		plugin:      p,
+		renewBefore: time.Hour,
+		prisms:      map[string]*nutanixCluster{},
+		refreshed:   map[string]time.Time{},
+	}
+	err = d.refreshCluster(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed, err := p.lookupState(server.Host(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.Namespace != "prod" {
+		t.Errorf("namespace of the login = %q, reverted by the refresh", refreshed.Namespace)
+	}
+	if !refreshed.UpdateTime.Equal(testNow) || refreshed.KubeconfigExpiry.IsZero() {
+		t.Errorf("refreshed state = %+v", refreshed)
+	}
+
+	// a refresh does not bring back a cluster logged out in between
+	err = p.removeState(server.Host(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.UpdateTime = testNow.Add(-48 * time.Hour)
+	err = d.refreshCluster(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := p.lookupState(server.Host(), "a"); entry != nil {
+		t.Errorf("logged out cluster back in the state: %+v", entry)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Package cmd dev provide development helpers like a fake Prism Central
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/nutanix/kubectl-karbon/karbontest"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+)
+
+// fakeClusterConfig is a cluster of the --clusters file of the fake server
+type fakeClusterConfig struct {
+	Name           string `json:"name"`
+	Status         string `json:"status,omitempty"`
+	Version        string `json:"version,omitempty"`
+	KubeAPIServer  string `json:"kubeapi_server,omitempty"`
+	DeploymentType string `json:"deployment_type,omitempty"`
+	NodePools      []struct {
+		Name     string `json:"name"`
+		Category string `json:"category,omitempty"`
+		Nodes    []struct {
+			Hostname    string `json:"hostname"`
+			IPv4Address string `json:"ipv4_address"`
+		} `json:"nodes,omitempty"`
+	} `json:"node_pools,omitempty"`
+}
+
+// newDevCmd returns the dev command
+func newDevCmd(p *plugin) *cobra.Command {
+	devCmd := &cobra.Command{
+		Use:   "dev",
+		Short: "Development helpers",
+		Long:  `Helpers to develop and demo the plugin without a Nutanix Prism Central.`,
+	}
+
+	devCmd.AddCommand(newDevFakeServerCmd(p))
+
+	return devCmd
+}
+
+// newDevFakeServerCmd returns the dev fake-server command
+func newDevFakeServerCmd(p *plugin) *cobra.Command {
+	devFakeServerCmd := &cobra.Command{
+		Use:   "fake-server",
+		Short: "Run a fake Prism Central serving the Karbon API",
+		Long: `Run a fake Prism Central serving the Karbon API used by the plugin, with demo clusters or the clusters
+of a YAML file, until interrupted.
+
+Kubeconfigs and SSH key/certs are generated, the k8s API servers and nodes they point to do not exist.`,
+		Example: `  kubectl karbon dev fake-server --listen 127.0.0.1:9440
+  KARBON_PASSWORD=nutanix/4u kubectl karbon login --server 127.0.0.1 --user admin -k --all`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			listen, _ := cmd.Flags().GetString("listen")
+			clustersFile, _ := cmd.Flags().GetString("clusters")
+			username, _ := cmd.Flags().GetString("user")
+			password, _ := cmd.Flags().GetString("password")
+			failures, _ := cmd.Flags().GetStringSlice("fail")
+
+			clusters := karbontest.DemoClusters()
+			if clustersFile != "" {
+				var err error
+				clusters, err = p.loadFakeClusters(clustersFile)
+				if err != nil {
+					return err
+				}
+			}
+
+			server := karbontest.NewUnstartedServer(clusters...)
+			server.SetCredentials(username, password)
+			cobra.CheckErr(server.Listen(listen))
+
+			for _, f := range failures {
+				pathPart, status, err := parseFakeFailure(f)
+				if err != nil {
+					return err
+				}
+				server.Fail(pathPart, status, 0)
+			}
+
+			server.StartTLS()
+			defer server.Close()
+
+			fmt.Fprintf(p.out, "Fake Prism Central listening on %s with %d cluster(s)\n", server.URL, len(clusters))
+			fmt.Fprintf(p.out, "Login with: KARBON_PASSWORD=%s kubectl karbon login --server %s --port %d --user %s --insecure\n",
+				shellQuote(password), server.Host(), server.Port(), shellQuote(username))
+
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+			return nil
+		},
+	}
+
+	devFakeServerCmd.Flags().String("listen", "127.0.0.1:9440", "Address to listen on")
+	devFakeServerCmd.Flags().String("clusters", "", "YAML file of the clusters to serve (default demo clusters)")
+	devFakeServerCmd.Flags().String("user", karbontest.DefaultUsername, "Username to accept")
+	devFakeServerCmd.Flags().String("password", karbontest.DefaultPassword, "Password to accept")
+	devFakeServerCmd.Flags().StringSlice("fail", nil, "Answer this HTTP status to the requests whose path contains the text, like '/ssh=500'")
+
+	return devFakeServerCmd
+}
+
+// loadFakeClusters reads the clusters of the fake server from a YAML file
+func (p *plugin) loadFakeClusters(file string) ([]karbontest.Cluster, error) {
+	path, err := p.expandHome(file)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := afero.ReadFile(p.Fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []fakeClusterConfig
+	err = yaml.UnmarshalStrict(data, &configs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clusters file %s: %w", file, err)
+	}
+
+	var clusters []karbontest.Cluster
+	for _, config := range configs {
+		cluster := karbontest.Cluster{
+			Name:           config.Name,
+			Status:         config.Status,
+			Version:        config.Version,
+			KubeAPIServer:  config.KubeAPIServer,
+			DeploymentType: config.DeploymentType,
+		}
+		for _, pool := range config.NodePools {
+			nodePool := karbontest.NodePool{Name: pool.Name, Category: pool.Category}
+			for _, node := range pool.Nodes {
+				nodePool.Nodes = append(nodePool.Nodes, karbontest.Node{Hostname: node.Hostname, IPv4Address: node.IPv4Address})
+			}
+			cluster.NodePools = append(cluster.NodePools, nodePool)
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	return clusters, nil
+}
+
+// parseFakeFailure parses a <path>=<status> failure
+func parseFakeFailure(failure string) (string, int, error) {
+	pathPart, status, ok := strings.Cut(failure, "=")
+	if !ok {
+		return "", 0, fmt.Errorf("invalid failure %q, use <path>=<status>", failure)
+	}
+
+	var code int
+	_, err := fmt.Sscanf(status, "%d", &code)
+	if err != nil || code < 100 || code > 599 {
+		return "", 0, fmt.Errorf("invalid HTTP status in failure %q", failure)
+	}
+
+	return pathPart, code, nil
+}
@@ -0,0 +1,190 @@
+package cmd_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nutanix/kubectl-karbon/cmd"
+	"github.com/nutanix/kubectl-karbon/karbontest"
+)
+
+// the e2e tests run the plugin in a process for its exit codes and output streams,
+// the behavior of the commands is tested in process with testOptions
+
+// the test binary runs the plugin when re-executed with this variable
+const e2eCommandEnv = "KARBON_E2E_COMMAND"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(e2eCommandEnv) == "1" {
+		cmd.Execute()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+type karbonRun struct {
+	stdout   string
+	stderr   string
+	exitCode int
+}
+
+type karbonEnv struct {
+	t        *testing.T
+	server   *karbontest.Server
+	home     string
+	password string
+}
+
+func newKarbonEnv(t *testing.T, clusters ...karbontest.Cluster) *karbonEnv {
+	server := karbontest.NewServer(clusters...)
+	t.Cleanup(server.Close)
+
+	return &karbonEnv{t: t, server: server, home: t.TempDir(), password: karbontest.DefaultPassword}
+}
+
+// run runs the plugin against the fake server in an empty home directory
+func (e *karbonEnv) run(args ...string) karbonRun {
+	e.t.Helper()
+
+	args = append(args, "--server", e.server.Host(), "--port", strconv.Itoa(e.server.Port()), "--user", karbontest.DefaultUsername, "--insecure")
+	return e.runWithoutServer(args...)
+}
+
+func (e *karbonEnv) runWithoutServer(args ...string) karbonRun {
+	e.t.Helper()
+
+	command := exec.Command(os.Args[0], args...)
+
+	env := []string{e2eCommandEnv + "=1", "HOME=" + e.home, "KARBON_PASSWORD=" + e.password}
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "KARBON_") && !strings.HasPrefix(v, "KUBECONFIG=") && !strings.HasPrefix(v, "HOME=") && !strings.HasPrefix(v, "SSH_AUTH_SOCK=") {
+			env = append(env, v)
+		}
+	}
+	command.Env = env
+
+	var stdout, stderr strings.Builder
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+
+	run := karbonRun{}
+	err := command.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		run.exitCode = exitErr.ExitCode()
+	} else if err != nil {
+		e.t.Fatal(err)
+	}
+	run.stdout = stdout.String()
+	run.stderr = stderr.String()
+
+	return run
+}
+
+func (e *karbonEnv) path(elem ...string) string {
+	return filepath.Join(append([]string{e.home}, elem...)...)
+}
+
+func TestList(t *testing.T) {
+	e := newKarbonEnv(t, karbontest.Cluster{Name: "prod-a", Version: "1.28.3-0"}, karbontest.Cluster{Name: "dev-b", Version: "1.27.9-0", Status: "kUpgrading"})
+
+	run := e.run("list")
+	if run.exitCode != 0 {
+		t.Fatalf("list failed: %s", run.stderr)
+	}
+	for _, want := range []string{"prod-a", "v1.28.3-0", "Active", "dev-b", "Upgrading"} {
+		if !strings.Contains(run.stdout, want) {
+			t.Errorf("list output misses %q:\n%s", want, run.stdout)
+		}
+	}
+
+	run = e.run("list", "-o", "json", "--version", ">=1.28")
+	var output struct {
+		Success bool `json:"success"`
+		Result  []struct {
+			Name string `json:"name"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal([]byte(run.stdout), &output); err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, run.stdout)
+	}
+	if !output.Success || len(output.Result) != 1 || output.Result[0].Name != "prod-a" {
+		t.Errorf("filtered list = %+v", output)
+	}
+}
+
+func TestLoginInvalidCredentials(t *testing.T) {
+	e := newKarbonEnv(t, karbontest.Cluster{Name: "a"})
+	e.password = "wrong"
+
+	run := e.run("login", "--cluster", "a")
+	if run.exitCode != 1 {
+		t.Errorf("exit code = %d, want 1", run.exitCode)
+	}
+	if !strings.Contains(run.stderr, "invalid client credentials") {
+		t.Errorf("stderr = %q", run.stderr)
+	}
+}
+
+func TestLoginPartialFailure(t *testing.T) {
+	e := newKarbonEnv(t, karbontest.Cluster{Name: "a"}, karbontest.Cluster{Name: "b"})
+	e.server.Fail("/clusters/b/kubeconfig", http.StatusInternalServerError, 0)
+
+	run := e.run("login", "--all", "--merge", "-o", "json")
+	if run.exitCode != 2 {
+		t.Errorf("exit code = %d, want 2", run.exitCode)
+	}
+
+	var output struct {
+		Success bool `json:"success"`
+		Result  []struct {
+			Cluster string `json:"cluster"`
+			Success bool   `json:"success"`
+			Error   string `json:"error"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal([]byte(run.stdout), &output); err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, run.stdout)
+	}
+
+	if output.Success || len(output.Result) != 2 {
+		t.Fatalf("output = %+v", output)
+	}
+	if !output.Result[0].Success || output.Result[1].Success || output.Result[1].Error == "" {
+		t.Errorf("results = %+v", output.Result)
+	}
+}
+
+func TestLoginSSHFailure(t *testing.T) {
+	e := newKarbonEnv(t, karbontest.Cluster{Name: "a"})
+	e.server.Fail("/ssh", http.StatusInternalServerError, 1)
+
+	run := e.run("login", "--cluster", "a", "--ssh-file", "-o", "json")
+	if run.exitCode != 0 {
+		t.Fatalf("login failed: %s", run.stderr)
+	}
+
+	if !strings.Contains(run.stdout, "failed to retrieve SSH key/cert") {
+		t.Errorf("warning missing from the result:\n%s", run.stdout)
+	}
+	if _, err := os.Stat(e.path(".ssh", "a")); !os.IsNotExist(err) {
+		t.Error("SSH key written without credentials")
+	}
+}
+
+func TestLoginUnknownCluster(t *testing.T) {
+	e := newKarbonEnv(t, karbontest.Cluster{Name: "a"})
+
+	run := e.run("login", "--cluster", "b")
+	if run.exitCode != 1 || !strings.Contains(run.stderr, "karbon cluster not found") {
+		t.Errorf("exit code = %d, stderr = %q", run.exitCode, run.stderr)
+	}
+}
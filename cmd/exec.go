@@ -0,0 +1,328 @@
+/*
+Package cmd exec run a command on all the nodes of a karbon cluster
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+// execResult is the outcome of the command on a node, also its JSON result
+type execResult struct {
+	Node       string `json:"node"`
+	ExitCode   int    `json:"exit_code"`
+	DurationMs int64  `json:"duration_ms"`
+	OutputFile string `json:"output_file,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	Duration time.Duration `json:"-"`
+	Err      error         `json:"-"`
+}
+
+// prefixWriter writes complete lines prefixed with the node name, sharing a lock with the other nodes
+type prefixWriter struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	for {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		w.writeLine(w.buf[:idx+1])
+		w.buf = w.buf[idx+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush writes the last incomplete line
+func (w *prefixWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.writeLine(append(w.buf, '\n'))
+		w.buf = nil
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fmt.Fprintf(w.out, "%s %s", w.prefix, line)
+}
+
+// newExecCmd returns the exec command
+func newExecCmd(p *plugin) *cobra.Command {
+	execCmd := &cobra.Command{
+		Use:   "exec <cluster> -- <command>",
+		Short: "Run a command on all the nodes of a k8s cluster",
+		Long: `Run a command over SSH on all the nodes of a Karbon cluster concurrently, using the Karbon SSH certificate.
+
+Output lines are prefixed with the node name and a summary of the exit codes is printed at the end.
+The command exits with a non zero code if the command failed on at least one node.
+With --output json the output lines go to stderr and the summary is the JSON result.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			positional, command := splitArgsAtDash(cmd, args)
+			if len(positional) != 1 {
+				return fmt.Errorf("accepts a cluster, received %d arg(s)", len(positional))
+			}
+			if len(command) == 0 {
+				return fmt.Errorf("a command must be given after --")
+			}
+			return nil
+		},
+		PreRun: func(cmd *cobra.Command, args []string) {
+
+			p.viper.BindPFlag("server", cmd.Flags().Lookup("server"))
+			p.viper.BindPFlag("user", cmd.Flags().Lookup("user"))
+			p.viper.BindPFlag("port", cmd.Flags().Lookup("port"))
+			p.viper.BindPFlag("insecure", cmd.Flags().Lookup("insecure"))
+			p.viper.BindPFlag("keyring", cmd.Flags().Lookup("keyring"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			positional, command := splitArgsAtDash(cmd, args)
+			karbonCluster := positional[0]
+
+			pools, _ := cmd.Flags().GetStringSlice("pool")
+			parallel, _ := cmd.Flags().GetInt("parallel")
+			outputDir, _ := cmd.Flags().GetString("output-dir")
+
+			if parallel < 1 {
+				return fmt.Errorf("parallel must be at least 1")
+			}
+
+			nutanixCluster, err := p.newNutanixCluster(cmd)
+			if err != nil {
+				return err
+			}
+
+			nodes, err := nutanixCluster.listKarbonNodes(karbonCluster)
+			if err != nil {
+				return err
+			}
+
+			nodes = filterNodes(nodes, pools)
+			if len(nodes) == 0 {
+				return fmt.Errorf("no node found in cluster %s", karbonCluster)
+			}
+
+			config, err := nutanixCluster.clusterSSHClientConfig(karbonCluster)
+			if err != nil {
+				return err
+			}
+
+			if outputDir != "" {
+				err = p.Fs.MkdirAll(outputDir, 0700)
+				if err != nil {
+					return err
+				}
+			}
+
+			// the standard output of the nodes is not part of the JSON result
+			streams := IOStreams{In: p.In, Out: p.out, ErrOut: p.ErrOut}
+
+			results := p.execNodes(streams, nutanixCluster.nodeRoute(karbonCluster), nodes, config, strings.Join(command, " "), parallel, outputDir)
+
+			failed := 0
+			for _, result := range results {
+				if result.Err != nil || result.ExitCode != 0 {
+					failed++
+				}
+			}
+
+			if p.jsonOutputEnabled() {
+				p.printJSONOutput(commandOutput{Command: commandName(cmd), Success: failed == 0, Result: results})
+			} else {
+				printExecResults(p.out, results)
+			}
+
+			if failed > 0 {
+				fmt.Fprintf(p.ErrOut, "Command failed on %d/%d node(s)\n", failed, len(results))
+				return exitWithCode(cmd, 1)
+			}
+			return nil
+		},
+	}
+
+	p.jsonOutputCommand(execCmd)
+
+	user, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+
+	execCmd.Flags().String("server", "", "Address of the PC to authenticate against")
+
+	execCmd.Flags().StringP("user", "u", user.Username, "Username to authenticate")
+
+	execCmd.Flags().Int("port", 9440, "Port to run Application server on")
+
+	execCmd.Flags().BoolP("insecure", "k", false, "Skip certificate verification (this is insecure)")
+
+	execCmd.Flags().Bool("keyring", false, "Use keyring to store and retrieve credential")
+
+	execCmd.Flags().StringSlice("pool", nil, "Only run on the nodes of these node pool(s), by name or category (master, worker, etcd)")
+	execCmd.Flags().Int("parallel", 10, "Maximum number of nodes running the command at the same time")
+	execCmd.Flags().String("output-dir", "", "Directory to save the output of every node in <node>.log")
+
+	return execCmd
+}
+
+// printExecResults prints the summary table of the exit codes of the nodes
+func printExecResults(out io.Writer, results []execResult) {
+	w := new(tabwriter.Writer)
+	w.Init(out, 8, 8, 0, '\t', 0)
+
+	fmt.Fprintf(w, "\n%s\t%s\t%s\t%s\t", "NODE", "EXIT", "DURATION", "ERROR")
+	for _, result := range results {
+		fmt.Fprintf(w, "\n%s\t%d\t%s\t%s\t", result.Node, result.ExitCode, result.Duration.Round(time.Millisecond), result.Error)
+	}
+	fmt.Fprintf(w, "\n")
+	w.Flush()
+}
+
+// filterNodes keeps the nodes of the given pools, matching pool name or category
+func filterNodes(nodes []karbonNode, pools []string) []karbonNode {
+	if len(pools) == 0 {
+		return nodes
+	}
+
+	var filtered []karbonNode
+	for _, node := range nodes {
+		for _, pool := range pools {
+			if node.Pool == pool || strings.EqualFold(node.Category, pool) {
+				filtered = append(filtered, node)
+				break
+			}
+		}
+	}
+
+	return filtered
+}
+
+// execNodes runs a command on the nodes with at most parallel concurrent connections,
+// results are returned in the order of the nodes
+func (p *plugin) execNodes(streams IOStreams, route prismRoute, nodes []karbonNode, config *ssh.ClientConfig, command string, parallel int, outputDir string) []execResult {
+	results := make([]execResult, len(nodes))
+
+	var outputMutex sync.Mutex
+
+	forEachParallel(nodes, parallel, func(i int, node karbonNode) {
+		start := time.Now()
+		exitCode, err := p.execNode(streams, route, node, config, command, &outputMutex, outputDir)
+		results[i] = execResult{
+			Node:     node.Hostname,
+			ExitCode: exitCode,
+			Duration: time.Since(start),
+			Err:      err,
+		}
+		results[i].DurationMs = results[i].Duration.Milliseconds()
+		if outputDir != "" {
+			results[i].OutputFile = execOutputFile(outputDir, node)
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+		}
+	})
+
+	return results
+}
+
+// execNode runs a command on a node, writing its prefixed output to the streams and optionally to a log file
+func (p *plugin) execNode(streams IOStreams, route prismRoute, node karbonNode, config *ssh.ClientConfig, command string, outputMutex *sync.Mutex, outputDir string) (int, error) {
+	client, err := p.dialNode(route, node, config)
+	if err != nil {
+		return -1, err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return -1, err
+	}
+	defer session.Close()
+
+	prefix := fmt.Sprintf("[%s]", node.Hostname)
+	stdout := &prefixWriter{mu: outputMutex, out: streams.Out, prefix: prefix}
+	stderr := &prefixWriter{mu: outputMutex, out: streams.ErrOut, prefix: prefix}
+	defer stdout.Flush()
+	defer stderr.Flush()
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	if outputDir != "" {
+		logFile, err := p.Fs.OpenFile(execOutputFile(outputDir, node), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return -1, err
+		}
+		defer logFile.Close()
+
+		// stdout and stderr are written by separate goroutines of the ssh session
+		var logMutex sync.Mutex
+		log := &lockedWriter{mu: &logMutex, out: logFile}
+		session.Stdout = io.MultiWriter(stdout, log)
+		session.Stderr = io.MultiWriter(stderr, log)
+	}
+
+	err = session.Run(command)
+
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	return 0, nil
+}
+
+// execOutputFile is the file of output-dir saving the output of a node
+func execOutputFile(outputDir string, node karbonNode) string {
+	return filepath.Join(outputDir, fmt.Sprintf("%s.log", node.Hostname))
+}
+
+// lockedWriter serializes writes to a shared writer
+type lockedWriter struct {
+	mu  *sync.Mutex
+	out io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.out.Write(p)
+}
@@ -0,0 +1,313 @@
+/*
+Package cmd export render kubernetes manifests from a karbon kubeconfig
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os/user"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+)
+
+// exportFormats are the default namespace of every supported export format
+var exportFormats = map[string]string{
+	"argocd": "argocd",
+	"secret": "default",
+	"flux":   "flux-system",
+	"capi":   "default",
+}
+
+// argocdClusterConfig is the config entry of an ArgoCD cluster secret
+type argocdClusterConfig struct {
+	BearerToken     string `json:"bearerToken,omitempty"`
+	TLSClientConfig struct {
+		Insecure bool   `json:"insecure"`
+		CAData   string `json:"caData,omitempty"`
+		CertData string `json:"certData,omitempty"`
+		KeyData  string `json:"keyData,omitempty"`
+	} `json:"tlsClientConfig"`
+}
+
+// exportResult is the JSON result of export, with the Secret when it is not applied
+type exportResult struct {
+	Cluster   string         `json:"cluster"`
+	Format    string         `json:"format"`
+	Namespace string         `json:"namespace"`
+	Name      string         `json:"name"`
+	Applied   bool           `json:"applied"`
+	Secret    *corev1.Secret `json:"secret,omitempty"`
+}
+
+// newExportCmd returns the export command
+func newExportCmd(p *plugin) *cobra.Command {
+	exportCmd := &cobra.Command{
+		Use:   "export <cluster>",
+		Short: "Render a Kubernetes Secret or a GitOps cluster registration from the kubeconfig of a k8s cluster",
+		Long: `Render a manifest from the kubeconfig of a Karbon cluster and write it to stdout or apply it to the current context.
+
+Supported formats (--as):
+  argocd  ArgoCD cluster secret (label argocd.argoproj.io/secret-type: cluster)
+  secret  Secret with the kubeconfig in the "kubeconfig" key
+  flux    Secret with the kubeconfig in the "value" key, for Flux kubeConfig.secretRef
+  capi    Cluster API kubeconfig secret (<cluster>-kubeconfig)
+
+With --output json the Secret is in the JSON result instead of the YAML manifest.`,
+		Args: cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+
+			p.viper.BindPFlag("server", cmd.Flags().Lookup("server"))
+			p.viper.BindPFlag("user", cmd.Flags().Lookup("user"))
+			p.viper.BindPFlag("port", cmd.Flags().Lookup("port"))
+			p.viper.BindPFlag("insecure", cmd.Flags().Lookup("insecure"))
+			p.viper.BindPFlag("keyring", cmd.Flags().Lookup("keyring"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			karbonCluster := args[0]
+
+			format, _ := cmd.Flags().GetString("as")
+			namespace, _ := cmd.Flags().GetString("namespace")
+			name, _ := cmd.Flags().GetString("name")
+			apply, _ := cmd.Flags().GetBool("apply")
+			kubeContext, _ := cmd.Flags().GetString("context")
+
+			defaultNamespace, ok := exportFormats[format]
+			if !ok {
+				return fmt.Errorf("unsupported format %q, use argocd, secret, flux or capi", format)
+			}
+			if namespace == "" {
+				namespace = defaultNamespace
+			}
+
+			nutanixCluster, err := p.newNutanixCluster(cmd)
+			if err != nil {
+				return err
+			}
+
+			kubeconfigResponse, err := nutanixCluster.getKubeconfig(karbonCluster)
+			if err != nil {
+				return err
+			}
+
+			secret, err := exportSecret(format, karbonCluster, kubeconfigResponse)
+			if err != nil {
+				return err
+			}
+
+			secret.Namespace = namespace
+			if name != "" {
+				secret.Name = name
+			}
+
+			result := exportResult{Cluster: karbonCluster, Format: format, Namespace: secret.Namespace, Name: secret.Name, Applied: apply}
+
+			if !apply {
+				if p.jsonOutputEnabled() {
+					result.Secret = secret
+					return p.printJSONOutput(commandOutput{Command: commandName(cmd), Success: true, Result: result})
+				}
+
+				data, err := yaml.Marshal(secret)
+				if err != nil {
+					return err
+				}
+
+				_, err = p.out.Write(data)
+				if err != nil {
+					return err
+				}
+				return nil
+			}
+
+			err = p.applySecret(secret, kubeContext)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(p.out, "Secret %s/%s applied for %s cluster\n", secret.Namespace, secret.Name, karbonCluster)
+
+			if p.jsonOutputEnabled() {
+				return p.printJSONOutput(commandOutput{Command: commandName(cmd), Success: true, Result: result})
+			}
+			return nil
+		},
+	}
+
+	p.jsonOutputCommand(exportCmd)
+
+	user, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+
+	exportCmd.Flags().String("server", "", "Address of the PC to authenticate against")
+
+	exportCmd.Flags().StringP("user", "u", user.Username, "Username to authenticate")
+
+	exportCmd.Flags().Int("port", 9440, "Port to run Application server on")
+
+	exportCmd.Flags().BoolP("insecure", "k", false, "Skip certificate verification (this is insecure)")
+
+	exportCmd.Flags().Bool("keyring", false, "Use keyring to store and retrieve credential")
+
+	exportCmd.Flags().String("as", "secret", "Format of the manifest (argocd, secret, flux or capi)")
+	exportCmd.Flags().StringP("namespace", "n", "", "Namespace of the Secret (default depends on the format)")
+	exportCmd.Flags().String("name", "", "Name of the Secret (default depends on the format)")
+	exportCmd.Flags().Bool("apply", false, "Apply the Secret to the current context instead of writing it to stdout")
+	exportCmd.Flags().String("context", "", "Context to apply the Secret to (default current context)")
+
+	return exportCmd
+}
+
+// exportSecret builds the Secret of the requested format from a karbon kubeconfig
+func exportSecret(format string, cluster string, kubeconfigResponse *kubeConfig) (*corev1.Secret, error) {
+	secret := &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: fmt.Sprintf("%s-kubeconfig", cluster),
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": "kubectl-karbon",
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+	}
+
+	kubeconfig := []byte(kubeconfigResponse.KubeConfig)
+
+	switch format {
+	case "secret":
+		secret.Data = map[string][]byte{"kubeconfig": kubeconfig}
+
+	case "flux":
+		secret.Data = map[string][]byte{"value": kubeconfig}
+
+	case "capi":
+		secret.Type = "cluster.x-k8s.io/secret"
+		secret.Labels["cluster.x-k8s.io/cluster-name"] = cluster
+		secret.Data = map[string][]byte{"value": kubeconfig}
+
+	case "argocd":
+		config, err := clientcmd.Load(kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+		}
+
+		context, ok := config.Contexts[config.CurrentContext]
+		if !ok {
+			return nil, fmt.Errorf("context %s not found in kubeconfig", config.CurrentContext)
+		}
+		kubeCluster, ok := config.Clusters[context.Cluster]
+		if !ok {
+			return nil, fmt.Errorf("cluster %s not found in kubeconfig", context.Cluster)
+		}
+		authInfo, ok := config.AuthInfos[context.AuthInfo]
+		if !ok {
+			return nil, fmt.Errorf("user %s not found in kubeconfig", context.AuthInfo)
+		}
+
+		var argocdConfig argocdClusterConfig
+		argocdConfig.BearerToken = authInfo.Token
+		argocdConfig.TLSClientConfig.Insecure = kubeCluster.InsecureSkipTLSVerify
+		if len(kubeCluster.CertificateAuthorityData) > 0 {
+			argocdConfig.TLSClientConfig.CAData = base64.StdEncoding.EncodeToString(kubeCluster.CertificateAuthorityData)
+		}
+		if len(authInfo.ClientCertificateData) > 0 {
+			argocdConfig.TLSClientConfig.CertData = base64.StdEncoding.EncodeToString(authInfo.ClientCertificateData)
+			argocdConfig.TLSClientConfig.KeyData = base64.StdEncoding.EncodeToString(authInfo.ClientKeyData)
+		}
+
+		configJSON, err := json.Marshal(argocdConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		secret.Name = fmt.Sprintf("karbon-%s", cluster)
+		secret.Labels["argocd.argoproj.io/secret-type"] = "cluster"
+		secret.StringData = map[string]string{
+			"name":   cluster,
+			"server": kubeCluster.Server,
+			"config": string(configJSON),
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+
+	return secret, nil
+}
+
+// applySecret server-side applies a Secret to a context of the kubeconfig of the --kubeconfig flag
+func (p *plugin) applySecret(secret *corev1.Secret, kubeContext string) error {
+	loadingRules, err := p.kubeconfigLoadingRules()
+	if err != nil {
+		return err
+	}
+
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+	if err != nil {
+		return err
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+
+	force := true
+	_, err = clientset.CoreV1().Secrets(secret.Namespace).Patch(context.Background(), secret.Name, types.ApplyPatchType, data, metav1.PatchOptions{
+		FieldManager: "kubectl-karbon",
+		Force:        &force,
+	})
+
+	return err
+}
+
+// kubeconfigLoadingRules loads the kubeconfig files of the --kubeconfig flag, a list like KUBECONFIG that it is bound to
+func (p *plugin) kubeconfigLoadingRules() (*clientcmd.ClientConfigLoadingRules, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.Precedence = nil
+
+	for _, kubeconfig := range filepath.SplitList(p.viper.GetString("kubeconfig")) {
+		kubeconfig, err := p.expandHome(kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		loadingRules.Precedence = append(loadingRules.Precedence, kubeconfig)
+	}
+
+	return loadingRules, nil
+}
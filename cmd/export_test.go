@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKubeconfigLoadingRules(t *testing.T) {
+	o, _, _ := testOptions(t)
+	p := newPlugin(o)
+	p.viper.Set("kubeconfig", "~/.kube/config:/etc/kube/other")
+
+	loadingRules, err := p.kubeconfigLoadingRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"/home/test/.kube/config", "/etc/kube/other"}
+	if loadingRules.ExplicitPath != "" || !reflect.DeepEqual(loadingRules.Precedence, want) {
+		t.Errorf("loading rules = %q %q, want precedence %q", loadingRules.ExplicitPath, loadingRules.Precedence, want)
+	}
+}
@@ -0,0 +1,245 @@
+/*
+Package cmd filter select karbon clusters without the fuzzy finder
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// clusterFilter selects clusters by name, status and version
+type clusterFilter struct {
+	all      bool
+	match    *regexp.Regexp
+	statuses []string
+	versions []versionConstraint
+}
+
+// versionConstraint is a comparison against a version, "1.28" matches all the 1.28.x versions
+type versionConstraint struct {
+	operator string
+	version  []int
+}
+
+// statusAliases maps the usual status names to the Karbon ones
+var statusAliases = map[string]string{
+	"running": "active",
+	"ready":   "active",
+	"failed":  "error",
+}
+
+// addClusterFilterFlags adds the cluster filter flags to a command
+func addClusterFilterFlags(flags *pflag.FlagSet) {
+	flags.Bool("all", false, "Select all the clusters (can be restricted with the other filters)")
+	flags.String("match", "", "Select the clusters whose name matches the regular expression")
+	flags.StringSlice("status", nil, "Select the clusters with one of the status (active or running, deploying, upgrading, error, ...)")
+	flags.String("version", "", "Select the clusters whose k8s version matches the constraints (like '>=1.28', '1.27' or '>=1.27,<1.29')")
+}
+
+// newClusterFilter builds the cluster filter from the flags of the command
+func newClusterFilter(flags *pflag.FlagSet) (*clusterFilter, error) {
+	filter := &clusterFilter{}
+
+	filter.all, _ = flags.GetBool("all")
+
+	match, _ := flags.GetString("match")
+	if match != "" {
+		// the whole name must match
+		re, err := regexp.Compile("^(?:" + match + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid --match expression: %w", err)
+		}
+		filter.match = re
+	}
+
+	statuses, _ := flags.GetStringSlice("status")
+	for _, status := range statuses {
+		filter.statuses = append(filter.statuses, normalizeStatus(status))
+	}
+
+	versions, _ := flags.GetString("version")
+	if versions != "" {
+		for _, constraint := range strings.Split(versions, ",") {
+			parsed, err := parseVersionConstraint(constraint)
+			if err != nil {
+				return nil, err
+			}
+			filter.versions = append(filter.versions, parsed)
+		}
+	}
+
+	return filter, nil
+}
+
+// active returns true when the clusters are selected by the filter instead of by name
+func (filter *clusterFilter) active() bool {
+	return filter.all || filter.match != nil || len(filter.statuses) > 0 || len(filter.versions) > 0
+}
+
+// matches returns true if the cluster is selected by the filter
+func (filter *clusterFilter) matches(cluster karbonCluster) bool {
+	if filter.match != nil && !filter.match.MatchString(cluster.Name) {
+		return false
+	}
+
+	if len(filter.statuses) > 0 {
+		status := normalizeStatus(cluster.Status)
+		found := false
+		for _, s := range filter.statuses {
+			if s == status {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(filter.versions) > 0 {
+		version, err := parseVersion(cluster.Version)
+		if err != nil {
+			return false
+		}
+		for _, constraint := range filter.versions {
+			if !constraint.matches(version) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// filterClusters returns the clusters selected by the filter
+func (filter *clusterFilter) filterClusters(clusters []karbonCluster) []karbonCluster {
+	var selected []karbonCluster
+	for _, cluster := range clusters {
+		if filter.matches(cluster) {
+			selected = append(selected, cluster)
+		}
+	}
+	return selected
+}
+
+// selectFilteredClusters returns the clusters selected by the filter
+func (nutanix *nutanixCluster) selectFilteredClusters(filter *clusterFilter) ([]karbonCluster, error) {
+	clusters, err := nutanix.listKarbonClusters()
+	if err != nil {
+		return nil, err
+	}
+
+	selected := filter.filterClusters(clusters)
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no cluster matches the filters")
+	}
+
+	return selected, nil
+}
+
+// normalizeStatus returns the lowercase status without the Karbon "k" prefix, aliases resolved
+func normalizeStatus(status string) string {
+	status = strings.TrimSpace(status)
+	if len(status) > 1 && status[0] == 'k' && status[1] >= 'A' && status[1] <= 'Z' {
+		status = status[1:]
+	}
+	status = strings.ToLower(status)
+
+	if alias, ok := statusAliases[status]; ok {
+		return alias
+	}
+	return status
+}
+
+func parseVersionConstraint(constraint string) (versionConstraint, error) {
+	constraint = strings.TrimSpace(constraint)
+
+	operator := "="
+	for _, op := range []string{">=", "<=", "!=", "==", ">", "<", "="} {
+		if rest, ok := strings.CutPrefix(constraint, op); ok {
+			operator = op
+			if op == "==" {
+				operator = "="
+			}
+			constraint = strings.TrimSpace(rest)
+			break
+		}
+	}
+
+	version, err := parseVersion(constraint)
+	if err != nil {
+		return versionConstraint{}, fmt.Errorf("invalid --version constraint: %w", err)
+	}
+
+	return versionConstraint{operator: operator, version: version}, nil
+}
+
+// parseVersion returns the numeric components of a version like v1.28.3-0
+func parseVersion(version string) ([]int, error) {
+	trimmed := strings.TrimPrefix(strings.TrimSpace(version), "v")
+	trimmed, _, _ = strings.Cut(trimmed, "-")
+
+	var parsed []int
+	for _, component := range strings.Split(trimmed, ".") {
+		n, err := strconv.Atoi(component)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", version)
+		}
+		parsed = append(parsed, n)
+	}
+
+	return parsed, nil
+}
+
+// matches compares the version with the constraint on the components given in the constraint only,
+// so that "<=1.28" matches 1.28.3
+func (constraint versionConstraint) matches(version []int) bool {
+	cmp := 0
+	for i, n := range constraint.version {
+		v := 0
+		if i < len(version) {
+			v = version[i]
+		}
+		if v != n {
+			if v < n {
+				cmp = -1
+			} else {
+				cmp = 1
+			}
+			break
+		}
+	}
+
+	switch constraint.operator {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	case "!=":
+		return cmp != 0
+	default:
+		return cmp == 0
+	}
+}
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/nutanix/kubectl-karbon/karbontest"
+	"github.com/spf13/afero"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// filterClusters are clusters of several names, status and versions
+var filterClusters = []karbontest.Cluster{
+	{Name: "prod-a", Version: "1.28.3-0"},
+	{Name: "prod-b", Version: "1.27.9-0", Status: "kUpgrading"},
+	{Name: "dev-c", Version: "1.28.1-0"},
+}
+
+func TestListFilters(t *testing.T) {
+	server := karbontest.NewServer(filterClusters...)
+	defer server.Close()
+
+	for _, test := range []struct {
+		filter []string
+		want   []string
+	}{
+		{nil, []string{"prod-a", "prod-b", "dev-c"}},
+		{[]string{"--match", "prod-.*"}, []string{"prod-a", "prod-b"}},
+		// the expression matches the whole name
+		{[]string{"--match", "prod"}, []string{}},
+		{[]string{"--status", "running"}, []string{"prod-a", "dev-c"}},
+		{[]string{"--version", ">=1.28"}, []string{"prod-a", "dev-c"}},
+		{[]string{"--match", "prod-.*", "--version", ">=1.28"}, []string{"prod-a"}},
+		{[]string{"--status", "error"}, []string{}},
+	} {
+		o, out, _ := testOptions(t)
+		t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+		args := append(append([]string{"list", "-o", "json"}, test.filter...), fakeServerArgs(server)...)
+		err := executeCommand(t, o, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var output struct {
+			Result []karbonCluster `json:"result"`
+		}
+		err = json.Unmarshal(out.Bytes(), &output)
+		if err != nil {
+			t.Fatalf("invalid JSON output: %v\n%s", err, out.String())
+		}
+		names := []string{}
+		for _, cluster := range output.Result {
+			names = append(names, cluster.Name)
+		}
+		if !slices.Equal(names, test.want) {
+			t.Errorf("list %q = %q, want %q", test.filter, names, test.want)
+		}
+	}
+}
+
+func TestLoginFilters(t *testing.T) {
+	server := karbontest.NewServer(filterClusters...)
+	defer server.Close()
+
+	for _, test := range []struct {
+		filter []string
+		want   []string
+	}{
+		{[]string{"--all"}, []string{"dev-c-context", "prod-a-context", "prod-b-context"}},
+		{[]string{"--match", "prod-.*", "--status", "active"}, []string{"prod-a-context"}},
+	} {
+		o, _, _ := testOptions(t)
+		t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+		args := append(append([]string{"login", "--merge"}, test.filter...), fakeServerArgs(server)...)
+		err := executeCommand(t, o, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := afero.ReadFile(o.Fs, "/home/test/.kube/config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := clientcmd.Load(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contexts := []string{}
+		for context := range config.Contexts {
+			contexts = append(contexts, context)
+		}
+		slices.Sort(contexts)
+		if !slices.Equal(contexts, test.want) {
+			t.Errorf("login %q contexts = %q, want %q", test.filter, contexts, test.want)
+		}
+	}
+
+	// a filter matching no cluster is an error, not a login into nothing
+	o, _, _ := testOptions(t)
+	t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+	err := executeCommand(t, o, append([]string{"login", "--match", "staging-.*"}, fakeServerArgs(server)...)...)
+	if err == nil {
+		t.Error("login with a filter matching no cluster succeeded")
+	}
+}
+
+func TestNormalizeStatus(t *testing.T) {
+	for status, want := range map[string]string{
+		"kActive":    "active",
+		"kUpgrading": "upgrading",
+		"Running":    "active",
+		"failed":     "error",
+		" kError ":   "error",
+		"k":          "k",
+	} {
+		if got := normalizeStatus(status); got != want {
+			t.Errorf("normalizeStatus(%q) = %q, want %q", status, got, want)
+		}
+	}
+}
+
+func TestVersionConstraint(t *testing.T) {
+	for _, test := range []struct {
+		constraint string
+		version    string
+		matches    bool
+	}{
+		{">=1.28", "v1.28.3-0", true},
+		{">=1.28", "1.27.9", false},
+		{"<=1.28", "1.28.3", true},
+		{"<1.28", "1.28.0", false},
+		{"1.28.3", "v1.28.3-0", true},
+		{"==1.28", "1.29.0", false},
+		{"!=1.28", "1.29.0", true},
+		{">1.27.9", "1.28", true},
+	} {
+		constraint, err := parseVersionConstraint(test.constraint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		version, err := parseVersion(test.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := constraint.matches(version); got != test.matches {
+			t.Errorf("%s matches %s = %v, want %v", test.constraint, test.version, got, test.matches)
+		}
+	}
+}
+
+func TestVersionConstraintInvalid(t *testing.T) {
+	for _, constraint := range []string{">=", "1.x", "latest"} {
+		if _, err := parseVersionConstraint(constraint); err == nil {
+			t.Errorf("parseVersionConstraint(%q) accepted", constraint)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Package cmd kubeconfig retrieve the kubeconfig of a karbon cluster
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os/user"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	clientcmdlatest "k8s.io/client-go/tools/clientcmd/api/latest"
+)
+
+// newKubeconfigCmd returns the kubeconfig command
+func newKubeconfigCmd(p *plugin) *cobra.Command {
+	kubeconfigCmd := &cobra.Command{
+		Use:   "kubeconfig",
+		Short: "Manage the kubeconfig of k8s clusters",
+		Long:  `Manage the kubeconfig of Karbon clusters without touching the local kubeconfig files`,
+	}
+
+	user, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+
+	kubeconfigCmd.PersistentFlags().String("server", "", "Address of the PC to authenticate against")
+
+	kubeconfigCmd.PersistentFlags().StringP("user", "u", user.Username, "Username to authenticate")
+
+	kubeconfigCmd.PersistentFlags().Int("port", 9440, "Port to run Application server on")
+
+	kubeconfigCmd.PersistentFlags().BoolP("insecure", "k", false, "Skip certificate verification (this is insecure)")
+
+	kubeconfigCmd.PersistentFlags().Bool("keyring", false, "Use keyring to store and retrieve credential")
+
+	kubeconfigCmd.AddCommand(newKubeconfigGetCmd(p))
+
+	return kubeconfigCmd
+}
+
+// kubeconfigGetResult is the JSON result of kubeconfig get, with the kubeconfig when it is not written to a file
+type kubeconfigGetResult struct {
+	Cluster    string     `json:"cluster"`
+	Format     string     `json:"format"`
+	Expiry     *time.Time `json:"expiry,omitempty"`
+	File       string     `json:"file,omitempty"`
+	Kubeconfig string     `json:"kubeconfig,omitempty"`
+}
+
+// newKubeconfigGetCmd returns the kubeconfig get command
+func newKubeconfigGetCmd(p *plugin) *cobra.Command {
+	kubeconfigGetCmd := &cobra.Command{
+		Use:   "get <cluster>",
+		Short: "Write the kubeconfig of a k8s cluster to stdout or a file",
+		Long: `Retrieve the kubeconfig of a Karbon cluster and write it to stdout or to the file given with --output-file.
+
+No existing kubeconfig file is modified, which makes it suitable for pipelines and CI secrets.
+With --output json the result gives the file written, or holds the kubeconfig instead of stdout.`,
+		Args: cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+
+			p.viper.BindPFlag("server", cmd.Flags().Lookup("server"))
+			p.viper.BindPFlag("user", cmd.Flags().Lookup("user"))
+			p.viper.BindPFlag("port", cmd.Flags().Lookup("port"))
+			p.viper.BindPFlag("insecure", cmd.Flags().Lookup("insecure"))
+			p.viper.BindPFlag("keyring", cmd.Flags().Lookup("keyring"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			output, _ := cmd.Flags().GetString("output-file")
+			format, _ := cmd.Flags().GetString("format")
+			minify, _ := cmd.Flags().GetBool("minify")
+			flatten, _ := cmd.Flags().GetBool("flatten")
+			encode, _ := cmd.Flags().GetBool("base64")
+
+			if format != "yaml" && format != "json" {
+				return fmt.Errorf("unsupported format %q, use yaml or json", format)
+			}
+
+			nutanixCluster, err := p.newNutanixCluster(cmd)
+			if err != nil {
+				return err
+			}
+
+			kubeconfigResponse, err := nutanixCluster.getKubeconfig(args[0])
+			if err != nil {
+				return err
+			}
+
+			data, err := renderKubeConfig(kubeconfigResponse, format, minify, flatten)
+			if err != nil {
+				return err
+			}
+
+			if encode {
+				data = []byte(base64.StdEncoding.EncodeToString(data) + "\n")
+			}
+
+			result := kubeconfigGetResult{Cluster: args[0], Format: format}
+			if expiry, err := kubeconfigExpiry(kubeconfigResponse); err == nil && !expiry.IsZero() {
+				result.Expiry = &expiry
+			}
+
+			if output == "" || output == "-" {
+				// the JSON result replaces stdout
+				if p.jsonOutputEnabled() {
+					result.Kubeconfig = string(data)
+					return p.printJSONOutput(commandOutput{Command: commandName(cmd), Success: true, Result: result})
+				}
+
+				_, err = p.out.Write(data)
+				if err != nil {
+					return err
+				}
+				return nil
+			}
+
+			output, err = p.expandHome(output)
+			if err != nil {
+				return err
+			}
+
+			err = afero.WriteFile(p.Fs, output, data, 0600)
+			if err != nil {
+				return err
+			}
+
+			if p.jsonOutputEnabled() {
+				result.File = output
+				return p.printJSONOutput(commandOutput{Command: commandName(cmd), Success: true, Result: result})
+			}
+			return nil
+		},
+	}
+
+	p.jsonOutputCommand(kubeconfigGetCmd)
+
+	kubeconfigGetCmd.Flags().String("output-file", "-", "File to write the kubeconfig to, - for stdout")
+	kubeconfigGetCmd.Flags().String("format", "yaml", "Output format (yaml or json)")
+	kubeconfigGetCmd.Flags().Bool("minify", false, "Remove all information not used by the current context")
+	kubeconfigGetCmd.Flags().Bool("flatten", false, "Embed the content of all referenced files")
+	kubeconfigGetCmd.Flags().Bool("base64", false, "Encode the output in base64, for a Kubernetes Secret or a CI variable")
+
+	return kubeconfigGetCmd
+}
+
+// renderKubeConfig serializes a karbon kubeconfig, raw when no transformation is requested
+func renderKubeConfig(kubeconfigResponse *kubeConfig, format string, minify bool, flatten bool) ([]byte, error) {
+	if format == "yaml" && !minify && !flatten {
+		return []byte(kubeconfigResponse.KubeConfig), nil
+	}
+
+	config, err := clientcmd.Load([]byte(kubeconfigResponse.KubeConfig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+
+	if minify {
+		err = clientcmdapi.MinifyConfig(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if flatten {
+		err = clientcmdapi.FlattenConfig(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if format == "yaml" {
+		return clientcmd.Write(*config)
+	}
+
+	external, err := clientcmdlatest.Scheme.ConvertToVersion(config, clientcmdlatest.ExternalVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(external, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, '\n'), nil
+}
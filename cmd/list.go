@@ -6,7 +6,7 @@ Licensed under the Apache License, Version 2.0 (the "License");
 you may not use this file except in compliance with the License.
 You may obtain a copy of the License at
 
-    http://www.apache.org/licenses/LICENSE-2.0
+	http://www.apache.org/licenses/LICENSE-2.0
 
 Unless required by applicable law or agreed to in writing, software
 distributed under the License is distributed on an "AS IS" BASIS,
@@ -18,55 +18,68 @@ package cmd
 
 import (
 	"fmt"
-	"os"
 	"os/user"
 	"text/tabwriter"
 
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
-// listCmd represents the list command
-var listCmd = &cobra.Command{
-	Use:   "list",
-	Short: "Get the list of k8s clusters",
-	Long:  `Return the list of all kubernetes cluster running on the tergeted Nutanix Karbon platform`,
-	PreRun: func(cmd *cobra.Command, args []string) {
-
-		viper.BindPFlag("server", cmd.Flags().Lookup("server"))
-		viper.BindPFlag("user", cmd.Flags().Lookup("user"))
-		viper.BindPFlag("port", cmd.Flags().Lookup("port"))
-		viper.BindPFlag("insecure", cmd.Flags().Lookup("insecure"))
-	},
-	Run: func(cmd *cobra.Command, args []string) {
-
-		nutanixCluster, err := newNutanixCluster()
-		if err != nil {
-			fmt.Println(err)
-			cmd.Usage()
-			return
-		}
-
-		clusters, err := nutanixCluster.listKarbonClusters()
-		cobra.CheckErr(err)
-
-		w := new(tabwriter.Writer)
-		w.Init(os.Stdout, 8, 8, 0, '\t', 0)
-
-		defer w.Flush()
-
-		fmt.Fprintf(w, "%s\t%s\t%s\t", "NAME", "VERSION", "STATUS")
-
-		for _, cluster := range clusters {
-			fmt.Fprintf(w, "\n%s\tv%s\t%s\t", cluster.Name, cluster.Version, cluster.Status[1:])
-		}
-		fmt.Fprintf(w, "\n")
-
-	},
-}
+// newListCmd returns the list command
+func newListCmd(p *plugin) *cobra.Command {
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "Get the list of k8s clusters",
+		Long:  `Return the list of all kubernetes cluster running on the tergeted Nutanix Karbon platform`,
+		PreRun: func(cmd *cobra.Command, args []string) {
+
+			p.viper.BindPFlag("server", cmd.Flags().Lookup("server"))
+			p.viper.BindPFlag("user", cmd.Flags().Lookup("user"))
+			p.viper.BindPFlag("port", cmd.Flags().Lookup("port"))
+			p.viper.BindPFlag("insecure", cmd.Flags().Lookup("insecure"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			nutanixCluster, err := p.newNutanixCluster(cmd)
+			if err != nil {
+				return err
+			}
+
+			filter, err := newClusterFilter(cmd.Flags())
+			if err != nil {
+				return err
+			}
+
+			clusters, err := nutanixCluster.listKarbonClusters()
+			if err != nil {
+				return err
+			}
+
+			clusters = filter.filterClusters(clusters)
+
+			if p.jsonOutputEnabled() {
+				if clusters == nil {
+					clusters = []karbonCluster{}
+				}
+				p.printJSONOutput(commandOutput{Command: commandName(cmd), Success: true, Result: clusters})
+				return nil
+			}
+
+			w := new(tabwriter.Writer)
+			w.Init(p.out, 8, 8, 0, '\t', 0)
+
+			defer w.Flush()
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t", "NAME", "VERSION", "STATUS")
+
+			for _, cluster := range clusters {
+				fmt.Fprintf(w, "\n%s\tv%s\t%s\t", cluster.Name, cluster.Version, cluster.Status[1:])
+			}
+			fmt.Fprintf(w, "\n")
+			return nil
+		},
+	}
 
-func init() {
-	rootCmd.AddCommand(listCmd)
+	p.jsonOutputCommand(listCmd)
 
 	user, err := user.Current()
 	if err != nil {
@@ -80,4 +93,8 @@ func init() {
 	listCmd.Flags().Int("port", 9440, "Port to run Application server on")
 
 	listCmd.Flags().BoolP("insecure", "k", false, "Skip certificate verification (this is insecure)")
+
+	addClusterFilterFlags(listCmd.Flags())
+
+	return listCmd
 }
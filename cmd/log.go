@@ -0,0 +1,114 @@
+/*
+Package cmd log configure the leveled logger of the plugin
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+)
+
+// secretFieldPattern matches the JSON fields whose value is never logged
+var secretFieldPattern = regexp.MustCompile(`(?i)(password|passphrase|secret|token|private_key|privatekey|kube_config|authorization)`)
+
+// setupLogger configures the logger from the --log-format, --log-file, --verbose and --debug settings,
+// the logs go to stderr without log file, warnings only by default, info with --verbose, debug with --debug
+func (p *plugin) setupLogger() error {
+	switch {
+	case p.debug || p.viper.GetBool("debug"):
+		p.logLevel.Set(slog.LevelDebug)
+	case p.verbose || p.viper.GetBool("verbose"):
+		p.logLevel.Set(slog.LevelInfo)
+	default:
+		p.logLevel.Set(slog.LevelWarn)
+	}
+
+	output := p.ErrOut
+	if path := p.viper.GetString("log-file"); path != "" {
+		path, err := p.expandHome(path)
+		if err != nil {
+			return err
+		}
+
+		file, err := p.Fs.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		output = file
+	}
+
+	handler, err := newLogHandler(p.viper.GetString("log-format"), output, p.logLevel)
+	if err != nil {
+		return err
+	}
+
+	p.logger = slog.New(handler)
+	return nil
+}
+
+func newLogHandler(format string, output io.Writer, level slog.Leveler) (slog.Handler, error) {
+	options := &slog.HandlerOptions{Level: level}
+
+	switch format {
+	case "", "text":
+		return slog.NewTextHandler(output, options), nil
+	case "json":
+		return slog.NewJSONHandler(output, options), nil
+	default:
+		return nil, fmt.Errorf("unsupported log format %q, use text or json", format)
+	}
+}
+
+// redactBody returns an HTTP body suitable for the logs, the values of the secret fields are replaced by REDACTED
+func redactBody(body []byte) string {
+	var value interface{}
+
+	if json.Unmarshal(body, &value) != nil {
+		return string(redactSecrets(body))
+	}
+
+	redacted, err := json.Marshal(redactValue(value))
+	if err != nil {
+		return ""
+	}
+
+	return string(redacted)
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if secretFieldPattern.MatchString(key) {
+				v[key] = "REDACTED"
+			} else {
+				v[key] = redactValue(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+	case string:
+		return string(redactSecrets([]byte(v)))
+	}
+
+	return value
+}
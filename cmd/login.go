@@ -17,140 +17,151 @@ limitations under the License.
 package cmd
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
-// loginCmd represents the login command
-var loginCmd = &cobra.Command{
-	Use:   "login",
-	Short: "Authenticate user with Nutanix Prism Central",
-	Long: `Authenticate user with Nutanix Prism Central and create a local kubeconfig file for the selected cluster.
-
-If option enabled retrieve SSH key/cert and add them to ssh-agent or in file in ~/.ssh/ folder`,
-	PreRun: func(cmd *cobra.Command, args []string) {
-
-		viper.BindPFlag("server", cmd.Flags().Lookup("server"))
-		viper.BindPFlag("cluster", cmd.Flags().Lookup("cluster"))
-		viper.BindPFlag("user", cmd.Flags().Lookup("user"))
-		viper.BindPFlag("port", cmd.Flags().Lookup("port"))
-		viper.BindPFlag("insecure", cmd.Flags().Lookup("insecure"))
-		viper.BindPFlag("kubie", cmd.Flags().Lookup("kubie"))
-		viper.BindPFlag("kubie-path", cmd.Flags().Lookup("kubie-path"))
-		viper.BindPFlag("ssh-agent", cmd.Flags().Lookup("ssh-agent"))
-		viper.BindPFlag("ssh-file", cmd.Flags().Lookup("ssh-file"))
-		viper.BindPFlag("force", cmd.Flags().Lookup("force"))
-		viper.BindPFlag("keyring", cmd.Flags().Lookup("keyring"))
-		viper.BindPFlag("merge", cmd.Flags().Lookup("merge"))
-	},
-	Run: func(cmd *cobra.Command, args []string) {
-
-		nutanixCluster, err := newNutanixCluster()
-		if err != nil {
-			fmt.Println(err)
-			cmd.Usage()
-			return
-		}
-
-		karbonClusters := viper.GetStringSlice("cluster")
-
-		if len(karbonClusters) == 0 {
-			karbonClusters, err = nutanixCluster.selectCluster()
-			cobra.CheckErr(err)
-		}
-
-		for _, karbonCluster := range karbonClusters {
-			//  Kubeconfig management section
-			if verbose {
-				fmt.Printf("Connect on https://%s:%d/ and retrieve Kubeconfig for cluster %s\n", nutanixCluster.server, nutanixCluster.port, karbonCluster)
+// newLoginCmd returns the login command
+func newLoginCmd(p *plugin) *cobra.Command {
+	loginCmd := &cobra.Command{
+		Use:   "login",
+		Short: "Authenticate user with Nutanix Prism Central",
+		Long: `Authenticate user with Nutanix Prism Central and create a local kubeconfig file for the selected cluster.
+
+If option enabled retrieve SSH key/cert and add them to ssh-agent or in file in ~/.ssh/ folder,
+and write OpenSSH Host entries for the cluster nodes in ~/.ssh/karbon.d/ folder`,
+		PreRun: func(cmd *cobra.Command, args []string) {
+
+			p.viper.BindPFlag("server", cmd.Flags().Lookup("server"))
+			p.viper.BindPFlag("cluster", cmd.Flags().Lookup("cluster"))
+			p.viper.BindPFlag("user", cmd.Flags().Lookup("user"))
+			p.viper.BindPFlag("port", cmd.Flags().Lookup("port"))
+			p.viper.BindPFlag("insecure", cmd.Flags().Lookup("insecure"))
+			p.viper.BindPFlag("kubie", cmd.Flags().Lookup("kubie"))
+			p.viper.BindPFlag("kubie-path", cmd.Flags().Lookup("kubie-path"))
+			p.viper.BindPFlag("ssh-agent", cmd.Flags().Lookup("ssh-agent"))
+			p.viper.BindPFlag("ssh-agent-confirm", cmd.Flags().Lookup("ssh-agent-confirm"))
+			p.viper.BindPFlag("ssh-file", cmd.Flags().Lookup("ssh-file"))
+			p.viper.BindPFlag("ssh-dir", cmd.Flags().Lookup("ssh-dir"))
+			p.viper.BindPFlag("ssh-file-name", cmd.Flags().Lookup("ssh-file-name"))
+			p.viper.BindPFlag("ssh-config", cmd.Flags().Lookup("ssh-config"))
+			p.viper.BindPFlag("force", cmd.Flags().Lookup("force"))
+			p.viper.BindPFlag("keyring", cmd.Flags().Lookup("keyring"))
+			p.viper.BindPFlag("merge", cmd.Flags().Lookup("merge"))
+			p.viper.BindPFlag("verify", cmd.Flags().Lookup("verify"))
+			p.viper.BindPFlag("kubeconfig-proxy-url", cmd.Flags().Lookup("kubeconfig-proxy-url"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			nutanixCluster, err := p.newNutanixCluster(cmd)
+			if err != nil {
+				return err
 			}
 
-			karbonKubeconfigPath := fmt.Sprintf("/karbon/v1/k8s/clusters/%s/kubeconfig", karbonCluster)
-			method := "GET"
-
-			kubeconfigResponseJSON, err := nutanixCluster.clusterRequest(method, karbonKubeconfigPath, nil)
-			cobra.CheckErr(err)
-
-			var kubeconfigResponse kubeConfig
-
-			err = json.Unmarshal([]byte(kubeconfigResponseJSON), &kubeconfigResponse)
-			cobra.CheckErr(err)
-
-			kubeconfig := viper.GetString("kubeconfig")
-
-			if viper.GetBool("kubie") {
-				kubiePath := viper.GetString("kubie-path")
-				clusterFile := fmt.Sprintf("%s.yaml", karbonCluster)
-				kubeconfig = filepath.Join(kubiePath, clusterFile)
+			filter, err := newClusterFilter(cmd.Flags())
+			if err != nil {
+				return err
 			}
 
-			if strings.HasPrefix(kubeconfig, "~/") {
-				userHomeDir, err := os.UserHomeDir()
-				cobra.CheckErr(err)
-				kubeconfig = filepath.Join(userHomeDir, kubeconfig[2:])
+			parallel, _ := cmd.Flags().GetInt("parallel")
+			if parallel < 1 {
+				return fmt.Errorf("parallel must be at least 1")
 			}
 
-			kubeconfigPath := filepath.Dir(kubeconfig)
-			_, err = os.Stat(kubeconfigPath)
+			karbonClusters := p.viper.GetStringSlice("cluster")
 
-			if os.IsNotExist(err) {
-				err := os.MkdirAll(kubeconfigPath, 0700)
-				cobra.CheckErr(err)
+			var selected []karbonCluster
+			switch {
+			case len(karbonClusters) > 0 && filter.active():
+				return fmt.Errorf("--cluster cannot be used with --all, --match, --status or --version")
+			case filter.active():
+				selected, err = nutanixCluster.selectFilteredClusters(filter)
+				if err != nil {
+					return err
+				}
+			case len(karbonClusters) == 0:
+				selected, err = nutanixCluster.selectCluster()
+				if errors.Is(err, errNoTerminal) {
+					err = fmt.Errorf("%w, use --cluster, --all or the --match, --status and --version filters", err)
+				}
+				if err != nil {
+					return err
+				}
 			}
 
-			err = SaveKubeConfig(kubeconfig, &kubeconfigResponse)
-			if err != nil {
-				cobra.CheckErr(fmt.Errorf("failed to save kubeconfig: %w", err))
+			// the clusters listed by the selection are not retrieved again for their UUID
+			listed := map[string]*karbonCluster{}
+			for i := range selected {
+				karbonClusters = append(karbonClusters, selected[i].Name)
+				listed[selected[i].Name] = &selected[i]
 			}
 
-			// SSH key/cert management section
-
-			if viper.GetBool("ssh-agent") || viper.GetBool("ssh-file") {
+			if p.viper.GetBool("kubeconfig-proxy-url") && nutanixCluster.route.proxyURL == "" {
+				return fmt.Errorf("--kubeconfig-proxy-url needs a proxy-url")
+			}
 
-				karbonSSHPath := fmt.Sprintf("/karbon/v1/k8s/clusters/%s/ssh", karbonCluster)
-				method = "GET"
+			results := make([]loginResult, len(karbonClusters))
 
-				if verbose {
-					fmt.Printf("Connect on https://%s:%d/ and retrieve SSH key/cert for cluster %s\n", nutanixCluster.server, nutanixCluster.port, karbonCluster)
+			forEachParallel(karbonClusters, parallel, func(i int, karbonCluster string) {
+				options := kubeconfigOptions{
+					ContextName: p.clusterSetting(cmd.Flags(), karbonCluster, "context-name"),
+					Profile:     p.viper.GetString("profile"),
+					Namespace:   p.clusterSetting(cmd.Flags(), karbonCluster, "namespace"),
+				}
+				if p.viper.GetBool("kubeconfig-proxy-url") {
+					options.ProxyURL = nutanixCluster.route.proxyURL
 				}
 
-				karbonSSHJSON, err := nutanixCluster.clusterRequest(method, karbonSSHPath, nil)
+				results[i] = nutanixCluster.loginCluster(karbonCluster, listed[karbonCluster], options)
+			})
 
-				if err != nil {
-					fmt.Printf("Failed to retrieve SSH key/cert for cluster %s\n", karbonCluster)
-				} else {
-					var karbonSSH sshConfig
-
-					err = json.Unmarshal([]byte(karbonSSHJSON), &karbonSSH)
-					cobra.CheckErr(err)
-
-					if viper.GetBool("ssh-file") {
-						err = saveKeyFile(karbonCluster, karbonSSH, viper.GetBool("force"))
-						cobra.CheckErr(err)
-					}
-
-					if viper.GetBool("ssh-agent") {
-						err = addKeyAgent(karbonCluster, karbonSSH)
-						cobra.CheckErr(err)
-					}
+			// printed once all the logins are done, in the order of the clusters
+			failed := 0
+			for i := range results {
+				if results[i].Err == nil {
+					fmt.Fprintf(p.out, "Logged successfully into %s cluster\n", results[i].Cluster)
+				}
+				if api := results[i].API; api != nil {
+					identity := valueOrDash(api.Username)
+					fmt.Fprintf(p.out, "Kubernetes API %s of %s cluster reachable in %dms, version %s, authenticated as %s\n", api.Server, results[i].Cluster, api.LatencyMs, api.ServerVersion, identity)
+				}
+				results[i].Success = results[i].Err == nil
+				if results[i].Err != nil {
+					results[i].Error = results[i].Err.Error()
+					failed++
 				}
+			}
 
+			switch {
+			case p.jsonOutputEnabled():
+				p.printJSONOutput(commandOutput{Command: commandName(cmd), Success: failed == 0, Result: results})
+			case len(results) == 1 && results[0].Err != nil:
+				return results[0].Err
+			case len(results) > 1:
+				printLoginResults(p.out, results)
 			}
 
-			fmt.Printf("Logged successfully into %s cluster\n", karbonCluster)
-		}
-	},
-}
+			switch {
+			case failed == len(results):
+				return exitWithCode(cmd, 1)
+			case failed > 0:
+				return exitWithCode(cmd, 2)
+			}
+			return nil
+		},
+	}
 
-func init() {
-	rootCmd.AddCommand(loginCmd)
+	p.jsonOutputCommand(loginCmd)
 
 	user, err := user.Current()
 	if err != nil {
@@ -165,6 +176,8 @@ func init() {
 
 	loginCmd.Flags().StringSliceVar(&clusters, "cluster", nil, "Karbon cluster(s) to connect to (multiple coma separated cluster names)")
 
+	addClusterFilterFlags(loginCmd.Flags())
+
 	loginCmd.Flags().Int("port", 9440, "Port to run Application server on")
 
 	loginCmd.Flags().BoolP("insecure", "k", false, "Skip certificate verification (this is insecure)")
@@ -177,11 +190,295 @@ func init() {
 
 	loginCmd.Flags().Bool("merge", false, "Use context feature for kubeconfig")
 
-	userHomeDir, err := os.UserHomeDir()
-	cobra.CheckErr(err)
-	defaultKubiePath := fmt.Sprintf("%s/.kube/kubie/", userHomeDir)
+	loginCmd.Flags().String("namespace", "", "Default namespace of the kubeconfig context")
+
+	loginCmd.Flags().String("context-name", "", "Name of the kubeconfig context, can be a template using {{.Cluster}}, {{.Profile}}, {{.Server}} and {{.Context}} (default from Karbon <cluster>-context)")
+
+	defaultKubiePath := fmt.Sprintf("%s/.kube/kubie/", p.HomeDir)
 	loginCmd.Flags().String("kubie-path", defaultKubiePath, "Path to kubie kubeconfig directory")
 
 	loginCmd.Flags().Bool("ssh-agent", false, "Add Key and Cert in SSH agent")
-	loginCmd.Flags().Bool("ssh-file", false, "Save Key and Cert in ~/.ssh/ directory")
+	loginCmd.Flags().Bool("ssh-agent-confirm", false, "Require the ssh-agent to confirm every use of the Key")
+	loginCmd.Flags().Bool("ssh-file", false, "Save Key and Cert in files of the SSH directory (see --ssh-dir)")
+	loginCmd.Flags().String("ssh-dir", "~/.ssh", "Directory of the Key and Cert files")
+	loginCmd.Flags().String("ssh-file-name", "{{.Cluster}}", "Name of the Key file, can be a template using {{.Cluster}}, {{.Profile}} and {{.Server}}, the Cert file has a -cert.pub suffix")
+	loginCmd.Flags().Int("parallel", 5, "Maximum number of clusters logged in at the same time")
+	loginCmd.Flags().Bool("ssh-config", false, "Write OpenSSH Host entries for the cluster nodes in ~/.ssh/karbon.d/ directory")
+	loginCmd.Flags().Bool("kubeconfig-proxy-url", false, "Write the proxy-url in the cluster entry of the kubeconfig, so that kubectl reaches the Kubernetes API through the same proxy")
+	loginCmd.Flags().Bool("verify", false, "Check the Kubernetes API is reachable with the new kubeconfig, and report its version and the authenticated identity")
+
+	return loginCmd
+}
+
+// loginResult is the outcome of the login into a cluster, also its JSON result
+type loginResult struct {
+	Cluster          string           `json:"cluster"`
+	Success          bool             `json:"success"`
+	Kubeconfig       string           `json:"kubeconfig,omitempty"`
+	Context          string           `json:"context,omitempty"`
+	KubeconfigExpiry *time.Time       `json:"kubeconfig_expiry,omitempty"`
+	FilesWritten     []string         `json:"files_written,omitempty"`
+	AgentKeys        []agentKeyResult `json:"agent_keys,omitempty"`
+	API              *apiVerification `json:"api,omitempty"`
+	Warnings         []string         `json:"warnings,omitempty"`
+	Error            string           `json:"error,omitempty"`
+
+	SSH string `json:"-"`
+	Err error  `json:"-"`
+}
+
+// agentKeyResult is a key added to or removed from the ssh-agent
+type agentKeyResult struct {
+	Comment string     `json:"comment"`
+	Expiry  *time.Time `json:"expiry,omitempty"`
+}
+
+// clusterLogin holds what is retrieved from Prism Central to login into a cluster
+type clusterLogin struct {
+	cluster    string
+	uuid       string
+	kubeconfig *kubeConfig
+	ssh        *sshConfig
+	sshErr     error
+	nodes      []karbonNode
+}
+
+// printLoginResults prints the summary table of a multi-cluster login
+func printLoginResults(out io.Writer, results []loginResult) {
+	w := new(tabwriter.Writer)
+	w.Init(out, 8, 8, 0, '\t', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "\n%s\t%s\t%s\t%s\t", "CLUSTER", "KUBECONFIG", "SSH", "ERROR")
+	for _, result := range results {
+		errMessage := "-"
+		if result.Err != nil {
+			errMessage = result.Err.Error()
+		}
+		fmt.Fprintf(w, "\n%s\t%s\t%s\t%s\t", result.Cluster, valueOrDash(result.Kubeconfig), valueOrDash(result.SSH), errMessage)
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// loginCluster retrieves the kubeconfig and, if enabled, the SSH key/cert of a karbon cluster,
+// records the login in the state file and verifies the Kubernetes API, it is safe to call concurrently,
+// listed is the cluster object when already listed, nil otherwise
+func (nutanixCluster *nutanixCluster) loginCluster(karbonCluster string, listed *karbonCluster, options kubeconfigOptions) loginResult {
+	result := loginResult{Cluster: karbonCluster}
+
+	login, err := nutanixCluster.fetchLogin(karbonCluster, listed)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	nutanixCluster.loginMutex.Lock()
+	result.Err = nutanixCluster.applyLogin(login, options, &result)
+	nutanixCluster.loginMutex.Unlock()
+
+	if result.Err == nil && nutanixCluster.viper.GetBool("verify") {
+		var warnings []string
+		result.API, warnings, result.Err = nutanixCluster.verifyKubeAPI(login.kubeconfig, nutanixCluster.route)
+		result.Warnings = append(result.Warnings, warnings...)
+	}
+
+	return result
+}
+
+// fetchLogin retrieves from Prism Central the kubeconfig, SSH key/cert and nodes needed by the login,
+// and the cluster object for its UUID when it was not listed
+func (nutanixCluster *nutanixCluster) fetchLogin(karbonCluster string, listed *karbonCluster) (*clusterLogin, error) {
+	login := &clusterLogin{cluster: karbonCluster}
+
+	var err error
+	if listed == nil {
+		listed, err = nutanixCluster.getKarbonCluster(karbonCluster)
+		if err != nil {
+			return nil, err
+		}
+	}
+	login.uuid = listed.UUID
+
+	login.kubeconfig, err = nutanixCluster.getKubeconfig(karbonCluster)
+	if err != nil {
+		return nil, err
+	}
+
+	if nutanixCluster.viper.GetBool("ssh-agent") || nutanixCluster.viper.GetBool("ssh-file") {
+		login.ssh, login.sshErr = nutanixCluster.getSSHConfig(karbonCluster)
+	}
+
+	if nutanixCluster.viper.GetBool("ssh-config") {
+		login.nodes, err = nutanixCluster.listKarbonNodes(karbonCluster)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return login, nil
+}
+
+// applyLogin writes the kubeconfig, the SSH key/cert, the state and the SSH config of a login,
+// the caller must hold loginMutex
+func (nutanixCluster *nutanixCluster) applyLogin(login *clusterLogin, options kubeconfigOptions, result *loginResult) error {
+	karbonCluster := login.cluster
+	kubeconfigResponse := login.kubeconfig
+
+	//  Kubeconfig management section
+	err := customizeKubeConfig(kubeconfigResponse, karbonCluster, nutanixCluster.server, options)
+	if err != nil {
+		return err
+	}
+
+	kubeconfig, err := nutanixCluster.kubeconfigFile(karbonCluster)
+	if err != nil {
+		return err
+	}
+
+	kubeconfigPath := filepath.Dir(kubeconfig)
+	_, err = nutanixCluster.Fs.Stat(kubeconfigPath)
+
+	if os.IsNotExist(err) {
+		err := nutanixCluster.Fs.MkdirAll(kubeconfigPath, 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = nutanixCluster.SaveKubeConfig(kubeconfig, kubeconfigResponse)
+	if err != nil {
+		return fmt.Errorf("failed to save kubeconfig: %w", err)
+	}
+	result.Kubeconfig = kubeconfig
+	result.FilesWritten = append(result.FilesWritten, kubeconfig)
+
+	state := clusterState{
+		Name:            karbonCluster,
+		UUID:            login.uuid,
+		Server:          nutanixCluster.server,
+		Port:            nutanixCluster.port,
+		User:            nutanixCluster.login,
+		Insecure:        nutanixCluster.insecure,
+		ProxyURL:        nutanixCluster.route.proxyURL,
+		SSHJump:         nutanixCluster.route.sshJump,
+		SSHJumpKey:      nutanixCluster.route.sshJumpKey,
+		Profile:         options.Profile,
+		Kubeconfig:      kubeconfig,
+		Namespace:       options.Namespace,
+		KubeconfigProxy: options.ProxyURL != "",
+		Merge:           nutanixCluster.viper.GetBool("merge") && !nutanixCluster.viper.GetBool("kubie"),
+		UpdateTime:      nutanixCluster.Clock.Now(),
+	}
+	state.KubeconfigExpiry, _ = kubeconfigExpiry(kubeconfigResponse)
+	if !state.KubeconfigExpiry.IsZero() {
+		result.KubeconfigExpiry = &state.KubeconfigExpiry
+	}
+	config, err := clientcmd.Load([]byte(kubeconfigResponse.KubeConfig))
+	if err == nil {
+		result.Context = config.CurrentContext
+		if options.ContextName != "" {
+			state.ContextName = config.CurrentContext
+			state.ContextTemplate = options.ContextName
+		}
+	}
+
+	// SSH key/cert management section
+
+	previous, err := nutanixCluster.lookupState(nutanixCluster.server, karbonCluster)
+	if err != nil {
+		return err
+	}
+	if previous != nil {
+		// keep track of the files of a previous login until they are replaced or removed
+		state.SSHFiles = previous.SSHFiles
+		state.SSHUsername = previous.SSHUsername
+	}
+
+	if login.sshErr != nil {
+		nutanixCluster.logger.Warn("failed to retrieve SSH key/cert", "cluster", karbonCluster, "error", login.sshErr)
+		result.SSH = "failed"
+		result.Warnings = append(result.Warnings, fmt.Sprintf("failed to retrieve SSH key/cert: %s", login.sshErr))
+	} else if karbonSSH := login.ssh; karbonSSH != nil {
+		var sshTargets []string
+
+		if nutanixCluster.viper.GetBool("ssh-file") {
+			privateKeyFile, certificateFile, err := nutanixCluster.configuredSSHKeyFiles(karbonCluster)
+			if err != nil {
+				return err
+			}
+
+			// files of a previous login at another location are stale
+			if len(state.SSHFiles) == 2 && state.SSHFiles[0] != privateKeyFile {
+				_, err = nutanixCluster.removeKeyFiles(state.SSHFiles...)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = nutanixCluster.saveKeyFile(privateKeyFile, certificateFile, *karbonSSH, nutanixCluster.viper.GetBool("force"))
+			if err != nil {
+				return err
+			}
+			state.SSHFile = true
+			state.SSHFiles = []string{privateKeyFile, certificateFile}
+			sshTargets = append(sshTargets, privateKeyFile)
+			result.FilesWritten = append(result.FilesWritten, privateKeyFile, certificateFile)
+		}
+
+		if nutanixCluster.viper.GetBool("ssh-agent") {
+			err = nutanixCluster.addKeyAgent(karbonCluster, *karbonSSH, nutanixCluster.viper.GetBool("ssh-agent-confirm"))
+			if err != nil {
+				return err
+			}
+			state.SSHAgent = true
+			state.SSHAgentConfirm = nutanixCluster.viper.GetBool("ssh-agent-confirm")
+			sshTargets = append(sshTargets, "ssh-agent")
+		}
+
+		state.SSHExpiry, _ = sshCertExpiry(*karbonSSH)
+		if state.SSHAgent {
+			agentKey := agentKeyResult{Comment: agentKeyComment(karbonCluster)}
+			if !state.SSHExpiry.IsZero() {
+				agentKey.Expiry = &state.SSHExpiry
+			}
+			result.AgentKeys = append(result.AgentKeys, agentKey)
+		}
+		if karbonSSH.Username != "" {
+			state.SSHUsername = karbonSSH.Username
+		}
+		result.SSH = strings.Join(sshTargets, ",")
+	}
+
+	// the state is saved first, the SSH config references the recorded key/cert files
+	err = nutanixCluster.updateState(nutanixCluster.server, karbonCluster, func(s *clusterState) {
+		*s = state
+	})
+	if err != nil {
+		return err
+	}
+
+	if nutanixCluster.viper.GetBool("ssh-config") {
+		sshUsername := state.SSHUsername
+		if sshUsername == "" {
+			sshUsername = defaultSSHUsername
+		}
+
+		sshConfigFile, err := nutanixCluster.writeSSHConfig(karbonCluster, login.nodes, sshUsername, nutanixCluster.route)
+		if err != nil {
+			return err
+		}
+
+		result.FilesWritten = append(result.FilesWritten, sshConfigFile)
+
+		nutanixCluster.logger.Info("SSH config file written", "file", sshConfigFile)
+	}
+
+	return nil
 }
@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/nutanix/kubectl-karbon/karbontest"
+	"github.com/spf13/afero"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func TestLogin(t *testing.T) {
+	server := karbontest.NewServer(karbontest.Cluster{Name: "a"})
+	defer server.Close()
+
+	o, out, _ := testOptions(t)
+	prompter := &fakePrompter{passwords: []string{karbontest.DefaultPassword}}
+	o.Prompter = prompter
+
+	err := executeCommand(t, o, append([]string{"login", "--cluster", "a", "--ssh-file"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(prompter.prompts) != 1 || !strings.Contains(prompter.prompts[0], karbontest.DefaultUsername) {
+		t.Errorf("prompts = %q", prompter.prompts)
+	}
+	if !strings.Contains(out.String(), "Logged successfully into a cluster") {
+		t.Errorf("output = %q", out.String())
+	}
+
+	data, err := afero.ReadFile(o.Fs, "/home/test/.kube/config")
+	if err != nil {
+		t.Fatalf("kubeconfig not written: %v", err)
+	}
+	config, err := clientcmd.Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.CurrentContext != "a-context" {
+		t.Errorf("current context = %s, want a-context", config.CurrentContext)
+	}
+
+	for _, file := range []string{"/home/test/.ssh/a", "/home/test/.ssh/a-cert.pub"} {
+		if _, err := o.Fs.Stat(file); err != nil {
+			t.Errorf("%s not written: %v", file, err)
+		}
+	}
+
+	data, err = afero.ReadFile(o.Fs, "/home/test/.kube/kubectl-karbon-state.json")
+	if err != nil {
+		t.Fatalf("state not written: %v", err)
+	}
+	var state karbonState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cluster := state.Clusters[stateKey(server.Host(), "a")]; cluster == nil || !cluster.UpdateTime.Equal(testNow) {
+		t.Errorf("state = %+v, want update time %s", cluster, testNow)
+	}
+}
+
+func TestLoginExistingKubeconfig(t *testing.T) {
+	server := karbontest.NewServer(karbontest.Cluster{Name: "a"}, karbontest.Cluster{Name: "b"})
+	defer server.Close()
+
+	o, _, _ := testOptions(t)
+	t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+	err := executeCommand(t, o, append([]string{"login", "--cluster", "a"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = executeCommand(t, o, append([]string{"login", "--cluster", "b", "--merge"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := afero.ReadFile(o.Fs, "/home/test/.kube/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := clientcmd.Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, context := range []string{"a-context", "b-context"} {
+		if _, ok := config.Contexts[context]; !ok {
+			t.Errorf("context %s not merged", context)
+		}
+	}
+	if config.CurrentContext != "b-context" {
+		t.Errorf("current context = %s, want b-context", config.CurrentContext)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	server := karbontest.NewServer(karbontest.Cluster{Name: "a"})
+	defer server.Close()
+
+	o, out, _ := testOptions(t)
+	t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+	err := executeCommand(t, o, append([]string{"login", "--cluster", "a", "--ssh-file"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	err = executeCommand(t, o, "logout", "--cluster", "a", "-o", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output struct {
+		Success bool         `json:"success"`
+		Result  logoutResult `json:"result"`
+	}
+	err = json.Unmarshal(out.Bytes(), &output)
+	if err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, out.String())
+	}
+	if !output.Success || len(output.Result.FilesRemoved) != 3 {
+		t.Errorf("output = %+v", output)
+	}
+
+	for _, file := range []string{"/home/test/.kube/config", "/home/test/.ssh/a", "/home/test/.ssh/a-cert.pub"} {
+		if exists, _ := afero.Exists(o.Fs, file); exists {
+			t.Errorf("%s not removed by logout", file)
+		}
+	}
+}
+
+func TestLogoutMerged(t *testing.T) {
+	server := karbontest.NewServer(karbontest.Cluster{Name: "a"}, karbontest.Cluster{Name: "b"})
+	defer server.Close()
+
+	o, _, _ := testOptions(t)
+	t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+	for _, cluster := range []string{"a", "b"} {
+		err := executeCommand(t, o, append([]string{"login", "--cluster", cluster, "--merge"}, fakeServerArgs(server)...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the merge mode of the login is used without --merge
+	err := executeCommand(t, o, "logout", "--cluster", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := afero.ReadFile(o.Fs, "/home/test/.kube/config")
+	if err != nil {
+		t.Fatalf("merged kubeconfig removed by logout: %v", err)
+	}
+	config, err := clientcmd.Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := config.Contexts["a-context"]; ok {
+		t.Error("context a-context not removed")
+	}
+	if _, ok := config.Contexts["b-context"]; !ok {
+		t.Error("context b-context removed with a")
+	}
+	if _, ok := config.Clusters["b"]; !ok {
+		t.Error("cluster entry of b removed with a")
+	}
+}
+
+func TestLoginVerify(t *testing.T) {
+	kubeAPI := karbontest.NewKubeAPIServer()
+	defer kubeAPI.Close()
+
+	server := karbontest.NewServer(karbontest.Cluster{Name: "a", KubeAPIServer: kubeAPI.Address()})
+	defer server.Close()
+
+	o, out, _ := testOptions(t)
+	t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+	err := executeCommand(t, o, append([]string{"login", "--cluster", "a", "--verify", "-o", "json"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output struct {
+		Success bool          `json:"success"`
+		Result  []loginResult `json:"result"`
+	}
+	err = json.Unmarshal(out.Bytes(), &output)
+	if err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, out.String())
+	}
+	if !output.Success || len(output.Result) != 1 || output.Result[0].API == nil {
+		t.Fatalf("output = %s", out.String())
+	}
+
+	api := output.Result[0].API
+	if api.ServerVersion != "v1.28.3" || api.Username != "a" || api.Server != kubeAPI.URL {
+		t.Errorf("api = %+v", api)
+	}
+	if len(output.Result[0].Warnings) != 0 {
+		t.Errorf("warnings = %q", output.Result[0].Warnings)
+	}
+}
+
+func TestLoginVerifyVersionSkew(t *testing.T) {
+	kubeAPI := karbontest.NewKubeAPIServer()
+	defer kubeAPI.Close()
+
+	server := karbontest.NewServer(karbontest.Cluster{Name: "a", KubeAPIServer: kubeAPI.Address()})
+	defer server.Close()
+
+	o, out, _ := testOptions(t)
+	o.Kubectl = fakeKubectl{version: version.Info{Major: "1", Minor: "25", GitVersion: "v1.25.0"}}
+	t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+	err := executeCommand(t, o, append([]string{"login", "--cluster", "a", "--verify", "-o", "json"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output struct {
+		Result []loginResult `json:"result"`
+	}
+	err = json.Unmarshal(out.Bytes(), &output)
+	if err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, out.String())
+	}
+	if len(output.Result) != 1 || len(output.Result[0].Warnings) != 1 || !strings.Contains(output.Result[0].Warnings[0], "kubectl v1.25.0") {
+		t.Errorf("output = %s", out.String())
+	}
+}
+
+func TestLoginFilteredReusesListedClusters(t *testing.T) {
+	server := karbontest.NewServer(karbontest.Cluster{Name: "a"}, karbontest.Cluster{Name: "b"})
+	defer server.Close()
+
+	o, _, _ := testOptions(t)
+	t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+	err := executeCommand(t, o, append([]string{"login", "--all", "--merge"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, request := range server.Requests() {
+		if request == "GET /karbon/v1-beta.1/k8s/clusters/a" || request == "GET /karbon/v1-beta.1/k8s/clusters/b" {
+			t.Errorf("listed cluster retrieved again: %s", request)
+		}
+	}
+
+	p := newPlugin(o)
+	for _, cluster := range []string{"a", "b"} {
+		state, err := p.lookupState(server.Host(), cluster)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state == nil || state.UUID == "" {
+			t.Errorf("state of %s = %+v, want the UUID of the listing", cluster, state)
+		}
+	}
+}
@@ -6,7 +6,7 @@ Licensed under the Apache License, Version 2.0 (the "License");
 you may not use this file except in compliance with the License.
 You may obtain a copy of the License at
 
-    http://www.apache.org/licenses/LICENSE-2.0
+	http://www.apache.org/licenses/LICENSE-2.0
 
 Unless required by applicable law or agreed to in writing, software
 distributed under the License is distributed on an "AS IS" BASIS,
@@ -18,75 +18,166 @@ package cmd
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
 
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
-// logoutCmd represents the logout command
-var logoutCmd = &cobra.Command{
-	Use:   "logout",
-	Short: "Remove all authentication items for the selected Karbon cluster",
-	Long: `Remove all authentication items for the selected Karbon cluster.
+// newLogoutCmd returns the logout command
+func newLogoutCmd(p *plugin) *cobra.Command {
+	logoutCmd := &cobra.Command{
+		Use:   "logout",
+		Short: "Remove all authentication items for the selected Karbon cluster",
+		Long: `Remove all authentication items for the selected Karbon cluster.
 	
-Remove the local kubeconfig file, The SSH key/cert from file and SSH agent`,
-	PreRun: func(cmd *cobra.Command, args []string) {
-
-		viper.BindPFlag("cluster", cmd.Flags().Lookup("cluster"))
-		viper.BindPFlag("kubie", cmd.Flags().Lookup("kubie"))
-		viper.BindPFlag("kubie-path", cmd.Flags().Lookup("kubie-path"))
-		viper.BindPFlag("ssh-agent", cmd.Flags().Lookup("ssh-agent"))
-		viper.BindPFlag("ssh-file", cmd.Flags().Lookup("ssh-file"))
-	},
-	Run: func(cmd *cobra.Command, args []string) {
-
-		karbonCluster := viper.GetString("cluster")
-		if karbonCluster == "" {
-			fmt.Fprintln(os.Stderr, "Error: required flag \"cluster\" not set")
-			cmd.Usage()
-			return
-		}
-
-		kubeconfig := viper.GetString("kubeconfig")
-
-		if viper.GetBool("kubie") {
-			kubiePath := viper.GetString("kubie-path")
-			clusterFile := fmt.Sprintf("%s.yaml", karbonCluster)
-			kubeconfig = filepath.Join(kubiePath, clusterFile)
-		}
-
-		err := os.Remove(kubeconfig)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-		}
-
-		if viper.GetBool("ssh-file") {
-			err := deleteKeyFile(karbonCluster)
-			cobra.CheckErr(err)
-		}
-
-		if viper.GetBool("ssh-agent") {
-			err = deleteKeyAgent(karbonCluster)
-			cobra.CheckErr(err)
-		}
-
-		fmt.Printf("Logged out successfully from %s cluster\n", karbonCluster)
-	},
-}
-
-func init() {
-	rootCmd.AddCommand(logoutCmd)
-
+Remove the local kubeconfig file, The SSH key/cert from file and SSH agent, the generated SSH config file.
+
+With --merge only the context of the cluster is removed from the kubeconfig file.
+For a login recorded in the state file, the kubeconfig file, the merge mode and the ssh-agent key of the login are used.
+--server is only needed when clusters of the same name were logged in from several Prism Centrals.`,
+		PreRun: func(cmd *cobra.Command, args []string) {
+
+			p.viper.BindPFlag("server", cmd.Flags().Lookup("server"))
+			p.viper.BindPFlag("cluster", cmd.Flags().Lookup("cluster"))
+			p.viper.BindPFlag("kubie", cmd.Flags().Lookup("kubie"))
+			p.viper.BindPFlag("kubie-path", cmd.Flags().Lookup("kubie-path"))
+			p.viper.BindPFlag("ssh-agent", cmd.Flags().Lookup("ssh-agent"))
+			p.viper.BindPFlag("ssh-file", cmd.Flags().Lookup("ssh-file"))
+			p.viper.BindPFlag("merge", cmd.Flags().Lookup("merge"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			karbonCluster := p.viper.GetString("cluster")
+			if karbonCluster == "" {
+				fmt.Fprintln(p.ErrOut, "Error: required flag \"cluster\" not set")
+				cmd.Usage()
+				return nil
+			}
+
+			result := logoutResult{Cluster: karbonCluster}
+
+			server := p.viper.GetString("server")
+
+			state, err := p.lookupState(server, karbonCluster)
+			if err != nil {
+				return err
+			}
+
+			kubeconfig := p.viper.GetString("kubeconfig")
+			merge := p.viper.GetBool("merge")
+			contextName := karbonCluster + "-context"
+
+			switch {
+			case state != nil:
+				// what the login did, even if the settings changed in between
+				server = state.Server
+				kubeconfig = state.Kubeconfig
+				merge = state.Merge
+				if state.ContextName != "" {
+					contextName = state.ContextName
+				}
+			case p.viper.GetBool("kubie"):
+				kubiePath := p.viper.GetString("kubie-path")
+				clusterFile := fmt.Sprintf("%s.yaml", karbonCluster)
+				kubeconfig = filepath.Join(kubiePath, clusterFile)
+				merge = false
+			}
+
+			if merge {
+				err = p.removeKubeconfigContext(kubeconfig, contextName)
+				if err == nil {
+					result.ContextsRemoved = append(result.ContextsRemoved, contextName)
+				}
+			} else {
+				err = p.Fs.Remove(kubeconfig)
+				if err == nil {
+					result.FilesRemoved = append(result.FilesRemoved, kubeconfig)
+				}
+			}
+			if err != nil {
+				fmt.Fprintln(p.ErrOut, err)
+				result.Warnings = append(result.Warnings, err.Error())
+			}
+
+			// files recorded at login are always removed
+			if p.viper.GetBool("ssh-file") || (state != nil && len(state.SSHFiles) > 0) {
+				removed, err := p.deleteKeyFile(server, karbonCluster)
+				if err != nil {
+					return err
+				}
+				result.FilesRemoved = append(result.FilesRemoved, removed...)
+			}
+
+			if p.viper.GetBool("ssh-agent") || (state != nil && state.SSHAgent) {
+				removed, err := p.deleteKeyAgent(karbonCluster)
+				if err != nil {
+					return err
+				}
+				for i := 0; i < removed; i++ {
+					result.AgentKeysRemoved = append(result.AgentKeysRemoved, agentKeyResult{Comment: agentKeyComment(karbonCluster)})
+				}
+			}
+
+			sshConfigFile, err := p.deleteSSHConfig(karbonCluster)
+			if err != nil {
+				return err
+			}
+			if sshConfigFile != "" {
+				result.FilesRemoved = append(result.FilesRemoved, sshConfigFile)
+			}
+
+			err = p.removeState(server, karbonCluster)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(p.out, "Logged out successfully from %s cluster\n", karbonCluster)
+
+			if p.jsonOutputEnabled() {
+				result.Success = true
+				p.printJSONOutput(commandOutput{Command: commandName(cmd), Success: true, Result: result})
+			}
+			return nil
+		},
+	}
+
+	p.jsonOutputCommand(logoutCmd)
+
+	logoutCmd.Flags().String("server", "", "Address of the PC the cluster was logged in from")
 	logoutCmd.Flags().String("cluster", "", "Karbon cluster to disconnect against")
 	logoutCmd.Flags().Bool("kubie", false, "Remove kubeconfig independent file from kubie-path directory")
 
-	userHomeDir, err := os.UserHomeDir()
-	cobra.CheckErr(err)
-	defaultKubiePath := fmt.Sprintf("%s/.kube/kubie/", userHomeDir)
+	defaultKubiePath := fmt.Sprintf("%s/.kube/kubie/", p.HomeDir)
 	logoutCmd.Flags().String("kubie-path", defaultKubiePath, "Path to kubie kubeconfig directory")
 
 	logoutCmd.Flags().Bool("ssh-agent", false, "Remove Key and Cert from SSH agent")
 	logoutCmd.Flags().Bool("ssh-file", false, "Remove Key and Cert from~/.ssh/ directory")
+	logoutCmd.Flags().Bool("merge", false, "Only remove the context of the cluster from the kubeconfig file")
+
+	return logoutCmd
+}
+
+// logoutResult is the JSON result of the logout command
+type logoutResult struct {
+	Cluster          string           `json:"cluster"`
+	Success          bool             `json:"success"`
+	FilesRemoved     []string         `json:"files_removed,omitempty"`
+	ContextsRemoved  []string         `json:"contexts_removed,omitempty"`
+	AgentKeysRemoved []agentKeyResult `json:"agent_keys_removed,omitempty"`
+	Warnings         []string         `json:"warnings,omitempty"`
+}
+
+// removeKubeconfigContext removes a context from a merged kubeconfig file, with its cluster and user when unused
+func (p *plugin) removeKubeconfigContext(kubeconfig string, contextName string) error {
+	config, err := p.loadKubeconfigFile(kubeconfig)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := config.Contexts[contextName]; !ok {
+		return fmt.Errorf("context %s not found in %s", contextName, kubeconfig)
+	}
+	removeContext(config, contextName)
+
+	return p.writeKubeconfigFile(*config, kubeconfig)
 }
@@ -0,0 +1,149 @@
+/*
+Package cmd options the dependencies of the commands, replaced by fakes in tests
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/term"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+// IOStreams are the standard streams of the commands, like the genericclioptions.IOStreams of kubectl
+type IOStreams struct {
+	In     io.Reader
+	Out    io.Writer
+	ErrOut io.Writer
+}
+
+// inTerminal returns the file descriptor of In and whether it is a terminal, a stream without file descriptor is not
+func (s IOStreams) inTerminal() (int, bool) {
+	file, ok := s.In.(interface{ Fd() uintptr })
+	if !ok {
+		return 0, false
+	}
+
+	fd := int(file.Fd())
+	return fd, term.IsTerminal(fd)
+}
+
+// PasswordPrompter asks the user for a password or a passphrase
+type PasswordPrompter interface {
+	PromptPassword(prompt string) (string, error)
+}
+
+// Clock returns the current time, the expiries of kubeconfigs and SSH certs are computed from it
+type Clock interface {
+	Now() time.Time
+}
+
+// Kubectl is the local kubectl whose client version login --verify compares with the Kubernetes API
+type Kubectl interface {
+	ClientVersion() (*version.Info, error)
+}
+
+// Options are the dependencies of the commands given to NewRootCommand
+type Options struct {
+	IOStreams
+
+	// Fs holds the files of the commands: config, kubeconfig, SSH key/cert, SSH config,
+	// known_hosts, state, log, record and the local files of cp, exec and support-bundle
+	Fs       afero.Fs
+	Prompter PasswordPrompter
+	Clock    Clock
+	Kubectl  Kubectl
+	// HomeDir is where ~/ and the default files are, the home directory of the user by default
+	HomeDir string
+}
+
+// terminalPrompter prints the prompt and reads the password from the terminal without echo
+type terminalPrompter struct {
+	out io.Writer
+}
+
+func (p terminalPrompter) PromptPassword(prompt string) (string, error) {
+	fmt.Fprintln(p.out, prompt)
+
+	password, err := term.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		return "", err
+	}
+
+	return string(password), nil
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewDefaultOptions returns the options of the plugin run from a terminal
+func NewDefaultOptions() *Options {
+	return &Options{
+		IOStreams: IOStreams{In: os.Stdin, Out: os.Stdout, ErrOut: os.Stderr},
+		Fs:        afero.NewOsFs(),
+		Prompter:  terminalPrompter{out: os.Stderr},
+		Clock:     realClock{},
+		Kubectl:   &pathKubectl{},
+		HomeDir:   userHomeDir(),
+	}
+}
+
+// userHomeDir returns the home directory of the user, empty if unknown
+func userHomeDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return home
+}
+
+// complete sets the default of the options not given
+func (o *Options) complete() {
+	defaults := NewDefaultOptions()
+
+	if o.In == nil {
+		o.In = defaults.In
+	}
+	if o.Out == nil {
+		o.Out = defaults.Out
+	}
+	if o.ErrOut == nil {
+		o.ErrOut = defaults.ErrOut
+	}
+	if o.Fs == nil {
+		o.Fs = defaults.Fs
+	}
+	if o.Prompter == nil {
+		o.Prompter = terminalPrompter{out: o.ErrOut}
+	}
+	if o.Clock == nil {
+		o.Clock = defaults.Clock
+	}
+	if o.Kubectl == nil {
+		o.Kubectl = defaults.Kubectl
+	}
+	if o.HomeDir == "" {
+		o.HomeDir = defaults.HomeDir
+	}
+}
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nutanix/kubectl-karbon/karbontest"
+	"github.com/spf13/afero"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+// fakePrompter answers the prompts with the given passwords, in order
+type fakePrompter struct {
+	passwords []string
+	prompts   []string
+}
+
+func (p *fakePrompter) PromptPassword(prompt string) (string, error) {
+	p.prompts = append(p.prompts, prompt)
+	if len(p.prompts) > len(p.passwords) {
+		return "", fmt.Errorf("unexpected prompt %q", prompt)
+	}
+	return p.passwords[len(p.prompts)-1], nil
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c fakeClock) Now() time.Time {
+	return c.now
+}
+
+// fakeKubectl is a local kubectl of a fixed client version
+type fakeKubectl struct {
+	version version.Info
+}
+
+func (k fakeKubectl) ClientVersion() (*version.Info, error) {
+	return &k.version, nil
+}
+
+var testNow = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// testOptions are options writing in memory, with a fixed clock and no password to prompt
+func testOptions(t *testing.T) (*Options, *bytes.Buffer, *bytes.Buffer) {
+	t.Helper()
+
+	t.Setenv("KUBECONFIG", "")
+	t.Setenv("KARBON_PASSWORD", "")
+	os.Unsetenv("KARBON_PASSWORD")
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	out := &bytes.Buffer{}
+	errOut := &bytes.Buffer{}
+
+	return &Options{
+		IOStreams: IOStreams{In: &bytes.Buffer{}, Out: out, ErrOut: errOut},
+		Fs:        afero.NewMemMapFs(),
+		Prompter:  &fakePrompter{},
+		Clock:     fakeClock{now: testNow},
+		Kubectl:   fakeKubectl{version: version.Info{Major: "1", Minor: "28", GitVersion: "v1.28.0"}},
+		// the default paths derive from the home directory, nothing is written there
+		HomeDir: "/home/test",
+	}, out, errOut
+}
+
+// executeCommand runs a new root command
+func executeCommand(t *testing.T, o *Options, args ...string) error {
+	t.Helper()
+
+	rootCmd := NewRootCommand(o)
+	rootCmd.SetArgs(args)
+	return rootCmd.Execute()
+}
+
+// fakeServerArgs are the flags to connect to the fake Prism Central
+func fakeServerArgs(server *karbontest.Server) []string {
+	return []string{"--server", server.Host(), "--port", strconv.Itoa(server.Port()), "--user", karbontest.DefaultUsername, "--insecure"}
+}
+
+func TestNewRootCommandDefaults(t *testing.T) {
+	o := &Options{}
+	NewRootCommand(o)
+
+	if o.In == nil || o.Out == nil || o.ErrOut == nil || o.Fs == nil || o.Prompter == nil || o.Clock == nil {
+		t.Errorf("options not completed: %+v", o)
+	}
+}
+
+func TestVersionOutput(t *testing.T) {
+	o, out, _ := testOptions(t)
+
+	err := executeCommand(t, o, "version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() == 0 {
+		t.Error("version written outside of the output stream")
+	}
+}
+
+func TestOutputFile(t *testing.T) {
+	server := karbontest.NewServer(karbontest.Cluster{Name: "a"})
+	defer server.Close()
+
+	o, out, _ := testOptions(t)
+	t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+	err := executeCommand(t, o, append([]string{"kubeconfig", "get", "a", "--output-file", "/home/test/a.yaml"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := afero.Exists(o.Fs, "/home/test/a.yaml"); !exists {
+		t.Error("kubeconfig not written to --output-file")
+	}
+
+	// -o is the output format, not the file
+	out.Reset()
+	err = executeCommand(t, o, append([]string{"kubeconfig", "get", "a", "-o", "json"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(out.Bytes()) {
+		t.Errorf("kubeconfig get -o json output = %q, want a JSON result", out.String())
+	}
+	if exists, _ := afero.Exists(o.Fs, "json"); exists {
+		t.Error("-o json written to a file")
+	}
+}
+
+func TestSelectClusterWithoutTerminal(t *testing.T) {
+	server := karbontest.NewServer(karbontest.Cluster{Name: "a"})
+	defer server.Close()
+
+	o, _, _ := testOptions(t)
+	t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+	// the injected stdin decides, not the terminal of the test process
+	err := executeCommand(t, o, append([]string{"login"}, fakeServerArgs(server)...)...)
+	if !errors.Is(err, errNoTerminal) {
+		t.Errorf("login without cluster error = %v, want %v", err, errNoTerminal)
+	}
+}
+
+func TestLogFile(t *testing.T) {
+	o, _, _ := testOptions(t)
+
+	err := executeCommand(t, o, "version", "--verbose", "--log-file", "~/karbon.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, _ := afero.Exists(o.Fs, "/home/test/karbon.log"); !exists {
+		t.Error("log file not created in the options filesystem")
+	}
+}
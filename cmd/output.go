@@ -0,0 +1,96 @@
+/*
+Package cmd output print the machine-readable result of the commands
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// outputAnnotation marks the commands printing a JSON result with --output json
+const outputAnnotation = "karbon/output-json"
+
+// commandOutput is the JSON document printed by a command with --output json
+type commandOutput struct {
+	Command  string      `json:"command"`
+	Success  bool        `json:"success"`
+	Result   interface{} `json:"result,omitempty"`
+	Warnings []string    `json:"warnings,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// setupOutput checks the output format of the command and, for JSON, moves the human text to stderr
+func (p *plugin) setupOutput(cmd *cobra.Command) error {
+	p.out = p.Out
+	p.jsonOut = nil
+
+	switch p.outputFormat {
+	case "text":
+		return nil
+	case "json":
+		if cmd.Annotations[outputAnnotation] != "true" {
+			return fmt.Errorf("--output json is not supported by the %s command", cmd.CommandPath())
+		}
+	default:
+		return fmt.Errorf("invalid output format %s, must be text or json", p.outputFormat)
+	}
+
+	p.jsonOut = p.Out
+	p.out = p.ErrOut
+
+	return nil
+}
+
+// commandName is the command of a JSON result, with its parents below the root like "ssh-agent list"
+func commandName(cmd *cobra.Command) string {
+	return strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ")
+}
+
+// jsonOutputEnabled returns true when the command prints a JSON result
+func (p *plugin) jsonOutputEnabled() bool {
+	return p.jsonOut != nil
+}
+
+// printJSONOutput writes the JSON result of a command to stdout
+func (p *plugin) printJSONOutput(output commandOutput) error {
+	encoder := json.NewEncoder(p.jsonOut)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(output)
+}
+
+// jsonOutputCommand marks a command as supporting --output json, its errors print a failed JSON result
+func (p *plugin) jsonOutputCommand(cmd *cobra.Command) {
+	if cmd.Annotations == nil {
+		cmd.Annotations = map[string]string{}
+	}
+	cmd.Annotations[outputAnnotation] = "true"
+
+	runE := cmd.RunE
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		err := runE(cmd, args)
+
+		var exitErr *exitError
+		if err != nil && p.jsonOutputEnabled() && !errors.As(err, &exitErr) {
+			p.printJSONOutput(commandOutput{Command: commandName(cmd), Error: err.Error()})
+		}
+		return err
+	}
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nutanix/kubectl-karbon/karbontest"
+	"github.com/spf13/afero"
+)
+
+// decodeOutput decodes the JSON result of a command
+func decodeOutput(t *testing.T, data []byte, result interface{}) commandOutput {
+	t.Helper()
+
+	var output struct {
+		commandOutput
+		Result json.RawMessage `json:"result"`
+	}
+	err := json.Unmarshal(data, &output)
+	if err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, data)
+	}
+	err = json.Unmarshal(output.Result, result)
+	if err != nil {
+		t.Fatalf("invalid JSON result: %v\n%s", err, output.Result)
+	}
+
+	return output.commandOutput
+}
+
+func TestDocumentCommandsJSON(t *testing.T) {
+	server := karbontest.NewServer(karbontest.Cluster{Name: "a"})
+	defer server.Close()
+
+	t.Run("kubeconfig get", func(t *testing.T) {
+		o, out, _ := testOptions(t)
+		t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+		err := executeCommand(t, o, append([]string{"kubeconfig", "get", "a", "-o", "json"}, fakeServerArgs(server)...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result kubeconfigGetResult
+		output := decodeOutput(t, out.Bytes(), &result)
+		if output.Command != "kubeconfig get" || !output.Success || result.Cluster != "a" || !strings.Contains(result.Kubeconfig, "current-context") || result.File != "" {
+			t.Errorf("output = %+v, result = %+v", output, result)
+		}
+
+		out.Reset()
+		err = executeCommand(t, o, append([]string{"kubeconfig", "get", "a", "-o", "json", "--output-file", "/home/test/a.yaml"}, fakeServerArgs(server)...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = kubeconfigGetResult{}
+		decodeOutput(t, out.Bytes(), &result)
+		if result.File != "/home/test/a.yaml" || result.Kubeconfig != "" {
+			t.Errorf("result = %+v, want the file written", result)
+		}
+	})
+
+	t.Run("ssh-key get", func(t *testing.T) {
+		o, out, _ := testOptions(t)
+		t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+		err := executeCommand(t, o, append([]string{"ssh-key", "get", "a", "-o", "json", "--output-file", "/home/test/a"}, fakeServerArgs(server)...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result sshKeyResult
+		output := decodeOutput(t, out.Bytes(), &result)
+		want := []string{"/home/test/a", "/home/test/a-cert.pub"}
+		if output.Command != "ssh-key get" || strings.Join(result.Files, ",") != strings.Join(want, ",") || result.PrivateKey != "" {
+			t.Errorf("output = %+v, result = %+v, want files %q", output, result, want)
+		}
+		for _, file := range want {
+			if exists, _ := afero.Exists(o.Fs, file); !exists {
+				t.Errorf("%s not written", file)
+			}
+		}
+	})
+
+	t.Run("export", func(t *testing.T) {
+		o, out, _ := testOptions(t)
+		t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+		err := executeCommand(t, o, append([]string{"export", "a", "--as", "flux", "-o", "json"}, fakeServerArgs(server)...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result exportResult
+		decodeOutput(t, out.Bytes(), &result)
+		if result.Namespace != "flux-system" || result.Name != "a-kubeconfig" || result.Applied || result.Secret == nil || len(result.Secret.Data["value"]) == 0 {
+			t.Errorf("result = %+v", result)
+		}
+	})
+}
+
+func TestExecResultJSON(t *testing.T) {
+	results := []execResult{
+		{Node: "a-master-0", ExitCode: 0, DurationMs: 12, Duration: 12 * time.Millisecond},
+		{Node: "a-worker-0", ExitCode: -1, Error: "connection refused"},
+	}
+
+	data, err := json.Marshal(results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `[{"node":"a-master-0","exit_code":0,"duration_ms":12},{"node":"a-worker-0","exit_code":-1,"duration_ms":0,"error":"connection refused"}]`
+	if string(data) != want {
+		t.Errorf("JSON = %s, want %s", data, want)
+	}
+}
+
+func TestInteractiveCommandsRejectJSON(t *testing.T) {
+	o, _, _ := testOptions(t)
+
+	err := executeCommand(t, o, "tunnel", "a", "-o", "json")
+	if err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("tunnel -o json error = %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+/*
+Package cmd proxy reach Prism Central and the nodes through a proxy or an SSH bastion
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+)
+
+// prismRoute is how Prism Central is reached, directly, through an HTTP(S)/SOCKS5 proxy or through an SSH bastion
+type prismRoute struct {
+	proxyURL   string
+	sshJump    string
+	sshJumpKey string
+}
+
+// configuredPrismRoute returns the route of the proxy-url, ssh-jump and ssh-jump-key settings
+func (p *plugin) configuredPrismRoute() prismRoute {
+	return prismRoute{
+		proxyURL:   p.viper.GetString("proxy-url"),
+		sshJump:    p.viper.GetString("ssh-jump"),
+		sshJumpKey: p.viper.GetString("ssh-jump-key"),
+	}
+}
+
+// nodeRoute returns the route to the nodes of a cluster, the SSH bastion recorded at login for the cluster,
+// otherwise the route to Prism Central
+func (nutanixCluster *nutanixCluster) nodeRoute(cluster string) prismRoute {
+	entry, err := nutanixCluster.lookupState(nutanixCluster.server, cluster)
+	if err != nil {
+		nutanixCluster.logger.Warn("SSH bastion of the login unknown, state file not read", "error", err)
+	}
+	if entry != nil && entry.SSHJump != "" {
+		return prismRoute{sshJump: entry.SSHJump, sshJumpKey: entry.SSHJumpKey}
+	}
+
+	return nutanixCluster.route
+}
+
+// jumpClients are the SSH bastion connections of a command, opened once per bastion and key
+type jumpClients struct {
+	mu      sync.Mutex
+	clients map[string]*ssh.Client
+}
+
+// parseProxyURL checks a proxy-url has a scheme supported by both the plugin and kubectl
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy-url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy-url %s, the scheme must be http, https or socks5", proxyURL)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy-url %s, no host", proxyURL)
+	}
+
+	return u, nil
+}
+
+// configureTransport routes a transport through the proxy or the SSH bastion of the route,
+// without any the transport keeps the proxy of the environment
+func (p *plugin) configureTransport(route prismRoute, transport *http.Transport) error {
+	switch {
+	case route.proxyURL != "" && route.sshJump != "":
+		return fmt.Errorf("proxy-url and ssh-jump cannot be used together")
+	case route.proxyURL != "":
+		u, err := parseProxyURL(route.proxyURL)
+		if err != nil {
+			return err
+		}
+		transport.Proxy = http.ProxyURL(u)
+	case route.sshJump != "":
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return p.dialJump(ctx, route, network, address)
+		}
+	}
+
+	return nil
+}
+
+// dialJump opens a connection to address from the SSH bastion
+func (p *plugin) dialJump(ctx context.Context, route prismRoute, network string, address string) (net.Conn, error) {
+	client, err := p.jumpClient(route.sshJump, route.sshJumpKey)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.DialContext(ctx, network, address)
+	if err != nil {
+		// the bastion connection may be broken, the next dial reconnects
+		p.forgetJumpClient(route.sshJump, route.sshJumpKey, client)
+		return nil, fmt.Errorf("failed to connect to %s through SSH bastion %s: %w", address, route.sshJump, err)
+	}
+
+	return conn, nil
+}
+
+// jumpClient returns the SSH connection to a bastion, opened once per bastion and key
+func (p *plugin) jumpClient(jump string, keyFile string) (*ssh.Client, error) {
+	p.jumps.mu.Lock()
+	defer p.jumps.mu.Unlock()
+
+	key := jump + " " + keyFile
+	if client, ok := p.jumps.clients[key]; ok {
+		return client, nil
+	}
+
+	username, address, err := parseJumpHost(jump)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := p.jumpAuthMethods(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := p.knownHostsCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	p.logger.Info("connect to SSH bastion", "address", address, "user", username)
+
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SSH bastion %s: %w", address, err)
+	}
+
+	if p.jumps.clients == nil {
+		p.jumps.clients = map[string]*ssh.Client{}
+	}
+	p.jumps.clients[key] = client
+	return client, nil
+}
+
+// forgetJumpClient closes and drops a cached bastion connection
+func (p *plugin) forgetJumpClient(jump string, keyFile string, client *ssh.Client) {
+	p.jumps.mu.Lock()
+	defer p.jumps.mu.Unlock()
+
+	key := jump + " " + keyFile
+	if p.jumps.clients[key] == client {
+		delete(p.jumps.clients, key)
+		client.Close()
+	}
+}
+
+// parseJumpHost returns the user and the address of a [user@]host[:port] bastion, like the OpenSSH ProxyJump
+func parseJumpHost(jump string) (string, string, error) {
+	username := ""
+	host := jump
+	if i := strings.LastIndex(jump, "@"); i >= 0 {
+		username, host = jump[:i], jump[i+1:]
+	}
+
+	if host == "" {
+		return "", "", fmt.Errorf("invalid ssh-jump %s, no host", jump)
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "22")
+	}
+
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return "", "", err
+		}
+		username = current.Username
+	}
+
+	return username, host, nil
+}
+
+// jumpAuthMethods authenticates on the bastion with the key file if given, and with the keys of the ssh-agent
+func (p *plugin) jumpAuthMethods(keyFile string) ([]ssh.AuthMethod, error) {
+	var auth []ssh.AuthMethod
+
+	if keyFile != "" {
+		path, err := p.expandHome(keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := afero.ReadFile(p.Fs, path)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err := ssh.ParsePrivateKey(data)
+		var missingErr *ssh.PassphraseMissingError
+		if errors.As(err, &missingErr) {
+			var passphrase string
+			passphrase, err = p.Prompter.PromptPassword(fmt.Sprintf("Enter passphrase for %s:", keyFile))
+			if err != nil {
+				return nil, err
+			}
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ssh-jump-key %s: %w", keyFile, err)
+		}
+
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+
+	// the ssh-agent connection stays open for the bastion connection lifetime
+	_, agentClient, err := dialSSHAgent()
+	if err == nil {
+		auth = append(auth, ssh.PublicKeysCallback(agentClient.Signers))
+	} else if !errors.Is(err, errNoSSHAgent) {
+		p.logger.Warn("ssh-agent not used for the SSH bastion", "error", err)
+	}
+
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no key to authenticate on the SSH bastion, use ssh-jump-key or an ssh-agent")
+	}
+
+	return auth, nil
+}
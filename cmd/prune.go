@@ -0,0 +1,379 @@
+/*
+Package cmd prune stale karbon contexts from kubeconfig and kubie directory
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// prunedContext is a stale context in the JSON result of prune, not removed with --dry-run
+type prunedContext struct {
+	Cluster    string `json:"cluster"`
+	Context    string `json:"context"`
+	Kubeconfig string `json:"kubeconfig"`
+	Removed    bool   `json:"removed"`
+}
+
+// karbonContext is a kubeconfig context created by a karbon login
+type karbonContext struct {
+	cluster    string
+	context    string
+	kubeconfig string
+	apiServer  string
+	kubie      bool
+	state      *clusterState
+}
+
+// newPruneCmd returns the prune command
+func newPruneCmd(p *plugin) *cobra.Command {
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove Karbon contexts of clusters that no longer exist",
+		Long: `Remove Karbon contexts of clusters that no longer exist on Prism Central.
+
+Karbon contexts from the kubeconfig file and the kubie-path directory are compared with the clusters
+of the Prism Central (matching on the cluster UUID recorded at login, or on API server address),
+contexts of deleted clusters are removed with their SSH key/cert files and ssh-agent keys.
+
+Untracked contexts (--untracked) may belong to another Prism Central, each removal is confirmed unless --yes is given.`,
+		PreRun: func(cmd *cobra.Command, args []string) {
+
+			p.viper.BindPFlag("server", cmd.Flags().Lookup("server"))
+			p.viper.BindPFlag("user", cmd.Flags().Lookup("user"))
+			p.viper.BindPFlag("port", cmd.Flags().Lookup("port"))
+			p.viper.BindPFlag("insecure", cmd.Flags().Lookup("insecure"))
+			p.viper.BindPFlag("keyring", cmd.Flags().Lookup("keyring"))
+			p.viper.BindPFlag("kubie-path", cmd.Flags().Lookup("kubie-path"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			untracked, _ := cmd.Flags().GetBool("untracked")
+			yes, _ := cmd.Flags().GetBool("yes")
+
+			nutanixCluster, err := p.newNutanixCluster(cmd)
+			if err != nil {
+				return err
+			}
+
+			clusters, err := nutanixCluster.listKarbonClusters()
+			if err != nil {
+				return err
+			}
+
+			uuids := map[string]bool{}
+			apiServers := map[string]bool{}
+			for _, cluster := range clusters {
+				uuids[cluster.UUID] = true
+				if cluster.KubeapiServerIpv4Address != "" {
+					apiServers[cluster.KubeapiServerIpv4Address] = true
+				}
+			}
+
+			state, err := p.loadState()
+			if err != nil {
+				return err
+			}
+
+			contexts, err := p.findKarbonContexts(state, untracked)
+			if err != nil {
+				return err
+			}
+
+			in := bufio.NewReader(p.In)
+
+			pruned := []prunedContext{}
+			for _, context := range contexts {
+				if !context.stale(nutanixCluster.server, uuids, apiServers) {
+					continue
+				}
+
+				result := prunedContext{Cluster: context.cluster, Context: context.context, Kubeconfig: context.kubeconfig}
+
+				if dryRun {
+					pruned = append(pruned, result)
+					fmt.Fprintf(p.out, "Would remove context %s of cluster %s from %s\n", context.context, context.cluster, context.kubeconfig)
+					continue
+				}
+
+				// an untracked context is not known to belong to the targeted Prism Central
+				if context.state == nil && !yes {
+					question := fmt.Sprintf("Remove untracked context %s of cluster %s from %s, its API server %s is not on %s? (y/n) ",
+						context.context, context.cluster, context.kubeconfig, context.apiServer, nutanixCluster.server)
+					if !confirm(in, p.out, question) {
+						continue
+					}
+				}
+
+				err = p.pruneKarbonContext(context)
+				if err != nil {
+					return err
+				}
+
+				result.Removed = true
+				pruned = append(pruned, result)
+				fmt.Fprintf(p.out, "Removed context %s of cluster %s from %s\n", context.context, context.cluster, context.kubeconfig)
+			}
+
+			if len(pruned) == 0 {
+				fmt.Fprintln(p.out, "No stale Karbon context found")
+			}
+
+			if p.jsonOutputEnabled() {
+				return p.printJSONOutput(commandOutput{Command: commandName(cmd), Success: true, Result: pruned})
+			}
+			return nil
+		},
+	}
+
+	p.jsonOutputCommand(pruneCmd)
+
+	user, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+
+	pruneCmd.Flags().String("server", "", "Address of the PC to authenticate against")
+
+	pruneCmd.Flags().StringP("user", "u", user.Username, "Username to authenticate")
+
+	pruneCmd.Flags().Int("port", 9440, "Port to run Application server on")
+
+	pruneCmd.Flags().BoolP("insecure", "k", false, "Skip certificate verification (this is insecure)")
+
+	pruneCmd.Flags().Bool("keyring", false, "Use keyring to store and retrieve credential")
+
+	defaultKubiePath := fmt.Sprintf("%s/.kube/kubie/", p.HomeDir)
+	pruneCmd.Flags().String("kubie-path", defaultKubiePath, "Path to kubie kubeconfig directory")
+
+	pruneCmd.Flags().Bool("dry-run", false, "Only print the contexts that would be removed")
+	pruneCmd.Flags().Bool("untracked", false, "Also prune Karbon named contexts (<cluster>-context) not recorded at login, after confirmation as they may belong to another Prism Central")
+	pruneCmd.Flags().BoolP("yes", "y", false, "Remove the untracked contexts without confirmation")
+
+	return pruneCmd
+}
+
+// findKarbonContexts lists the karbon contexts of the kubeconfig files and of the kubie-path directory,
+// contexts recorded at login are always returned, untracked ones only if they follow the karbon naming
+func (p *plugin) findKarbonContexts(state *karbonState, untracked bool) ([]karbonContext, error) {
+	kubiePath, err := p.expandHome(p.viper.GetString("kubie-path"))
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]bool{}
+
+	for _, kubeconfig := range filepath.SplitList(p.viper.GetString("kubeconfig")) {
+		kubeconfig, err := p.expandHome(kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		files[kubeconfig] = false
+	}
+
+	kubieFiles, err := afero.Glob(p.Fs, filepath.Join(kubiePath, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	for _, kubieFile := range kubieFiles {
+		files[kubieFile] = true
+	}
+
+	for _, entry := range state.Clusters {
+		if _, ok := files[entry.Kubeconfig]; !ok {
+			files[entry.Kubeconfig] = filepath.Clean(filepath.Dir(entry.Kubeconfig)) == filepath.Clean(kubiePath)
+		}
+	}
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var contexts []karbonContext
+
+	for _, path := range paths {
+		config, err := p.loadKubeconfigFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load kubeconfig %s: %w", path, err)
+		}
+
+		names := make([]string, 0, len(config.Contexts))
+		for name := range config.Contexts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			context := config.Contexts[name]
+
+			karbon := karbonContext{
+				context:    name,
+				kubeconfig: path,
+				kubie:      files[path],
+			}
+
+			for _, entry := range state.Clusters {
+				if entry.Kubeconfig != path {
+					continue
+				}
+				if name == entry.ContextName || (entry.ContextName == "" && name == entry.Name+"-context") {
+					karbon.cluster = entry.Name
+					karbon.state = entry
+				}
+			}
+
+			if karbon.state == nil {
+				if !untracked || name != context.Cluster+"-context" {
+					continue
+				}
+				karbon.cluster = context.Cluster
+			}
+
+			if cluster, ok := config.Clusters[context.Cluster]; ok {
+				if serverURL, err := url.Parse(cluster.Server); err == nil {
+					karbon.apiServer = serverURL.Hostname()
+				}
+			}
+
+			contexts = append(contexts, karbon)
+		}
+	}
+
+	return contexts, nil
+}
+
+// stale reports if a karbon context is of a cluster that no longer exists on the Prism Central server,
+// a context recorded at login is matched on the cluster UUID, otherwise on the API server address
+func (context karbonContext) stale(server string, uuids map[string]bool, apiServers map[string]bool) bool {
+	if context.state != nil {
+		// only what belongs to the targeted Prism Central is pruned
+		if context.state.Server != server {
+			return false
+		}
+		if context.state.UUID != "" {
+			return !uuids[context.state.UUID]
+		}
+	}
+
+	// a context without API server address is not known to be stale
+	if context.apiServer == "" {
+		return false
+	}
+
+	return !apiServers[context.apiServer]
+}
+
+// confirm asks a yes/no question and reads the answer from in, anything but y or yes is a no
+func confirm(in *bufio.Reader, out io.Writer, question string) bool {
+	fmt.Fprint(out, question)
+
+	answer, _ := in.ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+// pruneKarbonContext removes a karbon context with its kubie file, SSH key/cert and state entry
+func (p *plugin) pruneKarbonContext(context karbonContext) error {
+	config, err := p.loadKubeconfigFile(context.kubeconfig)
+	if err != nil {
+		return err
+	}
+
+	removeContext(config, context.context)
+
+	// A kubie file without any context left is removed
+	if context.kubie && len(config.Contexts) == 0 {
+		err = p.Fs.Remove(context.kubeconfig)
+	} else {
+		err = p.writeKubeconfigFile(*config, context.kubeconfig)
+	}
+	if err != nil {
+		return err
+	}
+
+	if context.state == nil {
+		return nil
+	}
+
+	if context.state.SSHFile {
+		_, err := p.deleteKeyFile(context.state.Server, context.cluster)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if context.state.SSHAgent {
+		_, err := p.deleteKeyAgent(context.cluster)
+		if err != nil {
+			p.logger.Warn("failed to remove SSH key from ssh-agent", "cluster", context.cluster, "error", err)
+		}
+	}
+
+	_, err = p.deleteSSHConfig(context.cluster)
+	if err != nil {
+		return err
+	}
+
+	return p.removeState(context.state.Server, context.cluster)
+}
+
+// removeContext deletes a context from a kubeconfig, with its cluster and user when no other context uses them
+func removeContext(config *clientcmdapi.Config, name string) {
+	context, ok := config.Contexts[name]
+	if !ok {
+		return
+	}
+	delete(config.Contexts, name)
+
+	clusterUsed := false
+	authInfoUsed := false
+	for _, other := range config.Contexts {
+		clusterUsed = clusterUsed || other.Cluster == context.Cluster
+		authInfoUsed = authInfoUsed || other.AuthInfo == context.AuthInfo
+	}
+
+	if !clusterUsed {
+		delete(config.Clusters, context.Cluster)
+	}
+	if !authInfoUsed {
+		delete(config.AuthInfos, context.AuthInfo)
+	}
+	if config.CurrentContext == name {
+		config.CurrentContext = ""
+	}
+}
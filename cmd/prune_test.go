@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/nutanix/kubectl-karbon/karbontest"
+	"github.com/spf13/afero"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// addKubeconfigContext adds a <cluster>-context context not recorded at login to a kubeconfig
+func addKubeconfigContext(t *testing.T, fs afero.Fs, path string, cluster string, server string) {
+	t.Helper()
+
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := clientcmd.Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Clusters[cluster] = &clientcmdapi.Cluster{Server: server}
+	config.AuthInfos[cluster] = &clientcmdapi.AuthInfo{Token: "token"}
+	config.Contexts[cluster+"-context"] = &clientcmdapi.Context{Cluster: cluster, AuthInfo: cluster}
+
+	data, err = clientcmd.Write(*config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = afero.WriteFile(fs, path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func kubeconfigContexts(t *testing.T, fs afero.Fs, path string) map[string]bool {
+	t.Helper()
+
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := clientcmd.Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contexts := map[string]bool{}
+	for name := range config.Contexts {
+		contexts[name] = true
+	}
+	return contexts
+}
+
+func TestPrune(t *testing.T) {
+	server := karbontest.NewServer(
+		karbontest.Cluster{Name: "a", KubeAPIServer: "10.0.0.1"},
+		karbontest.Cluster{Name: "b", KubeAPIServer: "10.0.0.2"},
+		karbontest.Cluster{Name: "e", KubeAPIServer: "10.0.0.5"},
+	)
+	defer server.Close()
+
+	o, out, _ := testOptions(t)
+	t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+	for _, cluster := range []string{"a", "b", "e"} {
+		err := executeCommand(t, o, append([]string{"login", "--cluster", cluster, "--merge"}, fakeServerArgs(server)...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kubeconfig := "/home/test/.kube/config"
+	// c is a cluster of another Prism Central, d has no API server address
+	addKubeconfigContext(t, o.Fs, kubeconfig, "c", "https://10.9.9.9:443")
+	addKubeconfigContext(t, o.Fs, kubeconfig, "d", "")
+
+	// a is recreated with the same API server address, b is deleted
+	server.RemoveCluster("a")
+	server.AddCluster(karbontest.Cluster{Name: "a", UUID: "11111111-1111-4111-8111-111111111111", KubeAPIServer: "10.0.0.1"})
+	server.RemoveCluster("b")
+
+	o.In = strings.NewReader("n\n")
+	err := executeCommand(t, o, append([]string{"prune", "--untracked"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), "Remove untracked context c-context") {
+		t.Errorf("untracked context removed without confirmation: %s", out.String())
+	}
+	contexts := kubeconfigContexts(t, o.Fs, kubeconfig)
+	for context, want := range map[string]bool{"a-context": false, "b-context": false, "c-context": true, "d-context": true, "e-context": true} {
+		if contexts[context] != want {
+			t.Errorf("context %s kept = %t, want %t", context, contexts[context], want)
+		}
+	}
+
+	err = executeCommand(t, o, append([]string{"prune", "--untracked", "--yes"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contexts = kubeconfigContexts(t, o.Fs, kubeconfig)
+	if contexts["c-context"] || !contexts["d-context"] || !contexts["e-context"] {
+		t.Errorf("contexts = %v, want c-context removed and d-context, e-context kept", contexts)
+	}
+}
+
+func TestPruneJSON(t *testing.T) {
+	server := karbontest.NewServer(karbontest.Cluster{Name: "a"}, karbontest.Cluster{Name: "b"})
+	defer server.Close()
+
+	o, out, _ := testOptions(t)
+	t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+	for _, cluster := range []string{"a", "b"} {
+		err := executeCommand(t, o, append([]string{"login", "--cluster", cluster, "--merge"}, fakeServerArgs(server)...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server.RemoveCluster("b")
+
+	out.Reset()
+	err := executeCommand(t, o, append([]string{"prune", "--dry-run", "-o", "json"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output struct {
+		Command string          `json:"command"`
+		Success bool            `json:"success"`
+		Result  []prunedContext `json:"result"`
+	}
+	err = json.Unmarshal(out.Bytes(), &output)
+	if err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, out.String())
+	}
+	want := prunedContext{Cluster: "b", Context: "b-context", Kubeconfig: "/home/test/.kube/config"}
+	if output.Command != "prune" || !output.Success || len(output.Result) != 1 || output.Result[0] != want {
+		t.Errorf("output = %+v", output)
+	}
+
+	if !kubeconfigContexts(t, o.Fs, "/home/test/.kube/config")["b-context"] {
+		t.Error("context b-context removed with --dry-run")
+	}
+}
@@ -0,0 +1,471 @@
+/*
+Package cmd record record and replay the HTTP exchanges with Prism Central
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nutanix/kubectl-karbon/version"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// harLog is the subset of the HTTP Archive (HAR 1.2) format written by --record and read by --replay
+type harLog struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            int64       `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+}
+
+type harRequest struct {
+	Method   string       `json:"method"`
+	URL      string       `json:"url"`
+	Headers  []harHeader  `json:"headers"`
+	PostData *harPostData `json:"postData,omitempty"`
+}
+
+type harResponse struct {
+	Status     int         `json:"status"`
+	StatusText string      `json:"statusText"`
+	Headers    []harHeader `json:"headers"`
+	Content    harContent  `json:"content"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+// harRecorder keeps the exchanges recorded by all the clusters to write them to a single file
+type harRecorder struct {
+	fs   afero.Fs
+	file string
+	mu   sync.Mutex
+	har  harLog
+}
+
+// recordingTransport records every exchange, sanitized
+type recordingTransport struct {
+	next     http.RoundTripper
+	recorder *harRecorder
+	logger   *slog.Logger
+}
+
+// replayTransport serves the responses of a record file, in order for the same method and path
+type replayTransport struct {
+	mu      sync.Mutex
+	entries []harEntry
+	used    []bool
+	logger  *slog.Logger
+}
+
+// recordState is the recorder or the replayer shared by all the clusters of a command
+type recordState struct {
+	recorderOnce sync.Once
+	recorder     *harRecorder
+
+	replayerOnce sync.Once
+	replayer     *replayTransport
+	replayerErr  error
+}
+
+// transport returns the HTTP transport to Prism Central, recording or replaying the exchanges if asked
+func (c *nutanixCluster) transport() (http.RoundTripper, error) {
+	record := c.viper.GetString("record")
+	replay := c.viper.GetString("replay")
+	state := &c.recording
+
+	if record != "" && replay != "" {
+		return nil, fmt.Errorf("--record and --replay cannot be used together")
+	}
+
+	if replay != "" {
+		state.replayerOnce.Do(func() {
+			state.replayer, state.replayerErr = c.loadReplay(replay)
+		})
+		return state.replayer, state.replayerErr
+	}
+
+	customTransport := http.DefaultTransport.(*http.Transport).Clone()
+	customTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: c.insecure}
+
+	err := c.configureTransport(c.route, customTransport)
+	if err != nil {
+		return nil, err
+	}
+
+	if record != "" {
+		path, err := c.expandHome(record)
+		if err != nil {
+			return nil, err
+		}
+
+		state.recorderOnce.Do(func() {
+			state.recorder = &harRecorder{fs: c.Fs, file: path}
+			state.recorder.har.Log.Version = "1.2"
+			state.recorder.har.Log.Creator = harCreator{Name: "kubectl-karbon", Version: version.Version}
+			state.recorder.har.Log.Entries = []harEntry{}
+		})
+		return &recordingTransport{next: customTransport, recorder: state.recorder, logger: c.logger}, nil
+	}
+
+	return customTransport, nil
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var requestBody []byte
+	if req.Body != nil {
+		var err error
+		requestBody, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(requestBody))
+	}
+
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	responseBody, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(responseBody))
+
+	entry := harEntry{
+		StartedDateTime: start,
+		Time:            time.Since(start).Milliseconds(),
+		Request: harRequest{
+			Method:  req.Method,
+			URL:     req.URL.String(),
+			Headers: harHeaders(req.Header),
+		},
+		Response: harResponse{
+			Status:     res.StatusCode,
+			StatusText: http.StatusText(res.StatusCode),
+			Headers:    harHeaders(res.Header),
+			Content: harContent{
+				Size:     len(responseBody),
+				MimeType: res.Header.Get("Content-Type"),
+				Text:     sanitizeRecordBody(responseBody),
+			},
+		},
+	}
+	if len(requestBody) > 0 {
+		entry.Request.PostData = &harPostData{MimeType: req.Header.Get("Content-Type"), Text: sanitizeRecordBody(requestBody)}
+	}
+
+	err = t.recorder.add(entry)
+	if err != nil {
+		t.logger.Warn("failed to record HTTP exchange", "file", t.recorder.file, "error", err)
+	}
+
+	return res, nil
+}
+
+// add appends an exchange and writes the whole record file, so that it is complete even if the command fails
+func (r *harRecorder) add(entry harEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.har.Log.Entries = append(r.har.Log.Entries, entry)
+
+	data, err := json.MarshalIndent(r.har, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return afero.WriteFile(r.fs, r.file, data, 0600)
+}
+
+// harHeaders returns the sorted headers of an exchange, the credentials are not recorded
+func harHeaders(header http.Header) []harHeader {
+	var headers []harHeader
+	for name, values := range header {
+		for _, value := range values {
+			if secretFieldPattern.MatchString(name) || strings.EqualFold(name, "Cookie") || strings.EqualFold(name, "Set-Cookie") {
+				value = "REDACTED"
+			}
+			headers = append(headers, harHeader{Name: name, Value: value})
+		}
+	}
+
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+
+	return headers
+}
+
+// sanitizeRecordBody redacts the secrets of a body, the kubeconfig keeps its structure without its credentials
+// so that a replayed login still works
+func sanitizeRecordBody(body []byte) string {
+	var value interface{}
+
+	if json.Unmarshal(body, &value) != nil {
+		return redactBody(body)
+	}
+
+	object, _ := value.(map[string]interface{})
+	kubeconfig, isKubeconfig := object["kube_config"].(string)
+
+	value = redactValue(value)
+	if isKubeconfig {
+		object["kube_config"] = sanitizeKubeconfig(kubeconfig)
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+
+	return string(data)
+}
+
+// sanitizeKubeconfig replaces the credentials of the users of a kubeconfig
+func sanitizeKubeconfig(kubeconfig string) string {
+	config, err := clientcmd.Load([]byte(kubeconfig))
+	if err != nil {
+		return "REDACTED"
+	}
+
+	for _, authInfo := range config.AuthInfos {
+		if authInfo.Token != "" {
+			authInfo.Token = "REDACTED"
+		}
+		if authInfo.Password != "" {
+			authInfo.Password = "REDACTED"
+		}
+		authInfo.ClientKeyData = nil
+	}
+
+	data, err := clientcmd.Write(*config)
+	if err != nil {
+		return "REDACTED"
+	}
+
+	return string(data)
+}
+
+func (p *plugin) loadReplay(file string) (*replayTransport, error) {
+	path, err := p.expandHome(file)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := afero.ReadFile(p.Fs, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replay file: %w", err)
+	}
+
+	var har harLog
+	err = json.Unmarshal(data, &har)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse replay file %s: %w", file, err)
+	}
+
+	return &replayTransport{entries: har.Log.Entries, used: make([]bool, len(har.Log.Entries)), logger: p.logger}, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	entry, ok := t.match(req.Method, req.URL.Path)
+	if !ok {
+		return nil, fmt.Errorf("no recorded response for %s %s", req.Method, replayPath(req.URL.Path))
+	}
+
+	t.logger.Debug("replay HTTP exchange", "method", req.Method, "path", replayPath(req.URL.Path), "status", entry.Response.Status)
+
+	header := http.Header{}
+	for _, h := range entry.Response.Headers {
+		// the body was sanitized, its length changed
+		if !strings.EqualFold(h.Name, "Content-Length") {
+			header.Add(h.Name, h.Value)
+		}
+	}
+
+	text, err := t.replaySSHCredentials(entry.Response.Content.Text)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.Response.Status, entry.Response.StatusText),
+		StatusCode:    entry.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(text)),
+		ContentLength: int64(len(text)),
+		Request:       req,
+	}, nil
+}
+
+// replaySSHCredentials replaces the redacted private key of a recorded SSH key/cert response by a throwaway key,
+// with a cert of the same validity signed by a throwaway CA, so that a replayed login writes valid key files
+// and ssh-agent keys, they cannot connect to the nodes
+func (t *replayTransport) replaySSHCredentials(text string) (string, error) {
+	var credentials map[string]interface{}
+	if json.Unmarshal([]byte(text), &credentials) != nil || credentials["private_key"] != "REDACTED" {
+		return text, nil
+	}
+
+	t.logger.Warn("SSH key/cert replayed with a throwaway key, it cannot connect to the nodes")
+
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	caSigner, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		return "", err
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	cert := &ssh.Certificate{
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{defaultSSHUsername},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if certificate, ok := credentials["certificate"].(string); ok {
+		if recorded, err := unmarshalCert([]byte(certificate)); err == nil {
+			cert = recorded
+		}
+	}
+	if expiryTime, ok := credentials["expiry_time"].(string); ok {
+		if expiry, err := parseExpiryTime(expiryTime); err == nil {
+			cert.ValidBefore = uint64(expiry.Unix())
+		}
+	}
+	cert.Key = sshPublicKey
+
+	err = cert.SignCert(rand.Reader, caSigner)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := ssh.MarshalPrivateKey(privateKey, "")
+	if err != nil {
+		return "", err
+	}
+
+	credentials["private_key"] = string(pem.EncodeToMemory(block))
+	credentials["certificate"] = string(ssh.MarshalAuthorizedKey(cert))
+
+	data, err := json.Marshal(credentials)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// match returns the first unused exchange with the same method and path, or the last one once all are used,
+// the server is ignored so that a session can be replayed with any --server
+func (t *replayTransport) match(method string, path string) (harEntry, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	last := -1
+	for i, entry := range t.entries {
+		if entry.Request.Method != method {
+			continue
+		}
+		if recorded, err := urlPath(entry.Request.URL); err != nil || replayPath(recorded) != replayPath(path) {
+			continue
+		}
+
+		if !t.used[i] {
+			t.used[i] = true
+			return entry, true
+		}
+		last = i
+	}
+
+	if last < 0 {
+		return harEntry{}, false
+	}
+	return t.entries[last], true
+}
+
+// replayPath normalizes a request path, clusterRequest paths start with a double slash
+func replayPath(path string) string {
+	return "/" + strings.TrimLeft(path, "/")
+}
+
+func urlPath(rawURL string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	return parsed.Path, nil
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/nutanix/kubectl-karbon/karbontest"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func TestRecordReplayLogin(t *testing.T) {
+	server := karbontest.NewServer(karbontest.Cluster{Name: "a"})
+	defer server.Close()
+
+	record := "/home/test/session.har"
+
+	o, _, _ := testOptions(t)
+	t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+	err := executeCommand(t, o, append([]string{"login", "--cluster", "a", "--ssh-file", "--record", record}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := afero.ReadFile(o.Fs, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{karbontest.DefaultPassword, "PRIVATE KEY-----", "Basic "} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("record file contains %q", secret)
+		}
+	}
+
+	// replayed offline, without password and with another server
+	server.Close()
+	o, _, _ = testOptions(t)
+	err = afero.WriteFile(o.Fs, record, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = executeCommand(t, o, "login", "--cluster", "a", "--ssh-file", "--server", "pc.invalid", "--replay", record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = afero.ReadFile(o.Fs, "/home/test/.kube/config")
+	if err != nil {
+		t.Fatalf("kubeconfig not written by the replay: %v", err)
+	}
+	if _, err := clientcmd.Load(data); err != nil {
+		t.Errorf("replayed kubeconfig: %v", err)
+	}
+
+	keyData, err := afero.ReadFile(o.Fs, "/home/test/.ssh/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(keyData)
+	if err != nil {
+		t.Fatalf("replayed private key: %v", err)
+	}
+	certData, err := afero.ReadFile(o.Fs, "/home/test/.ssh/a-cert.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := unmarshalCert(certData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		t.Error("replayed cert is not the one of the replayed key")
+	}
+	if _, err := ssh.NewCertSigner(cert, signer); err != nil {
+		t.Errorf("replayed key/cert not usable by an ssh-agent: %v", err)
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	body := `{"username":"admin","password":"secret","spec":{"token":"abc","items":[{"private_key":"key"}]},"note":"--token=xyz"}`
+
+	var redacted map[string]interface{}
+	err := json.Unmarshal([]byte(redactBody([]byte(body))), &redacted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if redacted["username"] != "admin" || redacted["password"] != "REDACTED" || redacted["note"] != "--token=REDACTED" {
+		t.Errorf("redacted = %v", redacted)
+	}
+	spec := redacted["spec"].(map[string]interface{})
+	if spec["token"] != "REDACTED" || spec["items"].([]interface{})[0].(map[string]interface{})["private_key"] != "REDACTED" {
+		t.Errorf("nested fields not redacted: %v", spec)
+	}
+
+	if text := redactBody([]byte("password: secret\n")); strings.Contains(text, "secret") {
+		t.Errorf("text body not redacted: %q", text)
+	}
+}
+
+func TestSanitizeKubeconfig(t *testing.T) {
+	kubeconfig := `apiVersion: v1
+kind: Config
+clusters:
+- name: a
+  cluster:
+    server: https://10.0.0.1:443
+    certificate-authority-data: Y2E=
+contexts:
+- name: a-context
+  context:
+    cluster: a
+    user: a-user
+current-context: a-context
+users:
+- name: a-user
+  user:
+    token: secret-token
+    password: secret-password
+    client-key-data: c2VjcmV0LWtleQ==
+`
+
+	sanitized := sanitizeKubeconfig(kubeconfig)
+	for _, secret := range []string{"secret-token", "secret-password", "c2VjcmV0LWtleQ=="} {
+		if strings.Contains(sanitized, secret) {
+			t.Errorf("sanitized kubeconfig contains %s:\n%s", secret, sanitized)
+		}
+	}
+
+	config, err := clientcmd.Load([]byte(sanitized))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.CurrentContext != "a-context" || config.Clusters["a"].Server != "https://10.0.0.1:443" || config.AuthInfos["a-user"].Token != "REDACTED" {
+		t.Errorf("kubeconfig structure not kept:\n%s", sanitized)
+	}
+
+	if sanitizeKubeconfig("not a kubeconfig: [") != "REDACTED" {
+		t.Error("invalid kubeconfig not redacted")
+	}
+}
@@ -17,86 +17,229 @@ limitations under the License.
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/spf13/cobra"
 
 	"github.com/spf13/viper"
 )
 
-var cfgFile string
-var verbose bool
-var debug bool
-
-// rootCmd represents the base command when called without any subcommands
-var rootCmd = &cobra.Command{
-	Use:   "kubectl-karbon",
-	Short: "Karbon Plugin for kubectl.",
-	// Long:  `Karbon Plugin for kubectl.`,
-	// Uncomment the following line if your bare application
-	// has an action associated with it:
-	// Run: func(cmd *cobra.Command, args []string) { },
+// plugin is the state of a root command, shared by its subcommands and their helpers,
+// two root commands share nothing
+type plugin struct {
+	*Options
+
+	viper    *viper.Viper
+	logger   *slog.Logger
+	logLevel *slog.LevelVar
+
+	cfgFile      string
+	verbose      bool
+	debug        bool
+	outputFormat string
+
+	// out is where the human text goes, stderr with --output json
+	out io.Writer
+	// jsonOut is where the JSON result goes with --output json, nil otherwise
+	jsonOut io.Writer
+
+	recording recordState
+	jumps     jumpClients
+
+	// loginMutex serializes the writes of concurrent logins, kubeconfig, key files, ssh-agent and state file are shared
+	loginMutex sync.Mutex
+	// knownHostsMutex serializes the hosts added to the known_hosts file
+	knownHostsMutex sync.Mutex
+
+	inherited inheritedPassword
 }
 
-// Execute adds all child commands to the root command and sets flags appropriately.
-// This is called by main.main(). It only needs to happen once to the rootCmd.
-func Execute() {
-	// cobra.CheckErr(rootCmd.Execute())
-	if err := rootCmd.Execute(); err != nil {
-		os.Exit(1)
+func newPlugin(o *Options) *plugin {
+	o.complete()
+
+	p := &plugin{
+		Options:  o,
+		viper:    viper.New(),
+		logLevel: &slog.LevelVar{},
+		out:      o.Out,
 	}
+	p.logLevel.Set(slog.LevelWarn)
+	p.logger = slog.New(slog.NewTextHandler(o.ErrOut, &slog.HandlerOptions{Level: p.logLevel}))
+
+	return p
+}
+
+// exitError ends a command with an exit code, its errors are already reported
+type exitError struct {
+	code int
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+// exitWithCode ends the command with an exit code without printing an error
+func exitWithCode(cmd *cobra.Command, code int) error {
+	cmd.SilenceErrors = true
+	return &exitError{code: code}
 }
 
-func init() {
-	cobra.OnInitialize(initConfig)
+// NewRootCommand returns the base command with all its subcommands, using the given dependencies
+func NewRootCommand(o *Options) *cobra.Command {
+	p := newPlugin(o)
+
+	rootCmd := &cobra.Command{
+		Use:   "kubectl-karbon",
+		Short: "Karbon Plugin for kubectl.",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			// the arguments are valid, the errors from now on are not usage errors
+			cmd.SilenceUsage = true
+
+			err := p.initConfig()
+			if err != nil {
+				return err
+			}
+			return p.setupOutput(cmd)
+		},
+		// Long:  `Karbon Plugin for kubectl.`,
+		// Uncomment the following line if your bare application
+		// has an action associated with it:
+		// RunE: func(cmd *cobra.Command, args []string) error { },
+	}
+
+	rootCmd.SetIn(o.In)
+	rootCmd.SetOut(o.Out)
+	rootCmd.SetErr(o.ErrOut)
 
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "karbon plugin config file (default ~/.kubectl-karbon.yaml)")
-	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "print verbose logging information")
-	rootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "print debug logging information")
+	rootCmd.PersistentFlags().StringVar(&p.cfgFile, "config", "", "karbon plugin config file (default ~/.kubectl-karbon.yaml)")
+	rootCmd.PersistentFlags().BoolVarP(&p.verbose, "verbose", "v", false, "print verbose logging information")
+	rootCmd.PersistentFlags().BoolVarP(&p.debug, "debug", "d", false, "print debug logging information")
+	rootCmd.PersistentFlags().StringVarP(&p.outputFormat, "output", "o", "text", "output format of the result, text or json (human text goes to stderr with json), ssh, tunnel, agent, ui, dev fake-server and daemon only support text")
+	rootCmd.PersistentFlags().String("log-format", "text", "format of the logs, text or json")
+	p.viper.BindPFlag("log-format", rootCmd.PersistentFlags().Lookup("log-format"))
+	rootCmd.PersistentFlags().String("log-file", "", "write the logs to this file instead of stderr")
+	p.viper.BindPFlag("log-file", rootCmd.PersistentFlags().Lookup("log-file"))
+	rootCmd.PersistentFlags().String("record", "", "record the HTTP exchanges with Prism Central, secrets redacted, in this HAR file")
+	p.viper.BindPFlag("record", rootCmd.PersistentFlags().Lookup("record"))
+	rootCmd.PersistentFlags().String("replay", "", "replay the HTTP exchanges of a HAR file recorded with --record instead of connecting to Prism Central")
+	p.viper.BindPFlag("replay", rootCmd.PersistentFlags().Lookup("replay"))
+	rootCmd.PersistentFlags().String("proxy-url", "", "proxy to reach Prism Central, http://, https:// or socks5:// URL (default from HTTPS_PROXY)")
+	p.viper.BindPFlag("proxy-url", rootCmd.PersistentFlags().Lookup("proxy-url"))
+	rootCmd.PersistentFlags().String("ssh-jump", "", "SSH bastion, [user@]host[:port], to reach Prism Central and the nodes")
+	p.viper.BindPFlag("ssh-jump", rootCmd.PersistentFlags().Lookup("ssh-jump"))
+	rootCmd.PersistentFlags().String("ssh-jump-key", "", "private key file to authenticate on the SSH bastion (default keys of the ssh-agent)")
+	p.viper.BindPFlag("ssh-jump-key", rootCmd.PersistentFlags().Lookup("ssh-jump-key"))
 	rootCmd.PersistentFlags().Int("request-timeout", 30, "request timeout in seconds for HTTP client")
+	p.viper.BindPFlag("request-timeout", rootCmd.PersistentFlags().Lookup("request-timeout"))
+	rootCmd.PersistentFlags().String("profile", "", "profile to use from the profiles section of the config file")
+	p.viper.BindPFlag("profile", rootCmd.PersistentFlags().Lookup("profile"))
 
-	userHomeDir, err := os.UserHomeDir()
-	cobra.CheckErr(err)
-	defaultKubeconfig := fmt.Sprintf("%s/.kube/config", userHomeDir)
+	defaultKubeconfig := filepath.Join(o.HomeDir, ".kube", "config")
 
 	rootCmd.PersistentFlags().String("kubeconfig", defaultKubeconfig, "path to the kubeconfig file to use for CLI requests")
-	viper.BindPFlag("kubeconfig", rootCmd.PersistentFlags().Lookup("kubeconfig"))
+	p.viper.BindPFlag("kubeconfig", rootCmd.PersistentFlags().Lookup("kubeconfig"))
+
+	rootCmd.AddCommand(
+		newAgentCmd(p),
+		newCpCmd(p),
+		newDaemonCmd(p),
+		newDevCmd(p),
+		newExecCmd(p),
+		newExportCmd(p),
+		newKubeconfigCmd(p),
+		newListCmd(p),
+		newLoginCmd(p),
+		newLogoutCmd(p),
+		newPruneCmd(p),
+		newSSHCmd(p),
+		newSSHAgentCmd(p),
+		newSSHConfigCmd(p),
+		newSSHKeyCmd(p),
+		newSupportBundleCmd(p),
+		newTunnelCmd(p),
+		newUICmd(p),
+		newVersionCmd(p),
+	)
+
+	return rootCmd
+}
 
-	// Cobra also supports local flags, which will only run
-	// when this action is called directly.
+// Execute runs the root command with the dependencies of a terminal.
+// This is called by main.main().
+func Execute() {
+	err := NewRootCommand(NewDefaultOptions()).Execute()
 
+	var exitErr *exitError
+	switch {
+	case errors.As(err, &exitErr):
+		os.Exit(exitErr.code)
+	case err != nil:
+		os.Exit(1)
+	}
 }
 
 // initConfig reads in config file and ENV variables if set.
-func initConfig() {
-	// Find home directory.
+func (p *plugin) initConfig() error {
+	p.viper.SetFs(p.Fs)
 
-	if cfgFile != "" {
+	if p.cfgFile != "" {
 		// Use config file from the flag.
-		viper.SetConfigFile(cfgFile)
+		p.viper.SetConfigFile(p.cfgFile)
 	} else {
 
 		// Search config in home directory with name ".kubectl-karbon" (without extension).
-		userHomeDir, err := os.UserHomeDir()
-		cobra.CheckErr(err)
+		userHomeDir, err := p.homeDir()
+		if err != nil {
+			return err
+		}
 
-		viper.AddConfigPath(userHomeDir)
-		viper.SetConfigName(".kubectl-karbon")
+		p.viper.AddConfigPath(userHomeDir)
+		p.viper.SetConfigName(".kubectl-karbon")
 	}
 
-	viper.SetEnvPrefix("karbon")
-	viper.BindEnv("kubeconfig", "KUBECONFIG")
-	viper.AutomaticEnv() // read in environment variables that match
+	p.viper.SetEnvPrefix("karbon")
+	p.viper.BindEnv("kubeconfig", "KUBECONFIG")
+	p.viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		if verbose {
-			fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+	configErr := p.viper.ReadInConfig()
+
+	// Settings of the selected profile override the global ones of the config file
+	if profile := p.viper.GetString("profile"); profile != "" {
+		profiles := p.viper.GetStringMap("profiles")
+		settings, ok := profiles[strings.ToLower(profile)].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("profile %s not found in config file", profile)
 		}
+		err := p.viper.MergeConfigMap(settings)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the log settings can come from the config file or the profile
+	err := p.setupLogger()
+	if err != nil {
+		return err
 	}
+
+	if configErr == nil {
+		p.logger.Info("using config file", "file", p.viper.ConfigFileUsed())
+	}
+	if profile := p.viper.GetString("profile"); profile != "" {
+		p.logger.Info("using profile", "profile", profile)
+	}
+
+	return nil
 }
@@ -0,0 +1,193 @@
+/*
+Package cmd ssh open an SSH session on a karbon node
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// newSSHCmd returns the ssh command
+func newSSHCmd(p *plugin) *cobra.Command {
+	sshCmd := &cobra.Command{
+		Use:   "ssh <cluster> [node] [-- command]",
+		Short: "Open an SSH session on a node of a k8s cluster",
+		Long: `Open an SSH session on a node of a Karbon cluster using the Karbon SSH certificate.
+
+The node can be given by hostname or IP address, a fuzzy finder is opened when omitted.
+A valid key/cert saved with "login --ssh-file" or added to the ssh-agent is reused, otherwise a fresh one is retrieved.
+A single remote command can be given after "--", use -t to allocate a terminal for it.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			positional, _ := splitArgsAtDash(cmd, args)
+			if len(positional) < 1 || len(positional) > 2 {
+				return fmt.Errorf("accepts a cluster and an optional node, received %d arg(s)", len(positional))
+			}
+			return nil
+		},
+		PreRun: func(cmd *cobra.Command, args []string) {
+
+			p.viper.BindPFlag("server", cmd.Flags().Lookup("server"))
+			p.viper.BindPFlag("user", cmd.Flags().Lookup("user"))
+			p.viper.BindPFlag("port", cmd.Flags().Lookup("port"))
+			p.viper.BindPFlag("insecure", cmd.Flags().Lookup("insecure"))
+			p.viper.BindPFlag("keyring", cmd.Flags().Lookup("keyring"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			positional, command := splitArgsAtDash(cmd, args)
+			karbonCluster := positional[0]
+			forceTTY, _ := cmd.Flags().GetBool("tty")
+
+			nutanixCluster, err := p.newNutanixCluster(cmd)
+			if err != nil {
+				return err
+			}
+
+			nodes, err := nutanixCluster.listKarbonNodes(karbonCluster)
+			if err != nil {
+				return err
+			}
+
+			var node karbonNode
+			if len(positional) == 2 {
+				node, err = findNode(nodes, positional[1])
+			} else {
+				node, err = selectNode(nodes)
+			}
+			if err != nil {
+				return err
+			}
+
+			config, err := nutanixCluster.clusterSSHClientConfig(karbonCluster)
+			if err != nil {
+				return err
+			}
+
+			client, err := p.dialNode(nutanixCluster.nodeRoute(karbonCluster), node, config)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+
+			exitCode, err := runSession(p.IOStreams, client, command, forceTTY || len(command) == 0)
+			if err != nil {
+				return err
+			}
+
+			if exitCode != 0 {
+				return exitWithCode(cmd, exitCode)
+			}
+			return nil
+		},
+	}
+
+	user, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+
+	sshCmd.Flags().String("server", "", "Address of the PC to authenticate against")
+
+	sshCmd.Flags().StringP("user", "u", user.Username, "Username to authenticate")
+
+	sshCmd.Flags().Int("port", 9440, "Port to run Application server on")
+
+	sshCmd.Flags().BoolP("insecure", "k", false, "Skip certificate verification (this is insecure)")
+
+	sshCmd.Flags().Bool("keyring", false, "Use keyring to store and retrieve credential")
+
+	sshCmd.Flags().BoolP("tty", "t", false, "Allocate a terminal for the remote command")
+
+	return sshCmd
+}
+
+// splitArgsAtDash separates the positional arguments from the command given after "--"
+func splitArgsAtDash(cmd *cobra.Command, args []string) ([]string, []string) {
+	dash := cmd.ArgsLenAtDash()
+	if dash < 0 {
+		return args, nil
+	}
+	return args[:dash], args[dash:]
+}
+
+// runSession runs a remote command, or an interactive shell when command is empty,
+// and returns its exit code
+func runSession(streams IOStreams, client *ssh.Client, command []string, tty bool) (int, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	session.Stdin = streams.In
+	session.Stdout = streams.Out
+	session.Stderr = streams.ErrOut
+
+	fd, terminal := streams.inTerminal()
+	if tty && terminal {
+		oldState, err := term.MakeRaw(fd)
+		if err != nil {
+			return 0, err
+		}
+		defer term.Restore(fd, oldState)
+
+		width, height, err := term.GetSize(fd)
+		if err != nil {
+			width, height = 80, 24
+		}
+
+		termType := os.Getenv("TERM")
+		if termType == "" {
+			termType = "xterm-256color"
+		}
+
+		err = session.RequestPty(termType, height, width, ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		stop := watchWindowSize(session, fd)
+		defer stop()
+	}
+
+	if len(command) > 0 {
+		err = session.Run(strings.Join(command, " "))
+	} else {
+		err = session.Shell()
+		if err == nil {
+			err = session.Wait()
+		}
+	}
+
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	}
+
+	return 0, err
+}
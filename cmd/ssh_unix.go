@@ -0,0 +1,47 @@
+//go:build !windows
+
+/*
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// watchWindowSize forwards the local terminal size changes to the remote session
+func watchWindowSize(session *ssh.Session, fd int) func() {
+	sigwinch := make(chan os.Signal, 1)
+	signal.Notify(sigwinch, syscall.SIGWINCH)
+
+	go func() {
+		for range sigwinch {
+			width, height, err := term.GetSize(fd)
+			if err == nil {
+				session.WindowChange(height, width)
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigwinch)
+		close(sigwinch)
+	}
+}
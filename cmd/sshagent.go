@@ -0,0 +1,275 @@
+/*
+Package cmd ssh-agent manage the karbon keys of the ssh-agent
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var errNoSSHAgent = errors.New("no ssh-agent available, SSH_AUTH_SOCK environment variable not set")
+
+// agentKeyPrefix prefixes the comment of the karbon keys added to the ssh-agent
+const agentKeyPrefix = "karbon cluster "
+
+// agentKeyInfo is a Karbon key of the ssh-agent, without expiry when it is not a cert
+type agentKeyInfo struct {
+	Cluster     string     `json:"cluster"`
+	Fingerprint string     `json:"fingerprint"`
+	Principals  []string   `json:"principals,omitempty"`
+	Expiry      *time.Time `json:"expiry,omitempty"`
+}
+
+// newSSHAgentCmd returns the ssh-agent command
+func newSSHAgentCmd(p *plugin) *cobra.Command {
+	sshAgentCmd := &cobra.Command{
+		Use:   "ssh-agent",
+		Short: "Manage the Karbon keys of the ssh-agent",
+		Long:  `Manage the Karbon SSH keys/certs added to the ssh-agent with "login --ssh-agent".`,
+	}
+
+	sshAgentCmd.AddCommand(newSSHAgentListCmd(p))
+
+	return sshAgentCmd
+}
+
+// newSSHAgentListCmd returns the ssh-agent list command
+func newSSHAgentListCmd(p *plugin) *cobra.Command {
+	sshAgentListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the Karbon keys of the ssh-agent",
+		Long:  `List the Karbon SSH keys/certs of the ssh-agent with their remaining lifetime.`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			conn, agentClient, err := dialSSHAgent()
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			keys, err := agentClient.List()
+			if err != nil {
+				return err
+			}
+
+			agentKeys := []agentKeyInfo{}
+			for _, key := range keys {
+				cluster, ok := strings.CutPrefix(key.Comment, agentKeyPrefix)
+				if !ok {
+					continue
+				}
+
+				info := agentKeyInfo{Cluster: cluster, Fingerprint: ssh.FingerprintSHA256(key)}
+
+				pub, err := ssh.ParsePublicKey(key.Blob)
+				if err == nil {
+					if cert, ok := pub.(*ssh.Certificate); ok {
+						validBefore := time.Unix(int64(cert.ValidBefore), 0)
+						info.Fingerprint = ssh.FingerprintSHA256(cert.Key)
+						info.Principals = cert.ValidPrincipals
+						info.Expiry = &validBefore
+					}
+				}
+
+				agentKeys = append(agentKeys, info)
+			}
+
+			if p.jsonOutputEnabled() {
+				return p.printJSONOutput(commandOutput{Command: commandName(cmd), Success: true, Result: agentKeys})
+			}
+
+			w := new(tabwriter.Writer)
+			w.Init(p.out, 8, 8, 0, '\t', 0)
+			defer w.Flush()
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t", "CLUSTER", "FINGERPRINT", "PRINCIPALS", "EXPIRY", "REMAINING")
+
+			now := p.Clock.Now()
+			for _, info := range agentKeys {
+				expiry := "-"
+				remaining := "-"
+				principals := "-"
+
+				if info.Expiry != nil {
+					principals = strings.Join(info.Principals, ",")
+					expiry = formatTime(*info.Expiry)
+					remaining = "expired"
+					if info.Expiry.After(now) {
+						remaining = info.Expiry.Sub(now).Round(time.Second).String()
+					}
+				}
+
+				fmt.Fprintf(w, "\n%s\t%s\t%s\t%s\t%s\t", info.Cluster, info.Fingerprint, principals, expiry, remaining)
+			}
+			fmt.Fprintf(w, "\n")
+			return nil
+		},
+	}
+
+	p.jsonOutputCommand(sshAgentListCmd)
+
+	return sshAgentListCmd
+}
+
+// dialSSHAgent connects to the ssh-agent of SSH_AUTH_SOCK, the connection must be closed by the caller
+func dialSSHAgent() (net.Conn, agent.ExtendedAgent, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, nil, errNoSSHAgent
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to ssh-agent: %w", err)
+	}
+
+	return conn, agent.NewClient(conn), nil
+}
+
+// agentKeyComment returns the comment identifying the key of a cluster in the ssh-agent
+func agentKeyComment(cluster string) string {
+	return agentKeyPrefix + cluster
+}
+
+// agentAddedKey builds the ssh-agent key of a cluster with a lifetime matching the cert expiry
+func (p *plugin) agentAddedKey(cluster string, sshConfig sshConfig, confirm bool) (agent.AddedKey, time.Time, error) {
+
+	privateKey := []byte(sshConfig.PrivateKey)
+	certificate := []byte(sshConfig.Certificate)
+
+	parsedKey, err := ssh.ParseRawPrivateKey(privateKey)
+	if err != nil {
+		return agent.AddedKey{}, time.Time{}, err
+	}
+
+	sshCert, err := unmarshalCert(certificate)
+	if err != nil {
+		return agent.AddedKey{}, time.Time{}, err
+	}
+
+	expiry, err := sshCertExpiry(sshConfig)
+	if err != nil {
+		return agent.AddedKey{}, time.Time{}, err
+	}
+
+	lifetime := math.Ceil(expiry.Sub(p.Clock.Now()).Seconds())
+	if lifetime <= 0 {
+		return agent.AddedKey{}, time.Time{}, fmt.Errorf("SSH cert of cluster %s expired on %s", cluster, formatTime(expiry))
+	}
+	if lifetime > math.MaxUint32 {
+		lifetime = math.MaxUint32
+	}
+
+	return agent.AddedKey{
+		PrivateKey:       parsedKey,
+		Certificate:      sshCert,
+		Comment:          agentKeyComment(cluster),
+		LifetimeSecs:     uint32(lifetime),
+		ConfirmBeforeUse: confirm,
+	}, expiry, nil
+}
+
+// addKeyAgent adds the key/cert of a cluster to the ssh-agent, replacing a previous one
+func (p *plugin) addKeyAgent(cluster string, sshConfig sshConfig, confirm bool) error {
+
+	addedKey, _, err := p.agentAddedKey(cluster, sshConfig, confirm)
+	if err != nil {
+		return err
+	}
+
+	conn, agentClient, err := dialSSHAgent()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = replaceAgentKey(agentClient, cluster, addedKey)
+	if err != nil {
+		return err
+	}
+
+	p.logger.Info("SSH key added to ssh-agent", "cluster", cluster, "lifetime", time.Duration(addedKey.LifetimeSecs)*time.Second)
+	return nil
+
+}
+
+// replaceAgentKey adds a key of a cluster to the ssh-agent then removes the previous ones,
+// a failed add keeps the previous keys
+func replaceAgentKey(agentClient agent.Agent, cluster string, addedKey agent.AddedKey) error {
+	err := agentClient.Add(addedKey)
+	if err != nil {
+		return err
+	}
+
+	_, err = removeAgentKeys(agentClient, cluster, addedKey.Certificate.Marshal())
+	return err
+}
+
+// deleteKeyAgent removes the keys of a cluster from the ssh-agent and returns their number
+func (p *plugin) deleteKeyAgent(cluster string) (int, error) {
+
+	conn, agentClient, err := dialSSHAgent()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	removed, err := removeAgentKeys(agentClient, cluster, nil)
+	if err != nil {
+		return removed, err
+	}
+
+	if removed > 0 {
+		p.logger.Info("SSH key deleted from ssh-agent", "cluster", cluster)
+	}
+
+	return removed, nil
+}
+
+// removeAgentKeys removes the keys of a cluster from the ssh-agent, except the one whose blob is keep,
+// and returns their number
+func removeAgentKeys(agentClient agent.Agent, cluster string, keep []byte) (int, error) {
+	keyList, err := agentClient.List()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, key := range keyList {
+		if key.Comment == agentKeyComment(cluster) && !bytes.Equal(key.Blob, keep) {
+			err = agentClient.Remove(key)
+			if err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,261 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nutanix/kubectl-karbon/karbontest"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testSSHConfig returns a key/cert signed by a throwaway CA and valid until expiry
+func testSSHConfig(t *testing.T, expiry time.Time) sshConfig {
+	t.Helper()
+
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSigner, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := &ssh.Certificate{
+		Key:             sshPublicKey,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{defaultSSHUsername},
+		ValidAfter:      uint64(expiry.Add(-24 * time.Hour).Unix()),
+		ValidBefore:     uint64(expiry.Unix()),
+	}
+	err = cert.SignCert(rand.Reader, caSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(privateKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sshConfig{
+		PrivateKey:  string(pem.EncodeToMemory(block)),
+		Certificate: string(ssh.MarshalAuthorizedKey(cert)),
+		ExpiryTime:  expiry.Format(time.RFC3339),
+		Username:    defaultSSHUsername,
+	}
+}
+
+func TestAgentAddedKeyLifetime(t *testing.T) {
+	o, _, _ := testOptions(t)
+	p := newPlugin(o)
+
+	expiry := testNow.Add(90 * time.Minute)
+
+	addedKey, gotExpiry, err := p.agentAddedKey("a", testSSHConfig(t, expiry), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addedKey.LifetimeSecs != 90*60 {
+		t.Errorf("lifetime = %d, want %d", addedKey.LifetimeSecs, 90*60)
+	}
+	if !gotExpiry.Equal(expiry) {
+		t.Errorf("expiry = %s, want %s", gotExpiry, expiry)
+	}
+	if addedKey.Comment != agentKeyComment("a") || !addedKey.ConfirmBeforeUse {
+		t.Errorf("added key = %+v", addedKey)
+	}
+}
+
+func TestAgentAddedKeyExpired(t *testing.T) {
+	o, _, _ := testOptions(t)
+	p := newPlugin(o)
+
+	_, _, err := p.agentAddedKey("a", testSSHConfig(t, testNow.Add(-time.Second)), false)
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("error = %v, want expired cert", err)
+	}
+}
+
+func TestCertValid(t *testing.T) {
+	o, _, _ := testOptions(t)
+	p := newPlugin(o)
+
+	for _, test := range []struct {
+		expiry time.Time
+		valid  bool
+	}{
+		{testNow.Add(time.Hour), true},
+		{testNow.Add(30 * time.Second), false},
+		{testNow.Add(-time.Hour), false},
+	} {
+		cert, err := unmarshalCert([]byte(testSSHConfig(t, test.expiry).Certificate))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.certValid(cert); got != test.valid {
+			t.Errorf("certValid(expiry %s) = %v, want %v", test.expiry, got, test.valid)
+		}
+	}
+}
+
+// failingAgent is an ssh-agent refusing to add keys
+type failingAgent struct {
+	agent.Agent
+}
+
+func (failingAgent) Add(agent.AddedKey) error {
+	return errors.New("agent refused the key")
+}
+
+func TestReplaceAgentKey(t *testing.T) {
+	o, _, _ := testOptions(t)
+	p := newPlugin(o)
+
+	keyring := agent.NewKeyring()
+
+	oldKey, _, err := p.agentAddedKey("a", testSSHConfig(t, testNow.Add(time.Hour)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replaceAgentKey(keyring, "a", oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey, _, err := p.agentAddedKey("a", testSSHConfig(t, testNow.Add(2*time.Hour)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = replaceAgentKey(failingAgent{keyring}, "a", newKey)
+	if err == nil {
+		t.Fatal("failed add not reported")
+	}
+	keys, _ := keyring.List()
+	if len(keys) != 1 || !bytes.Equal(keys[0].Blob, oldKey.Certificate.Marshal()) {
+		t.Fatalf("previous key not kept after a failed add: %v", keys)
+	}
+
+	err = replaceAgentKey(keyring, "a", newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, _ = keyring.List()
+	if len(keys) != 1 || !bytes.Equal(keys[0].Blob, newKey.Certificate.Marshal()) {
+		t.Errorf("keys = %v, want only the new key", keys)
+	}
+}
+
+// recordingAgent is an in-memory ssh-agent recording the added keys
+type recordingAgent struct {
+	agent.Agent
+
+	mu    sync.Mutex
+	added []agent.AddedKey
+}
+
+func (a *recordingAgent) Add(key agent.AddedKey) error {
+	a.mu.Lock()
+	a.added = append(a.added, key)
+	a.mu.Unlock()
+	return a.Agent.Add(key)
+}
+
+// serveTestAgent serves an in-memory ssh-agent on the SSH_AUTH_SOCK of the test
+func serveTestAgent(t *testing.T) *recordingAgent {
+	t.Helper()
+
+	keyring := &recordingAgent{Agent: agent.NewKeyring()}
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	t.Setenv("SSH_AUTH_SOCK", socket)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	return keyring
+}
+
+func TestLoginAgentKeyLifetime(t *testing.T) {
+	server := karbontest.NewServer(karbontest.Cluster{Name: "a"})
+	defer server.Close()
+
+	o, _, _ := testOptions(t)
+	t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+	keyring := serveTestAgent(t)
+
+	// the fake Prism Central issues certs valid from the real time
+	now := time.Now()
+	o.Clock = fakeClock{now: now}
+
+	for i := 0; i < 2; i++ {
+		err := executeCommand(t, o, append([]string{"login", "--cluster", "a", "--ssh-agent", "--force"}, fakeServerArgs(server)...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(keyring.added) != 2 {
+		t.Fatalf("%d keys added, want one per login", len(keyring.added))
+	}
+	for _, key := range keyring.added {
+		lifetime := time.Duration(key.LifetimeSecs) * time.Second
+		if lifetime > server.SSHLifetime+time.Second || lifetime < server.SSHLifetime-time.Minute {
+			t.Errorf("lifetime = %s, want the %s validity of the cert", lifetime, server.SSHLifetime)
+		}
+	}
+
+	// the key of the second login replaced the first one
+	keys, err := keyring.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != agentKeyComment("a") || !bytes.Equal(keys[0].Blob, keyring.added[1].Certificate.Marshal()) {
+		t.Errorf("agent keys = %v, want only the key of the last login", keys)
+	}
+
+	err = executeCommand(t, o, "logout", "--cluster", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, _ = keyring.List()
+	if len(keys) != 0 {
+		t.Errorf("agent keys after logout = %v", keys)
+	}
+}
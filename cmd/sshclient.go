@@ -0,0 +1,397 @@
+/*
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ktr0731/go-fuzzyfinder"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultSSHUsername is the user of karbon nodes when not returned by the API
+const defaultSSHUsername = "nutanix"
+
+type karbonNodePool struct {
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	Nodes    []struct {
+		Hostname    string `json:"hostname"`
+		IPv4Address string `json:"ipv4_address"`
+	} `json:"nodes"`
+}
+
+// karbonNode is a VM of a karbon cluster
+type karbonNode struct {
+	Hostname    string
+	IPv4Address string
+	Pool        string
+	Category    string
+}
+
+// listKarbonNodes returns the nodes of all the node pools of a karbon cluster
+func (nutanix *nutanixCluster) listKarbonNodes(cluster string) ([]karbonNode, error) {
+	karbonNodePoolsPath := fmt.Sprintf("/karbon/v1-beta.1/k8s/clusters/%s/node-pools", cluster)
+	method := "GET"
+
+	nutanix.logger.Info("retrieve node list", "cluster", cluster)
+
+	responseJSON, err := nutanix.clusterRequest(method, karbonNodePoolsPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var pools []karbonNodePool
+
+	err = json.Unmarshal(responseJSON, &pools)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []karbonNode
+	for _, pool := range pools {
+		for _, node := range pool.Nodes {
+			nodes = append(nodes, karbonNode{
+				Hostname:    node.Hostname,
+				IPv4Address: node.IPv4Address,
+				Pool:        pool.Name,
+				Category:    pool.Category,
+			})
+		}
+	}
+
+	return nodes, nil
+}
+
+// findNode returns the node matching a hostname or an IP address
+func findNode(nodes []karbonNode, name string) (karbonNode, error) {
+	for _, node := range nodes {
+		if node.Hostname == name || node.IPv4Address == name {
+			return node, nil
+		}
+	}
+	return karbonNode{}, fmt.Errorf("node %s not found", name)
+}
+
+// selectNode lets the user choose a node with the fuzzy finder
+func selectNode(nodes []karbonNode) (karbonNode, error) {
+	idx, err := fuzzyfinder.Find(
+		nodes,
+		func(i int) string {
+			return nodes[i].Hostname
+		},
+		fuzzyfinder.WithPreviewWindow(func(i, w, h int) string {
+			if i == -1 {
+				return ""
+			}
+
+			return fmt.Sprintf("%s\n\n      IP: %s\n    pool: %s\ncategory: %s",
+				nodes[i].Hostname,
+				nodes[i].IPv4Address,
+				nodes[i].Pool,
+				nodes[i].Category)
+		}),
+	)
+
+	if err != nil {
+		return karbonNode{}, err
+	}
+
+	return nodes[idx], nil
+}
+
+// clusterSSHClientConfig returns the SSH client configuration of a cluster, using in order the key/cert files
+// saved at login when still valid, the key added to the ssh-agent at login, or a fresh key/cert from the API
+func (nutanix *nutanixCluster) clusterSSHClientConfig(cluster string) (*ssh.ClientConfig, error) {
+	karbonSSH, err := nutanix.loadKeyFile(cluster)
+	if err == nil {
+		cert, err := unmarshalCert([]byte(karbonSSH.Certificate))
+		if err == nil && nutanix.certValid(cert) {
+			nutanix.logger.Info("using SSH key/cert files", "cluster", cluster)
+			karbonSSH.Username = nutanix.sshUsername(cluster)
+			return nutanix.sshClientConfig(karbonSSH)
+		}
+	}
+
+	signer, err := nutanix.agentSigner(cluster)
+	if err == nil {
+		nutanix.logger.Info("using SSH key/cert from ssh-agent", "cluster", cluster)
+		return nutanix.signerClientConfig(signer, nutanix.sshUsername(cluster))
+	}
+
+	karbonSSH, err = nutanix.getSSHConfig(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return nutanix.sshClientConfig(karbonSSH)
+}
+
+// sshUsername returns the user of the nodes of a cluster returned by the API at login, the default one
+// when the login did not retrieve the SSH key/cert or was on another Prism Central
+func (nutanix *nutanixCluster) sshUsername(cluster string) string {
+	entry, err := nutanix.lookupState(nutanix.server, cluster)
+	if err != nil {
+		nutanix.logger.Warn("SSH user of the login unknown, state file not read", "error", err)
+	}
+	if entry != nil && entry.SSHUsername != "" {
+		return entry.SSHUsername
+	}
+
+	return defaultSSHUsername
+}
+
+// certValid reports if a certificate is valid for at least another minute
+func (p *plugin) certValid(cert *ssh.Certificate) bool {
+	return p.Clock.Now().Add(time.Minute).Before(time.Unix(int64(cert.ValidBefore), 0))
+}
+
+// agentSigner returns the signer of the valid key/cert added to the ssh-agent for a cluster
+func (p *plugin) agentSigner(cluster string) (ssh.Signer, error) {
+	conn, agentClient, err := dialSSHAgent()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := agentClient.List()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	signers, err := agentClient.Signers()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if key.Comment != agentKeyComment(cluster) {
+			continue
+		}
+
+		pub, err := ssh.ParsePublicKey(key.Blob)
+		if err != nil {
+			continue
+		}
+		if cert, ok := pub.(*ssh.Certificate); !ok || !p.certValid(cert) {
+			continue
+		}
+
+		for _, signer := range signers {
+			if bytes.Equal(signer.PublicKey().Marshal(), key.Blob) {
+				// the connection stays open for the signer lifetime
+				return signer, nil
+			}
+		}
+	}
+
+	conn.Close()
+	return nil, fmt.Errorf("no valid key found in ssh-agent for cluster %s", cluster)
+}
+
+// loadKeyFile reads the SSH key/cert saved by saveKeyFile
+func (nutanix *nutanixCluster) loadKeyFile(cluster string) (*sshConfig, error) {
+	privateKeyFile, certificateFile, err := nutanix.sshKeyFiles(nutanix.server, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := afero.ReadFile(nutanix.Fs, privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := afero.ReadFile(nutanix.Fs, certificateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sshConfig{
+		PrivateKey:  string(privateKey),
+		Certificate: string(certificate),
+	}, nil
+}
+
+// sshClientConfig builds the SSH client configuration authenticating with the karbon cert
+func (p *plugin) sshClientConfig(karbonSSH *sshConfig) (*ssh.ClientConfig, error) {
+	parsedKey, err := ssh.ParseRawPrivateKey([]byte(karbonSSH.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.NewSignerFromKey(parsedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sshCert, err := unmarshalCert([]byte(karbonSSH.Certificate))
+	if err != nil {
+		return nil, err
+	}
+
+	certSigner, err := ssh.NewCertSigner(sshCert, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	username := karbonSSH.Username
+	if username == "" {
+		username = defaultSSHUsername
+	}
+
+	return p.signerClientConfig(certSigner, username)
+}
+
+// signerClientConfig builds the SSH client configuration authenticating with a signer
+func (p *plugin) signerClientConfig(signer ssh.Signer, username string) (*ssh.ClientConfig, error) {
+	hostKeyCallback, err := p.knownHostsCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}, nil
+}
+
+// knownHostsCallback checks host keys against ~/.ssh/known_hosts,
+// unknown hosts are added to the file (like StrictHostKeyChecking=accept-new) and changed keys are rejected
+func (p *plugin) knownHostsCallback() (ssh.HostKeyCallback, error) {
+	userHomeDir, err := p.homeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	sshDir := filepath.Join(userHomeDir, ".ssh")
+	err = p.Fs.MkdirAll(sshDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	knownHostsFile := filepath.Join(sshDir, "known_hosts")
+	file, err := p.Fs.OpenFile(knownHostsFile, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	callback, err := p.readKnownHosts(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// hosts added by this callback, the known_hosts file is only read once
+	added := map[string]bool{}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return err
+		}
+
+		p.knownHostsMutex.Lock()
+		defer p.knownHostsMutex.Unlock()
+
+		entry := knownhosts.Normalize(hostname) + " " + ssh.FingerprintSHA256(key)
+		if added[entry] {
+			return nil
+		}
+
+		file, err := p.Fs.OpenFile(knownHostsFile, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = fmt.Fprintln(file, knownhosts.Line([]string{hostname}, key))
+		if err != nil {
+			return err
+		}
+
+		added[entry] = true
+		fmt.Fprintf(p.ErrOut, "Warning: Permanently added '%s' (%s) to the list of known hosts.\n", knownhosts.Normalize(hostname), key.Type())
+		return nil
+	}, nil
+}
+
+// readKnownHosts returns the callback of a known_hosts file of the plugin filesystem,
+// knownhosts only reads files of the OS so it is given a temporary copy
+func (p *plugin) readKnownHosts(knownHostsFile string) (ssh.HostKeyCallback, error) {
+	data, err := afero.ReadFile(p.Fs, knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp("", "kubectl-karbon-known-hosts-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return knownhosts.New(tmp.Name())
+}
+
+// dialNode opens an SSH connection to a karbon node, through the SSH bastion of the route if any
+func (p *plugin) dialNode(route prismRoute, node karbonNode, config *ssh.ClientConfig) (*ssh.Client, error) {
+	address := net.JoinHostPort(node.IPv4Address, "22")
+
+	p.logger.Info("connect to node", "node", node.Hostname, "address", address)
+
+	if route.sshJump == "" {
+		client, err := ssh.Dial("tcp", address, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to node %s: %w", node.Hostname, err)
+		}
+		return client, nil
+	}
+
+	conn, err := p.dialJump(context.Background(), route, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node %s: %w", node.Hostname, err)
+	}
+
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to node %s: %w", node.Hostname, err)
+	}
+
+	return ssh.NewClient(clientConn, channels, requests), nil
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+)
+
+func testHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestKnownHostsCallback(t *testing.T) {
+	o, _, _ := testOptions(t)
+	p := newPlugin(o)
+
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.10"), Port: 22}
+	key := testHostKey(t)
+
+	callback, err := p.knownHostsCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = callback("10.0.0.10:22", remote, key)
+	if err != nil {
+		t.Fatalf("unknown host rejected: %v", err)
+	}
+
+	data, err := afero.ReadFile(o.Fs, "/home/test/.ssh/known_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "10.0.0.10 ssh-ed25519 ") {
+		t.Errorf("known_hosts = %q", data)
+	}
+
+	// a new callback reads the added host from the plugin filesystem
+	callback, err = p.knownHostsCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callback("10.0.0.10:22", remote, key); err != nil {
+		t.Errorf("known host rejected: %v", err)
+	}
+	if err := callback("10.0.0.10:22", remote, testHostKey(t)); err == nil {
+		t.Error("changed host key accepted")
+	}
+}
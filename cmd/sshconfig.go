@@ -0,0 +1,216 @@
+/*
+Package cmd ssh-config generate OpenSSH client configuration for karbon nodes
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+// sshConfigResult is the JSON result of ssh-config
+type sshConfigResult struct {
+	Cluster string   `json:"cluster"`
+	File    string   `json:"file"`
+	Hosts   []string `json:"hosts"`
+}
+
+// newSSHConfigCmd returns the ssh-config command
+func newSSHConfigCmd(p *plugin) *cobra.Command {
+	sshConfigCmd := &cobra.Command{
+		Use:   "ssh-config <cluster>",
+		Short: "Generate OpenSSH client configuration for the nodes of a k8s cluster",
+		Long: `Write a managed OpenSSH client configuration file ~/.ssh/karbon.d/<cluster>.conf
+with a Host <cluster>-<node> entry per node of the Karbon cluster.
+
+Add "Include karbon.d/*.conf" at the top of ~/.ssh/config to use it with plain ssh.
+The key/cert files saved with "login --ssh-file" are referenced when present, otherwise the ssh-agent is used.
+The user of the nodes is the one returned with the SSH key/cert at login, nutanix without login.`,
+		Args: cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+
+			p.viper.BindPFlag("server", cmd.Flags().Lookup("server"))
+			p.viper.BindPFlag("user", cmd.Flags().Lookup("user"))
+			p.viper.BindPFlag("port", cmd.Flags().Lookup("port"))
+			p.viper.BindPFlag("insecure", cmd.Flags().Lookup("insecure"))
+			p.viper.BindPFlag("keyring", cmd.Flags().Lookup("keyring"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			karbonCluster := args[0]
+
+			nutanixCluster, err := p.newNutanixCluster(cmd)
+			if err != nil {
+				return err
+			}
+
+			nodes, err := nutanixCluster.listKarbonNodes(karbonCluster)
+			if err != nil {
+				return err
+			}
+
+			// no SSH key/cert is issued to write a config file, the user is the one of the login
+			sshConfigFile, err := nutanixCluster.writeSSHConfig(karbonCluster, nodes, nutanixCluster.sshUsername(karbonCluster), nutanixCluster.nodeRoute(karbonCluster))
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(p.out, "SSH config file %s successfully written\n", sshConfigFile)
+
+			if p.jsonOutputEnabled() {
+				result := sshConfigResult{Cluster: karbonCluster, File: sshConfigFile, Hosts: []string{}}
+				for _, node := range nodes {
+					result.Hosts = append(result.Hosts, sshHostAlias(karbonCluster, node))
+				}
+				return p.printJSONOutput(commandOutput{Command: commandName(cmd), Success: true, Result: result})
+			}
+			return nil
+		},
+	}
+
+	p.jsonOutputCommand(sshConfigCmd)
+
+	user, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+
+	sshConfigCmd.Flags().String("server", "", "Address of the PC to authenticate against")
+
+	sshConfigCmd.Flags().StringP("user", "u", user.Username, "Username to authenticate")
+
+	sshConfigCmd.Flags().Int("port", 9440, "Port to run Application server on")
+
+	sshConfigCmd.Flags().BoolP("insecure", "k", false, "Skip certificate verification (this is insecure)")
+
+	sshConfigCmd.Flags().Bool("keyring", false, "Use keyring to store and retrieve credential")
+
+	return sshConfigCmd
+}
+
+// sshConfigFile returns the managed OpenSSH configuration file of a cluster
+func (p *plugin) sshConfigFile(cluster string) (string, error) {
+	userHomeDir, err := p.homeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(userHomeDir, ".ssh", "karbon.d", fmt.Sprintf("%s.conf", cluster)), nil
+}
+
+// sshHostAlias returns the Host alias <cluster>-<node> of a node
+func sshHostAlias(cluster string, node karbonNode) string {
+	return fmt.Sprintf("%s-%s", cluster, node.Hostname)
+}
+
+// writeSSHConfig writes the managed OpenSSH configuration file of a cluster with a Host entry per node,
+// reached through the SSH bastion of the route if any
+func (nutanix *nutanixCluster) writeSSHConfig(cluster string, nodes []karbonNode, username string, route prismRoute) (string, error) {
+	configFile, err := nutanix.sshConfigFile(cluster)
+	if err != nil {
+		return "", err
+	}
+
+	privateKeyFile, certificateFile, err := nutanix.sshKeyFiles(nutanix.server, cluster)
+	if err != nil {
+		return "", err
+	}
+	_, keyErr := nutanix.Fs.Stat(privateKeyFile)
+	_, certErr := nutanix.Fs.Stat(certificateFile)
+	withFiles := keyErr == nil && certErr == nil
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Managed by kubectl-karbon for cluster %s, do not edit\n", cluster)
+
+	for _, node := range nodes {
+		fmt.Fprintf(&buf, "\nHost %s\n", sshHostAlias(cluster, node))
+		fmt.Fprintf(&buf, "    HostName %s\n", node.IPv4Address)
+		fmt.Fprintf(&buf, "    User %s\n", username)
+		if route.sshJump != "" {
+			fmt.Fprintf(&buf, "    ProxyJump %s\n", route.sshJump)
+		}
+		if withFiles {
+			fmt.Fprintf(&buf, "    IdentityFile \"%s\"\n", privateKeyFile)
+			fmt.Fprintf(&buf, "    CertificateFile \"%s\"\n", certificateFile)
+			fmt.Fprintf(&buf, "    IdentitiesOnly yes\n")
+		}
+	}
+
+	err = nutanix.Fs.MkdirAll(filepath.Dir(configFile), 0700)
+	if err != nil {
+		return "", err
+	}
+
+	err = afero.WriteFile(nutanix.Fs, configFile, buf.Bytes(), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	if !nutanix.sshConfigIncluded() {
+		nutanix.logger.Warn("add \"Include karbon.d/*.conf\" at the top of ~/.ssh/config to use the generated Host entries")
+	}
+
+	return configFile, nil
+}
+
+// deleteSSHConfig removes the managed OpenSSH configuration file of a cluster and returns it, empty if there was none
+func (p *plugin) deleteSSHConfig(cluster string) (string, error) {
+	configFile, err := p.sshConfigFile(cluster)
+	if err != nil {
+		return "", err
+	}
+
+	err = p.Fs.Remove(configFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	p.logger.Info("SSH config file deleted", "file", configFile)
+
+	return configFile, nil
+}
+
+// sshConfigIncluded reports if ~/.ssh/config includes the karbon.d directory
+func (p *plugin) sshConfigIncluded() bool {
+	userHomeDir, err := p.homeDir()
+	if err != nil {
+		return false
+	}
+
+	data, err := afero.ReadFile(p.Fs, filepath.Join(userHomeDir, ".ssh", "config"))
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.EqualFold(fields[0], "Include") && strings.Contains(line, "karbon.d") {
+			return true
+		}
+	}
+
+	return false
+}
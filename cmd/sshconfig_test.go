@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nutanix/kubectl-karbon/karbontest"
+	"github.com/spf13/afero"
+)
+
+func TestSSHConfigCommand(t *testing.T) {
+	server := karbontest.NewServer(karbontest.Cluster{
+		Name:        "a",
+		SSHUsername: "ops",
+		NodePools:   []karbontest.NodePool{{Name: "a-master-pool", Category: "master", Nodes: []karbontest.Node{{Hostname: "a-master-0", IPv4Address: "10.0.1.10"}}}},
+	})
+	defer server.Close()
+
+	o, _, _ := testOptions(t)
+	t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+	// without login, the user is the default one
+	err := executeCommand(t, o, append([]string{"ssh-config", "a"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := readSSHConfig(t, o.Fs, "a")
+	if !strings.Contains(config, "    User nutanix\n") {
+		t.Errorf("SSH config without login not for the default user:\n%s", config)
+	}
+
+	err = executeCommand(t, o, append([]string{"login", "--cluster", "a", "--ssh-file"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := len(server.Requests())
+	err = executeCommand(t, o, append([]string{"ssh-config", "a"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range server.Requests()[requests:] {
+		if strings.HasSuffix(request, "/ssh") {
+			t.Errorf("SSH key/cert issued to write the SSH config: %s", request)
+		}
+	}
+
+	config = readSSHConfig(t, o.Fs, "a")
+	for _, line := range []string{"Host a-a-master-0\n", "    HostName 10.0.1.10\n", "    User ops\n", "    IdentityFile \"/home/test/.ssh/a\"\n"} {
+		if !strings.Contains(config, line) {
+			t.Errorf("SSH config without %q:\n%s", line, config)
+		}
+	}
+}
+
+func TestClusterSSHClientConfigUser(t *testing.T) {
+	server := karbontest.NewServer(karbontest.Cluster{Name: "a", SSHUsername: "ops"})
+	defer server.Close()
+
+	o, _, _ := testOptions(t)
+	t.Setenv("KARBON_PASSWORD", karbontest.DefaultPassword)
+
+	err := executeCommand(t, o, append([]string{"login", "--cluster", "a", "--ssh-file"}, fakeServerArgs(server)...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the key/cert files of the login are used with the user returned by the API
+	cluster := &nutanixCluster{plugin: newPlugin(o), server: server.Host()}
+	config, err := cluster.clusterSSHClientConfig("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.User != "ops" {
+		t.Errorf("SSH user = %s, want ops", config.User)
+	}
+}
+
+// readSSHConfig returns the managed OpenSSH config file of a cluster
+func readSSHConfig(t *testing.T, fs afero.Fs, cluster string) string {
+	t.Helper()
+
+	data, err := afero.ReadFile(fs, "/home/test/.ssh/karbon.d/"+cluster+".conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSSHHostAlias(t *testing.T) {
+	for hostname, want := range map[string]string{
+		"karbon-a-k8s-master-0": "a-karbon-a-k8s-master-0",
+		"a-worker-0":            "a-a-worker-0",
+	} {
+		if alias := sshHostAlias("a", karbonNode{Hostname: hostname}); alias != want {
+			t.Errorf("sshHostAlias(a, %s) = %s, want %s", hostname, alias, want)
+		}
+	}
+}
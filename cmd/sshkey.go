@@ -0,0 +1,426 @@
+/*
+Package cmd ssh-key export the SSH key/cert of karbon clusters
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshKeyFormats are the supported formats of ssh-key get
+var sshKeyFormats = []string{"openssh", "ppk", "json", "pem"}
+
+// sshKeyResult is the JSON result of ssh-key get, with the key and cert when they are not written to a file
+type sshKeyResult struct {
+	Cluster     string   `json:"cluster"`
+	Format      string   `json:"format"`
+	Username    string   `json:"username"`
+	ExpiryTime  string   `json:"expiry_time,omitempty"`
+	Files       []string `json:"files,omitempty"`
+	PrivateKey  string   `json:"private_key,omitempty"`
+	Certificate string   `json:"certificate,omitempty"`
+}
+
+// newSSHKeyCmd returns the ssh-key command
+func newSSHKeyCmd(p *plugin) *cobra.Command {
+	sshKeyCmd := &cobra.Command{
+		Use:   "ssh-key",
+		Short: "Manage the SSH key/cert of k8s clusters",
+		Long:  `Manage the SSH key/cert of Karbon clusters without touching the local SSH files`,
+	}
+
+	user, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+
+	sshKeyCmd.PersistentFlags().String("server", "", "Address of the PC to authenticate against")
+
+	sshKeyCmd.PersistentFlags().StringP("user", "u", user.Username, "Username to authenticate")
+
+	sshKeyCmd.PersistentFlags().Int("port", 9440, "Port to run Application server on")
+
+	sshKeyCmd.PersistentFlags().BoolP("insecure", "k", false, "Skip certificate verification (this is insecure)")
+
+	sshKeyCmd.PersistentFlags().Bool("keyring", false, "Use keyring to store and retrieve credential")
+
+	sshKeyCmd.AddCommand(newSSHKeyGetCmd(p))
+
+	return sshKeyCmd
+}
+
+// newSSHKeyGetCmd returns the ssh-key get command
+func newSSHKeyGetCmd(p *plugin) *cobra.Command {
+	sshKeyGetCmd := &cobra.Command{
+		Use:   "get <cluster>",
+		Short: "Write the SSH key/cert of a k8s cluster to stdout or a file",
+		Long: `Retrieve the SSH key/cert of a Karbon cluster and write it to stdout or to the file given with --output-file.
+
+Formats:
+  openssh  OpenSSH private key, the cert is written in <file>-cert.pub
+  pem      PEM private key (PKCS#1 for RSA, SEC1 for ECDSA, PKCS#8 otherwise), the cert is written in <file>-cert.pub
+  ppk      PuTTY private key (version 2, RSA and ECDSA keys), the cert is written in <file>-cert.pub
+  json     JSON document with the OpenSSH private key, the cert, the username and the expiry time
+
+On stdout, the private key is followed by the cert. Use --passphrase to encrypt the private key,
+the passphrase is read from KARBON_SSH_PASSPHRASE or prompted.
+With --output json the result lists the files written, or holds the private key and the cert instead of stdout.`,
+		Args: cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+
+			p.viper.BindPFlag("server", cmd.Flags().Lookup("server"))
+			p.viper.BindPFlag("user", cmd.Flags().Lookup("user"))
+			p.viper.BindPFlag("port", cmd.Flags().Lookup("port"))
+			p.viper.BindPFlag("insecure", cmd.Flags().Lookup("insecure"))
+			p.viper.BindPFlag("keyring", cmd.Flags().Lookup("keyring"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			karbonCluster := args[0]
+			output, _ := cmd.Flags().GetString("output-file")
+			format, _ := cmd.Flags().GetString("format")
+			withPassphrase, _ := cmd.Flags().GetBool("passphrase")
+
+			if !isValidSSHKeyFormat(format) {
+				return fmt.Errorf("unsupported format %q, use %s", format, strings.Join(sshKeyFormats, ", "))
+			}
+
+			if format == "pem" && withPassphrase {
+				return fmt.Errorf("passphrase is not supported with pem format, legacy PEM encryption is insecure, use openssh or ppk")
+			}
+
+			var passphrase []byte
+			if withPassphrase {
+				var err error
+				passphrase, err = p.readPassphrase()
+				if err != nil {
+					return err
+				}
+			}
+
+			nutanixCluster, err := p.newNutanixCluster(cmd)
+			if err != nil {
+				return err
+			}
+
+			karbonSSH, err := nutanixCluster.getSSHConfig(karbonCluster)
+			if err != nil {
+				return err
+			}
+
+			privateKey, err := ssh.ParseRawPrivateKey([]byte(karbonSSH.PrivateKey))
+			if err != nil {
+				return err
+			}
+
+			comment := agentKeyComment(karbonCluster)
+
+			var key []byte
+			switch format {
+			case "openssh", "json":
+				key, err = marshalOpenSSHKey(privateKey, comment, passphrase)
+			case "pem":
+				key, err = marshalPEMKey(privateKey)
+			case "ppk":
+				key, err = marshalPPKKey(privateKey, comment, passphrase)
+			}
+			if err != nil {
+				return err
+			}
+
+			username := karbonSSH.Username
+			if username == "" {
+				username = defaultSSHUsername
+			}
+
+			result := sshKeyResult{Cluster: karbonCluster, Format: format, Username: username, ExpiryTime: karbonSSH.ExpiryTime}
+
+			data := key
+			certificate := []byte(karbonSSH.Certificate)
+			if format == "json" {
+				exported := *karbonSSH
+				exported.PrivateKey = string(key)
+				exported.Username = username
+
+				data, err = json.MarshalIndent(exported, "", "  ")
+				if err != nil {
+					return err
+				}
+				data = append(data, '\n')
+				certificate = nil
+			}
+
+			// the JSON result replaces stdout
+			if p.jsonOutputEnabled() && (output == "" || output == "-") {
+				result.PrivateKey = string(key)
+				result.Certificate = karbonSSH.Certificate
+				return p.printJSONOutput(commandOutput{Command: commandName(cmd), Success: true, Result: result})
+			}
+
+			files, err := p.writeSSHKeyOutput(p.IOStreams, output, data, certificate)
+			if err != nil {
+				return err
+			}
+
+			if p.jsonOutputEnabled() {
+				result.Files = files
+				return p.printJSONOutput(commandOutput{Command: commandName(cmd), Success: true, Result: result})
+			}
+			return nil
+		},
+	}
+
+	p.jsonOutputCommand(sshKeyGetCmd)
+
+	sshKeyGetCmd.Flags().String("output-file", "-", "File to write the private key to, - for stdout")
+	sshKeyGetCmd.Flags().String("format", "openssh", fmt.Sprintf("Output format (%s)", strings.Join(sshKeyFormats, ", ")))
+	sshKeyGetCmd.Flags().Bool("passphrase", false, "Encrypt the private key with a passphrase")
+
+	return sshKeyGetCmd
+}
+
+func isValidSSHKeyFormat(format string) bool {
+	for _, f := range sshKeyFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// readPassphrase returns the passphrase of KARBON_SSH_PASSPHRASE or prompts it twice
+func (p *plugin) readPassphrase() ([]byte, error) {
+	if passphrase, ok := os.LookupEnv("KARBON_SSH_PASSPHRASE"); ok {
+		if passphrase == "" {
+			return nil, fmt.Errorf("KARBON_SSH_PASSPHRASE is empty")
+		}
+		return []byte(passphrase), nil
+	}
+
+	passphrase, err := p.Prompter.PromptPassword("Enter passphrase:")
+	if err != nil {
+		return nil, err
+	}
+
+	confirm, err := p.Prompter.PromptPassword("Enter same passphrase again:")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	if passphrase != confirm {
+		return nil, fmt.Errorf("passphrases do not match")
+	}
+
+	return []byte(passphrase), nil
+}
+
+// writeSSHKeyOutput writes the key followed by the cert on stdout,
+// or the key in the output file and the cert next to it in a -cert.pub file, and returns the files written
+func (p *plugin) writeSSHKeyOutput(streams IOStreams, output string, key []byte, certificate []byte) ([]string, error) {
+	if output == "" || output == "-" {
+		_, err := streams.Out.Write(key)
+		if err != nil {
+			return nil, err
+		}
+		_, err = streams.Out.Write(certificate)
+		return nil, err
+	}
+
+	output, err := p.expandHome(output)
+	if err != nil {
+		return nil, err
+	}
+
+	err = afero.WriteFile(p.Fs, output, key, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if certificate == nil {
+		return []string{output}, nil
+	}
+
+	certificateFile := strings.TrimSuffix(output, filepath.Ext(output)) + "-cert.pub"
+	if filepath.Ext(output) != ".ppk" && filepath.Ext(output) != ".pem" {
+		certificateFile = output + "-cert.pub"
+	}
+
+	err = afero.WriteFile(p.Fs, certificateFile, certificate, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(streams.ErrOut, "SSH key written in %s and cert in %s\n", output, certificateFile)
+	return []string{output, certificateFile}, nil
+}
+
+// marshalOpenSSHKey encodes a private key in the OpenSSH format, encrypted when a passphrase is given
+func marshalOpenSSHKey(privateKey interface{}, comment string, passphrase []byte) ([]byte, error) {
+	var block *pem.Block
+	var err error
+
+	if len(passphrase) > 0 {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(privateKey, comment, passphrase)
+	} else {
+		block, err = ssh.MarshalPrivateKey(privateKey, comment)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(block), nil
+}
+
+// marshalPEMKey encodes a private key in the traditional PEM format of its type
+func marshalPEMKey(privateKey interface{}) ([]byte, error) {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	case *ed25519.PrivateKey:
+		return marshalPEMKey(*key)
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+}
+
+// marshalPPKKey encodes a RSA or ECDSA private key in the PuTTY version 2 format,
+// encrypted with aes256-cbc when a passphrase is given
+func marshalPPKKey(privateKey interface{}, comment string, passphrase []byte) ([]byte, error) {
+	var privateBlob []byte
+
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if len(key.Primes) != 2 {
+			return nil, fmt.Errorf("ppk format does not support multi-prime RSA keys")
+		}
+		key.Precompute()
+		privateBlob = ssh.Marshal(struct {
+			D    *big.Int
+			P    *big.Int
+			Q    *big.Int
+			Iqmp *big.Int
+		}{key.D, key.Primes[0], key.Primes[1], key.Precomputed.Qinv})
+	case *ecdsa.PrivateKey:
+		privateBlob = ssh.Marshal(struct {
+			D *big.Int
+		}{key.D})
+	default:
+		return nil, fmt.Errorf("ppk format does not support %T keys", privateKey)
+	}
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := signer.PublicKey()
+	publicBlob := publicKey.Marshal()
+
+	encryption := "none"
+	if len(passphrase) > 0 {
+		encryption = "aes256-cbc"
+
+		// the private blob is padded to the cipher block size
+		if padding := len(privateBlob) % aes.BlockSize; padding != 0 {
+			digest := sha1.Sum(privateBlob)
+			privateBlob = append(privateBlob, digest[:aes.BlockSize-padding]...)
+		}
+	}
+
+	macKey := sha1.Sum(append([]byte("putty-private-key-file-mac-key"), passphrase...))
+	mac := hmac.New(sha1.New, macKey[:])
+	mac.Write(ssh.Marshal(struct {
+		Algorithm  string
+		Encryption string
+		Comment    string
+		Public     []byte
+		Private    []byte
+	}{publicKey.Type(), encryption, comment, publicBlob, privateBlob}))
+
+	if len(passphrase) > 0 {
+		key0 := sha1.Sum(append([]byte{0, 0, 0, 0}, passphrase...))
+		key1 := sha1.Sum(append([]byte{0, 0, 0, 1}, passphrase...))
+		block, err := aes.NewCipher(append(key0[:], key1[:]...)[:32])
+		if err != nil {
+			return nil, err
+		}
+
+		encrypted := make([]byte, len(privateBlob))
+		cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(encrypted, privateBlob)
+		privateBlob = encrypted
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "PuTTY-User-Key-File-2: %s\n", publicKey.Type())
+	fmt.Fprintf(&buf, "Encryption: %s\n", encryption)
+	fmt.Fprintf(&buf, "Comment: %s\n", comment)
+	writePPKLines(&buf, "Public-Lines", publicBlob)
+	writePPKLines(&buf, "Private-Lines", privateBlob)
+	fmt.Fprintf(&buf, "Private-MAC: %s\n", hex.EncodeToString(mac.Sum(nil)))
+
+	return buf.Bytes(), nil
+}
+
+// writePPKLines writes a base64 blob in lines of 64 characters preceded by their count
+func writePPKLines(buf *bytes.Buffer, header string, blob []byte) {
+	encoded := base64.StdEncoding.EncodeToString(blob)
+
+	var lines []string
+	for len(encoded) > 64 {
+		lines = append(lines, encoded[:64])
+		encoded = encoded[64:]
+	}
+	lines = append(lines, encoded)
+
+	fmt.Fprintf(buf, "%s: %d\n", header, len(lines))
+	for _, line := range lines {
+		fmt.Fprintln(buf, line)
+	}
+}
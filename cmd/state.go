@@ -0,0 +1,266 @@
+/*
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// clusterState records what a successful login did for a karbon cluster,
+// so that other commands (daemon, logout, ...) know how to refresh or clean it.
+type clusterState struct {
+	Name             string    `json:"name"`
+	UUID             string    `json:"uuid,omitempty"`
+	Server           string    `json:"server"`
+	Port             int       `json:"port"`
+	User             string    `json:"user"`
+	Insecure         bool      `json:"insecure"`
+	ProxyURL         string    `json:"proxy_url,omitempty"`
+	SSHJump          string    `json:"ssh_jump,omitempty"`
+	SSHJumpKey       string    `json:"ssh_jump_key,omitempty"`
+	Profile          string    `json:"profile,omitempty"`
+	Kubeconfig       string    `json:"kubeconfig"`
+	ContextName      string    `json:"context_name,omitempty"`
+	ContextTemplate  string    `json:"context_template,omitempty"`
+	Namespace        string    `json:"namespace,omitempty"`
+	KubeconfigProxy  bool      `json:"kubeconfig_proxy,omitempty"`
+	Merge            bool      `json:"merge"`
+	SSHFile          bool      `json:"ssh_file"`
+	SSHFiles         []string  `json:"ssh_files,omitempty"`
+	SSHAgent         bool      `json:"ssh_agent"`
+	SSHAgentConfirm  bool      `json:"ssh_agent_confirm,omitempty"`
+	SSHUsername      string    `json:"ssh_username,omitempty"`
+	KubeconfigExpiry time.Time `json:"kubeconfig_expiry,omitempty"`
+	SSHExpiry        time.Time `json:"ssh_expiry,omitempty"`
+	UpdateTime       time.Time `json:"update_time"`
+}
+
+// karbonState holds the clusters logged in, keyed by stateKey as clusters of two Prism Centrals may have the same name
+type karbonState struct {
+	Clusters map[string]*clusterState `json:"clusters"`
+}
+
+const (
+	// stateLockWait is how long a command waits for the state file lock taken by another one
+	stateLockWait  = 5 * time.Second
+	stateLockRetry = 50 * time.Millisecond
+	// stateLockStale is the age of a lock file left by a killed command, removed by the next one
+	stateLockStale = 30 * time.Second
+)
+
+// stateKey is the key of a cluster in the state, its Prism Central and its name
+func stateKey(server string, cluster string) string {
+	return server + "/" + cluster
+}
+
+func (p *plugin) stateFilePath() (string, error) {
+	if path := p.viper.GetString("state-file"); path != "" {
+		return p.expandHome(path)
+	}
+
+	userHomeDir, err := p.homeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(userHomeDir, ".kube", "kubectl-karbon-state.json"), nil
+}
+
+// loadState reads the state file, a missing file returns an empty state
+func (p *plugin) loadState() (*karbonState, error) {
+	state := &karbonState{Clusters: map[string]*clusterState{}}
+
+	path, err := p.stateFilePath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := afero.ReadFile(p.Fs, path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+
+	// state files written before the server was in the key are keyed by cluster name
+	clusters := map[string]*clusterState{}
+	for key, entry := range state.Clusters {
+		if entry.Name == "" {
+			entry.Name = key
+		}
+		clusters[stateKey(entry.Server, entry.Name)] = entry
+	}
+	state.Clusters = clusters
+
+	return state, nil
+}
+
+// saveState writes the state file
+func (p *plugin) saveState(s *karbonState) error {
+	path, err := p.stateFilePath()
+	if err != nil {
+		return err
+	}
+
+	err = p.Fs.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return afero.WriteFile(p.Fs, path, data, 0600)
+}
+
+// lockState creates the lock file of the state file, waiting for the command holding it, and returns its removal
+func (p *plugin) lockState() (func(), error) {
+	path, err := p.stateFilePath()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.Fs.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	lockFile := path + ".lock"
+
+	for waited := time.Duration(0); ; waited += stateLockRetry {
+		file, err := p.Fs.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			file.Close()
+			return func() { p.Fs.Remove(lockFile) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to lock state file %s: %w", path, err)
+		}
+
+		if info, err := p.Fs.Stat(lockFile); err == nil && p.Clock.Now().Sub(info.ModTime()) > stateLockStale {
+			p.logger.Warn("removing stale state file lock", "lock", lockFile, "time", info.ModTime())
+			p.Fs.Remove(lockFile)
+			continue
+		}
+
+		if waited >= stateLockWait {
+			return nil, fmt.Errorf("state file %s is locked by another kubectl-karbon, remove %s if none is running", path, lockFile)
+		}
+		time.Sleep(stateLockRetry)
+	}
+}
+
+// changeState applies fn to the state file read under its lock and saves it, unless fn fails
+func (p *plugin) changeState(fn func(*karbonState) error) error {
+	unlock, err := p.lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := p.loadState()
+	if err != nil {
+		return err
+	}
+
+	err = fn(state)
+	if err != nil {
+		return err
+	}
+
+	return p.saveState(state)
+}
+
+// keys returns the keys of the state in a stable order
+func (s *karbonState) keys() []string {
+	keys := make([]string, 0, len(s.Clusters))
+	for key := range s.Clusters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// lookup returns the entry of cluster logged in from server, nil when the cluster is not tracked.
+// Without server, the cluster must be tracked for a single Prism Central.
+func (s *karbonState) lookup(server string, cluster string) (*clusterState, error) {
+	if server != "" {
+		return s.Clusters[stateKey(server, cluster)], nil
+	}
+
+	var found *clusterState
+	for _, key := range s.keys() {
+		entry := s.Clusters[key]
+		if entry.Name != cluster {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("cluster %s logged in from %s and %s, set the server", cluster, found.Server, entry.Server)
+		}
+		found = entry
+	}
+
+	return found, nil
+}
+
+// lookupState returns the state entry of cluster logged in from server, see lookup
+func (p *plugin) lookupState(server string, cluster string) (*clusterState, error) {
+	state, err := p.loadState()
+	if err != nil {
+		return nil, err
+	}
+
+	return state.lookup(server, cluster)
+}
+
+// updateState applies fn to the state entry of cluster logged in from server (created if needed) and saves the state file
+func (p *plugin) updateState(server string, cluster string, fn func(*clusterState)) error {
+	return p.changeState(func(state *karbonState) error {
+		key := stateKey(server, cluster)
+
+		entry, ok := state.Clusters[key]
+		if !ok {
+			entry = &clusterState{Name: cluster, Server: server}
+			state.Clusters[key] = entry
+		}
+		fn(entry)
+
+		return nil
+	})
+}
+
+// removeState forgets a cluster logged in from server from the state file
+func (p *plugin) removeState(server string, cluster string) error {
+	return p.changeState(func(state *karbonState) error {
+		delete(state.Clusters, stateKey(server, cluster))
+		return nil
+	})
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestStateKeyedByServer(t *testing.T) {
+	o, _, _ := testOptions(t)
+	p := newPlugin(o)
+
+	for _, server := range []string{"pc1", "pc2"} {
+		err := p.updateState(server, "a", func(s *clusterState) {
+			s.Kubeconfig = "/home/test/.kube/" + server
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, server := range []string{"pc1", "pc2"} {
+		entry, err := p.lookupState(server, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil || entry.Server != server || entry.Kubeconfig != "/home/test/.kube/"+server {
+			t.Errorf("state of a on %s = %+v", server, entry)
+		}
+	}
+
+	// without server the cluster is ambiguous
+	if _, err := p.lookupState("", "a"); err == nil {
+		t.Error("lookup of a without server succeeded")
+	}
+
+	err := p.removeState("pc1", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := p.lookupState("", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil || entry.Server != "pc2" {
+		t.Errorf("state of a = %+v, want the login on pc2", entry)
+	}
+}
+
+func TestLoadStateKeyedByName(t *testing.T) {
+	o, _, _ := testOptions(t)
+	p := newPlugin(o)
+
+	err := afero.WriteFile(o.Fs, "/home/test/.kube/kubectl-karbon-state.json", []byte(`{"clusters": {"a": {"name": "a", "server": "pc"}}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := p.lookupState("pc", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil {
+		t.Error("state keyed by cluster name not found by server and name")
+	}
+}
+
+func TestChangeStateWaitsForLock(t *testing.T) {
+	o, _, _ := testOptions(t)
+	p := newPlugin(o)
+
+	unlock, err := p.lockState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- p.updateState("pc", "a", func(s *clusterState) {})
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("state changed while locked, error = %v", err)
+	case <-time.After(10 * stateLockRetry):
+	}
+
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, _ := afero.Exists(o.Fs, "/home/test/.kube/kubectl-karbon-state.json.lock"); exists {
+		t.Error("lock file not removed")
+	}
+}
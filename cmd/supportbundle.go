@@ -0,0 +1,745 @@
+/*
+Package cmd support-bundle collect logs and configuration of karbon nodes
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nutanix/kubectl-karbon/version"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"sigs.k8s.io/yaml"
+)
+
+// defaultSupportCollection is the builtin collection, print it with --show-collection to customize it
+const defaultSupportCollection = `commands:
+- name: kubelet.log
+  command: journalctl --no-pager --since "-24h" -u "kubelet*"
+- name: containerd.log
+  command: journalctl --no-pager --since "-24h" -u containerd -u docker
+- name: etcd.log
+  command: journalctl --no-pager --since "-24h" -u etcd
+  pools: [etcd]
+- name: df.txt
+  command: df -h
+- name: free.txt
+  command: free -m
+files:
+- path: /var/log/messages
+- path: /etc/kubernetes
+  redact: true
+`
+
+// supportCollection defines what is collected on every node
+type supportCollection struct {
+	Commands []supportCommand `json:"commands"`
+	Files    []supportFiles   `json:"files"`
+}
+
+// supportCommand is a command run with sudo, its output is stored in nodes/<node>/<name>
+type supportCommand struct {
+	Name    string   `json:"name"`
+	Command string   `json:"command"`
+	Pools   []string `json:"pools,omitempty"`
+}
+
+// supportFiles is a file or directory copied with sudo in nodes/<node>/files/<path>
+type supportFiles struct {
+	Path   string   `json:"path"`
+	Redact bool     `json:"redact,omitempty"`
+	Pools  []string `json:"pools,omitempty"`
+}
+
+// supportManifest describes the content of a bundle, stored in manifest.json
+type supportManifest struct {
+	Cluster    string              `json:"cluster"`
+	Server     string              `json:"server"`
+	Created    time.Time           `json:"created"`
+	Version    string              `json:"version"`
+	Collection string              `json:"collection"`
+	Entries    []supportEntryState `json:"entries"`
+}
+
+type supportEntryState struct {
+	Node     string `json:"node,omitempty"`
+	Name     string `json:"name"`
+	Path     string `json:"path,omitempty"`
+	Size     int64  `json:"size"`
+	ExitCode int    `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// supportBundleResult is the JSON result of support-bundle
+type supportBundleResult struct {
+	File     string          `json:"file"`
+	Manifest supportManifest `json:"manifest"`
+}
+
+// supportBundle writes the entries of a tar.gz bundle from concurrent node collections
+type supportBundle struct {
+	mu       sync.Mutex
+	fs       afero.Fs
+	tw       *tar.Writer
+	root     string
+	created  time.Time
+	manifest supportManifest
+}
+
+// newSupportBundleCmd returns the support-bundle command
+func newSupportBundleCmd(p *plugin) *cobra.Command {
+	supportBundleCmd := &cobra.Command{
+		Use:   "support-bundle <cluster>",
+		Short: "Collect logs and configuration of all the nodes of a k8s cluster",
+		Long: `Collect logs and configuration of all the nodes of a Karbon cluster over SSH, using the Karbon SSH certificate,
+and write them with the cluster object from the Karbon API in a single timestamped tar.gz with a manifest.
+
+By default the kubelet, containerd and etcd journals, /var/log/messages, /etc/kubernetes (with secrets redacted),
+df and free are collected. Use --collection to give a YAML collection file or the name of a collection defined
+in the "support-collections" section of the configuration file, and --show-collection to print the default one.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			show, _ := cmd.Flags().GetBool("show-collection")
+			if show {
+				return cobra.NoArgs(cmd, args)
+			}
+			return cobra.ExactArgs(1)(cmd, args)
+		},
+		PreRun: func(cmd *cobra.Command, args []string) {
+
+			p.viper.BindPFlag("server", cmd.Flags().Lookup("server"))
+			p.viper.BindPFlag("user", cmd.Flags().Lookup("user"))
+			p.viper.BindPFlag("port", cmd.Flags().Lookup("port"))
+			p.viper.BindPFlag("insecure", cmd.Flags().Lookup("insecure"))
+			p.viper.BindPFlag("keyring", cmd.Flags().Lookup("keyring"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			collectionArg, _ := cmd.Flags().GetString("collection")
+			show, _ := cmd.Flags().GetBool("show-collection")
+
+			collection, collectionName, err := p.loadSupportCollection(collectionArg)
+			if err != nil {
+				return err
+			}
+
+			if show && p.jsonOutputEnabled() {
+				return p.printJSONOutput(commandOutput{Command: commandName(cmd), Success: true, Result: collection})
+			}
+			if show {
+				data, err := yaml.Marshal(collection)
+				if err != nil {
+					return err
+				}
+				fmt.Fprint(p.out, string(data))
+				return nil
+			}
+
+			karbonCluster := args[0]
+			output, _ := cmd.Flags().GetString("output-file")
+			parallel, _ := cmd.Flags().GetInt("parallel")
+			pools, _ := cmd.Flags().GetStringSlice("pool")
+
+			if parallel < 1 {
+				return fmt.Errorf("parallel must be at least 1")
+			}
+
+			nutanixCluster, err := p.newNutanixCluster(cmd)
+			if err != nil {
+				return err
+			}
+
+			created := p.Clock.Now().UTC()
+			root := fmt.Sprintf("%s-support-bundle-%s", karbonCluster, created.Format("20060102T150405Z"))
+			if output == "" {
+				output = root + ".tar.gz"
+			}
+
+			clusterJSON, err := nutanixCluster.getClusterObject(karbonCluster)
+			if err != nil {
+				return err
+			}
+
+			nodes, err := nutanixCluster.listKarbonNodes(karbonCluster)
+			if err != nil {
+				return err
+			}
+
+			nodes = filterNodes(nodes, pools)
+			if len(nodes) == 0 {
+				return fmt.Errorf("no node found in cluster %s", karbonCluster)
+			}
+
+			config, err := nutanixCluster.clusterSSHClientConfig(karbonCluster)
+			if err != nil {
+				return err
+			}
+
+			file, err := p.Fs.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			gz := gzip.NewWriter(file)
+			bundle := &supportBundle{
+				fs:      p.Fs,
+				tw:      tar.NewWriter(gz),
+				root:    root,
+				created: created,
+				manifest: supportManifest{
+					Cluster:    karbonCluster,
+					Server:     nutanixCluster.server,
+					Created:    created,
+					Version:    version.Version,
+					Collection: collectionName,
+				},
+			}
+
+			writeBundle := func() error {
+				err := bundle.add("", "cluster.json", "", clusterJSON, 0)
+				if err != nil {
+					return err
+				}
+
+				nodesJSON, err := json.MarshalIndent(nodes, "", "  ")
+				if err != nil {
+					return err
+				}
+				err = bundle.add("", "nodes.json", "", nodesJSON, 0)
+				if err != nil {
+					return err
+				}
+
+				route := nutanixCluster.nodeRoute(karbonCluster)
+				forEachParallel(nodes, parallel, func(i int, node karbonNode) {
+					err := p.collectNode(bundle, route, node, config, collection)
+					if err != nil {
+						bundle.record(supportEntryState{Node: node.Hostname, Name: "connection", Error: err.Error()})
+						fmt.Fprintf(p.ErrOut, "%s: %s\n", node.Hostname, err)
+					}
+				})
+
+				manifestJSON, err := json.MarshalIndent(bundle.manifest, "", "  ")
+				if err != nil {
+					return err
+				}
+				err = bundle.add("", "manifest.json", "", manifestJSON, 0)
+				if err != nil {
+					return err
+				}
+
+				err = bundle.tw.Close()
+				if err != nil {
+					return err
+				}
+				err = gz.Close()
+				if err != nil {
+					return err
+				}
+				return file.Close()
+			}
+
+			err = writeBundle()
+			if err != nil {
+				// no partial bundle is left behind
+				file.Close()
+				p.Fs.Remove(output)
+			}
+			if err != nil {
+				return err
+			}
+
+			failed := 0
+			for _, entry := range bundle.manifest.Entries {
+				if entry.Error != "" {
+					failed++
+				}
+			}
+
+			fmt.Fprintf(p.out, "Support bundle %s successfully written\n", output)
+
+			var warnings []string
+			if failed > 0 {
+				warning := fmt.Sprintf("%d item(s) could not be collected, see manifest.json", failed)
+				warnings = append(warnings, warning)
+				fmt.Fprintln(p.ErrOut, warning)
+			}
+
+			if p.jsonOutputEnabled() {
+				return p.printJSONOutput(commandOutput{
+					Command:  commandName(cmd),
+					Success:  true,
+					Result:   supportBundleResult{File: output, Manifest: bundle.manifest},
+					Warnings: warnings,
+				})
+			}
+			return nil
+		},
+	}
+
+	p.jsonOutputCommand(supportBundleCmd)
+
+	user, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+
+	supportBundleCmd.Flags().String("server", "", "Address of the PC to authenticate against")
+
+	supportBundleCmd.Flags().StringP("user", "u", user.Username, "Username to authenticate")
+
+	supportBundleCmd.Flags().Int("port", 9440, "Port to run Application server on")
+
+	supportBundleCmd.Flags().BoolP("insecure", "k", false, "Skip certificate verification (this is insecure)")
+
+	supportBundleCmd.Flags().Bool("keyring", false, "Use keyring to store and retrieve credential")
+
+	supportBundleCmd.Flags().String("output-file", "", "Bundle file (default <cluster>-support-bundle-<timestamp>.tar.gz)")
+	supportBundleCmd.Flags().String("collection", "", "YAML collection file or name of a collection of the configuration file")
+	supportBundleCmd.Flags().Bool("show-collection", false, "Print the collection in YAML and exit")
+	supportBundleCmd.Flags().StringSlice("pool", nil, "Only collect on the nodes of these node pool(s), by name or category (master, worker, etcd)")
+	supportBundleCmd.Flags().Int("parallel", 5, "Maximum number of nodes collected at the same time")
+
+	return supportBundleCmd
+}
+
+// loadSupportCollection returns the builtin collection, a collection file or a named collection of the configuration file
+func (p *plugin) loadSupportCollection(name string) (*supportCollection, string, error) {
+	var data []byte
+
+	switch {
+	case name == "" || name == "default":
+		name = "default"
+		data = []byte(defaultSupportCollection)
+	case p.viper.IsSet("support-collections." + strings.ToLower(name)):
+		var err error
+		data, err = yaml.Marshal(p.viper.Get("support-collections." + strings.ToLower(name)))
+		if err != nil {
+			return nil, "", err
+		}
+	default:
+		file, err := p.expandHome(name)
+		if err != nil {
+			return nil, "", err
+		}
+		data, err = afero.ReadFile(p.Fs, file)
+		if err != nil {
+			return nil, "", fmt.Errorf("collection %s is neither a file nor defined in the configuration file: %w", name, err)
+		}
+	}
+
+	collection := &supportCollection{}
+	err := yaml.UnmarshalStrict(data, collection)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid collection %s: %w", name, err)
+	}
+
+	for _, command := range collection.Commands {
+		if command.Name == "" || command.Command == "" || strings.Contains(command.Name, "/") {
+			return nil, "", fmt.Errorf("invalid collection %s: commands need a name without / and a command", name)
+		}
+	}
+	for _, files := range collection.Files {
+		if !path.IsAbs(files.Path) {
+			return nil, "", fmt.Errorf("invalid collection %s: file path %q must be absolute", name, files.Path)
+		}
+	}
+
+	return collection, name, nil
+}
+
+// getClusterObject returns the cluster object of the Karbon API, indented
+func (nutanix *nutanixCluster) getClusterObject(cluster string) ([]byte, error) {
+	karbonClusterPath := fmt.Sprintf("/karbon/v1-beta.1/k8s/clusters/%s", cluster)
+	method := "GET"
+
+	nutanix.logger.Info("retrieve cluster object", "cluster", cluster)
+
+	responseJSON, err := nutanix.clusterRequest(method, karbonClusterPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	err = json.Indent(&out, responseJSON, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// add writes a file entry in the bundle, under nodes/<node>/ when node is set, and records it in the manifest
+func (b *supportBundle) add(node string, name string, source string, data []byte, exitCode int) error {
+	return b.addReader(node, name, source, bytes.NewReader(data), int64(len(data)), exitCode)
+}
+
+// addSpool writes a file entry in the bundle from the content of a spool file
+func (b *supportBundle) addSpool(node string, name string, source string, spool afero.File, exitCode int) error {
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return b.addReader(node, name, source, spool, size, exitCode)
+}
+
+func (b *supportBundle) addReader(node string, name string, source string, r io.Reader, size int64, exitCode int) error {
+	entryPath := path.Join(b.root, name)
+	if node != "" {
+		entryPath = path.Join(b.root, "nodes", node, name)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err := b.tw.WriteHeader(&tar.Header{
+		Name:    entryPath,
+		Mode:    0600,
+		Size:    size,
+		ModTime: b.created,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(b.tw, r)
+	if err != nil {
+		return err
+	}
+
+	if name != "manifest.json" {
+		b.manifest.Entries = append(b.manifest.Entries, supportEntryState{
+			Node:     node,
+			Name:     name,
+			Path:     source,
+			Size:     size,
+			ExitCode: exitCode,
+		})
+	}
+
+	return nil
+}
+
+// newSpool returns a temporary file holding a command output or a file of a node until it is added to the bundle,
+// the tar header needs the size and the content is not kept in memory, cleanup closes and removes it
+func (b *supportBundle) newSpool() (afero.File, func(), error) {
+	spool, err := afero.TempFile(b.fs, "", "kubectl-karbon-support-*")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return spool, func() {
+		spool.Close()
+		b.fs.Remove(spool.Name())
+	}, nil
+}
+
+// record adds an entry to the manifest without content, typically for an error
+func (b *supportBundle) record(entry supportEntryState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.manifest.Entries = append(b.manifest.Entries, entry)
+}
+
+// collectNode runs the collection on a node, failures of a single item are recorded in the manifest
+func (p *plugin) collectNode(bundle *supportBundle, route prismRoute, node karbonNode, config *ssh.ClientConfig, collection *supportCollection) error {
+	client, err := p.dialNode(route, node, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for _, command := range collection.Commands {
+		if !nodeInPools(node, command.Pools) {
+			continue
+		}
+
+		p.logger.Info("collect command output", "command", command.Name, "node", node.Hostname)
+
+		err := collectCommand(bundle, client, node, command)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, files := range collection.Files {
+		if !nodeInPools(node, files.Pools) {
+			continue
+		}
+
+		p.logger.Info("collect files", "path", files.Path, "node", node.Hostname)
+
+		err := collectFiles(bundle, client, node, files)
+		if err != nil {
+			bundle.record(supportEntryState{Node: node.Hostname, Name: "files", Path: files.Path, Error: err.Error()})
+		}
+	}
+
+	return nil
+}
+
+// collectCommand runs a command of the collection and adds its output to the bundle,
+// only a failure to write the bundle is returned
+func collectCommand(bundle *supportBundle, client *ssh.Client, node karbonNode, command supportCommand) error {
+	spool, cleanup, err := bundle.newSpool()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	stderr, exitCode, err := runCommandOutput(client, "sudo -n sh -c "+shellQuote(command.Command), spool)
+	if err != nil {
+		bundle.record(supportEntryState{Node: node.Hostname, Name: command.Name, Error: err.Error()})
+		return nil
+	}
+
+	err = bundle.addSpool(node.Hostname, command.Name, "", spool, exitCode)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		bundle.record(supportEntryState{Node: node.Hostname, Name: command.Name, ExitCode: exitCode, Error: strings.TrimSpace(string(stderr))})
+	}
+
+	return nil
+}
+
+// collectFiles streams a remote tar of a file or directory and adds its regular files to the bundle
+func collectFiles(bundle *supportBundle, client *ssh.Client, node karbonNode, files supportFiles) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = session.Start("sudo -n tar -C / -cf - " + shellQuote(strings.TrimPrefix(path.Clean(files.Path), "/")))
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(stdout)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		err = collectFile(bundle, node, header.Name, tr, files.Redact)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = session.Wait()
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("tar exited with code %d: %s", exitErr.ExitStatus(), strings.TrimSpace(stderr.String()))
+	}
+
+	return err
+}
+
+// collectFile adds a file of a node read from r to the bundle, redacting its secrets line by line when redact is set
+func collectFile(bundle *supportBundle, node karbonNode, name string, r io.Reader, redact bool) error {
+	spool, cleanup, err := bundle.newSpool()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	var w io.Writer = spool
+	var redactor *redactWriter
+	if redact {
+		redactor = &redactWriter{w: spool}
+		w = redactor
+	}
+
+	_, err = io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	if redactor != nil {
+		err = redactor.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return bundle.addSpool(node.Hostname, path.Join("files", name), "/"+name, spool, 0)
+}
+
+// runCommandOutput runs a command writing its output to stdout and returns its error output and exit code
+func runCommandOutput(client *ssh.Client, command string, stdout io.Writer) ([]byte, int, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, -1, err
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stdout = stdout
+	session.Stderr = &stderr
+
+	err = session.Run(command)
+
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return stderr.Bytes(), exitErr.ExitStatus(), nil
+	}
+	if err != nil {
+		return nil, -1, err
+	}
+
+	return stderr.Bytes(), 0, nil
+}
+
+// nodeInPools reports if a node belongs to one of the pools, by name or category, an empty list matches all nodes
+func nodeInPools(node karbonNode, pools []string) bool {
+	return len(filterNodes([]karbonNode{node}, pools)) == 1
+}
+
+// shellQuote quotes a string for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+var (
+	privateKeyPattern      = regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`)
+	privateKeyBeginPattern = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)
+	privateKeyEndPattern   = regexp.MustCompile(`-----END [A-Z ]*PRIVATE KEY-----`)
+	secretKeyPattern       = regexp.MustCompile(`(?im)^(\s*-?\s*"?[\w.-]*(password|passwd|token|secret|private[-_]?key|client-key-data)[\w.-]*"?\s*:\s*).+$`)
+	secretFlagPattern      = regexp.MustCompile(`(?i)--[\w-]*(password|token|secret)[\w-]*=[^\s"']+`)
+)
+
+// redactSecrets replaces private keys, tokens, passwords and secrets of configuration files by REDACTED
+func redactSecrets(data []byte) []byte {
+	data = privateKeyPattern.ReplaceAll(data, []byte("REDACTED"))
+	data = secretKeyPattern.ReplaceAll(data, []byte("${1}REDACTED"))
+	return secretFlagPattern.ReplaceAllFunc(data, func(flag []byte) []byte {
+		name := flag[:bytes.IndexByte(flag, '=')]
+		// paths of secret files are kept, they help support
+		if bytes.HasSuffix(name, []byte("-file")) || bytes.HasSuffix(name, []byte("-dir")) {
+			return flag
+		}
+		return []byte(string(name) + "=REDACTED")
+	})
+}
+
+// maxRedactLine is the longest line buffered by a redactWriter, longer lines are redacted in chunks
+const maxRedactLine = 64 * 1024
+
+// redactWriter redacts like redactSecrets the text written to it, line by line, without holding a whole file in memory,
+// Close writes the last line
+type redactWriter struct {
+	w     io.Writer
+	line  []byte
+	inKey bool
+}
+
+func (r *redactWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			r.line = append(r.line, p...)
+			if len(r.line) < maxRedactLine {
+				return n, nil
+			}
+			return n, r.flush()
+		}
+
+		r.line = append(r.line, p[:i+1]...)
+		p = p[i+1:]
+
+		err := r.flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
+
+// Close writes the buffered end of the text, the end of an unterminated private key is dropped
+func (r *redactWriter) Close() error {
+	return r.flush()
+}
+
+// flush writes the buffered line, private keys spanning lines are replaced by a single REDACTED
+func (r *redactWriter) flush() error {
+	line := r.line
+	r.line = r.line[:0]
+
+	var out []byte
+	for len(line) > 0 {
+		if r.inKey {
+			end := privateKeyEndPattern.FindIndex(line)
+			if end == nil {
+				break
+			}
+			r.inKey = false
+			line = line[end[1]:]
+			continue
+		}
+
+		begin := privateKeyBeginPattern.FindIndex(line)
+		if begin == nil {
+			out = append(out, redactSecrets(line)...)
+			break
+		}
+		out = append(out, redactSecrets(line[:begin[0]])...)
+		out = append(out, "REDACTED"...)
+		r.inKey = true
+		line = line[begin[1]:]
+	}
+
+	_, err := r.w.Write(out)
+	return err
+}
@@ -0,0 +1,266 @@
+/*
+Package cmd tunnel forward a local port to the Kubernetes API through a node of the karbon cluster
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"os/user"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// newTunnelCmd returns the tunnel command
+func newTunnelCmd(p *plugin) *cobra.Command {
+	tunnelCmd := &cobra.Command{
+		Use:   "tunnel <cluster> [node]",
+		Short: "Forward a local port to the Kubernetes API through a node of a k8s cluster",
+		Long: `Open an SSH connection to a master node of a Karbon cluster using the Karbon SSH certificate and forward
+a local port to the Kubernetes API, for clusters whose API address is not routable but whose nodes are reachable.
+
+A kubeconfig pointing to https://127.0.0.1:<port>, with the TLS server name of the Kubernetes API, is written
+in a temporary file removed when the tunnel stops. The tunnel stays in the foreground until interrupted.`,
+		Example: `  kubectl karbon tunnel mycluster
+  KUBECONFIG=/tmp/kubectl-karbon-tunnel-123.yaml kubectl get nodes`,
+		Args: cobra.RangeArgs(1, 2),
+		PreRun: func(cmd *cobra.Command, args []string) {
+
+			p.viper.BindPFlag("server", cmd.Flags().Lookup("server"))
+			p.viper.BindPFlag("user", cmd.Flags().Lookup("user"))
+			p.viper.BindPFlag("port", cmd.Flags().Lookup("port"))
+			p.viper.BindPFlag("insecure", cmd.Flags().Lookup("insecure"))
+			p.viper.BindPFlag("keyring", cmd.Flags().Lookup("keyring"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			karbonCluster := args[0]
+			localPort, _ := cmd.Flags().GetInt("local-port")
+			remoteAddress, _ := cmd.Flags().GetString("remote-address")
+			kubeconfigFile, _ := cmd.Flags().GetString("write-kubeconfig")
+
+			nutanixCluster, err := p.newNutanixCluster(cmd)
+			if err != nil {
+				return err
+			}
+
+			kubeconfigResponse, err := nutanixCluster.getKubeconfig(karbonCluster)
+			if err != nil {
+				return err
+			}
+
+			nodes, err := nutanixCluster.listKarbonNodes(karbonCluster)
+			if err != nil {
+				return err
+			}
+
+			var node karbonNode
+			if len(args) == 2 {
+				node, err = findNode(nodes, args[1])
+			} else {
+				node, err = masterNode(nodes)
+			}
+			if err != nil {
+				return err
+			}
+
+			config, err := nutanixCluster.clusterSSHClientConfig(karbonCluster)
+			if err != nil {
+				return err
+			}
+
+			client, err := p.dialNode(nutanixCluster.nodeRoute(karbonCluster), node, config)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+
+			listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+			if err != nil {
+				return err
+			}
+			defer listener.Close()
+
+			data, apiAddress, err := tunnelKubeconfig(kubeconfigResponse, listener.Addr().String())
+			if err != nil {
+				return err
+			}
+			if remoteAddress == "" {
+				remoteAddress = apiAddress
+			}
+
+			if kubeconfigFile == "" {
+				file, err := afero.TempFile(p.Fs, "", "kubectl-karbon-tunnel-*.yaml")
+				if err != nil {
+					return err
+				}
+				file.Close()
+				kubeconfigFile = file.Name()
+				defer p.Fs.Remove(kubeconfigFile)
+			}
+			err = afero.WriteFile(p.Fs, kubeconfigFile, data, 0600)
+			if err != nil {
+				return err
+			}
+
+			go p.forwardTunnel(listener, client.Dial, remoteAddress)
+
+			fmt.Fprintf(p.out, "Forwarding %s to the Kubernetes API %s of %s cluster through node %s\n", listener.Addr(), remoteAddress, karbonCluster, node.Hostname)
+			fmt.Fprintf(p.out, "Use it with: export KUBECONFIG=%s\n", kubeconfigFile)
+			fmt.Fprintln(p.out, "Press Ctrl+C to stop the tunnel")
+
+			closed := make(chan error, 1)
+			go func() {
+				closed <- client.Wait()
+			}()
+
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+			select {
+			case <-signals:
+				p.logger.Info("tunnel stopped", "cluster", karbonCluster)
+			case err := <-closed:
+				p.logger.Warn("SSH connection to the node closed", "node", node.Hostname, "error", err)
+			}
+			return nil
+		},
+	}
+
+	user, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+
+	tunnelCmd.Flags().String("server", "", "Address of the PC to authenticate against")
+
+	tunnelCmd.Flags().StringP("user", "u", user.Username, "Username to authenticate")
+
+	tunnelCmd.Flags().Int("port", 9440, "Port to run Application server on")
+
+	tunnelCmd.Flags().BoolP("insecure", "k", false, "Skip certificate verification (this is insecure)")
+
+	tunnelCmd.Flags().Bool("keyring", false, "Use keyring to store and retrieve credential")
+
+	tunnelCmd.Flags().Int("local-port", 0, "Local port to listen on (default a free port)")
+	tunnelCmd.Flags().String("remote-address", "", "Address of the Kubernetes API reached from the node, like 127.0.0.1:6443 (default the server of the kubeconfig)")
+	tunnelCmd.Flags().String("write-kubeconfig", "", "File to write the kubeconfig of the tunnel to (default a temporary file removed when the tunnel stops)")
+
+	return tunnelCmd
+}
+
+// masterNode returns the first master node of a cluster
+func masterNode(nodes []karbonNode) (karbonNode, error) {
+	for _, node := range nodes {
+		if node.Category == "master" {
+			return node, nil
+		}
+	}
+	return karbonNode{}, fmt.Errorf("no master node found")
+}
+
+// tunnelKubeconfig rewrites the server of the current context of a karbon kubeconfig to the local address of the tunnel,
+// the TLS server name stays the one of the Kubernetes API, it returns the kubeconfig and the host:port of the Kubernetes API
+func tunnelKubeconfig(kubeconfigResponse *kubeConfig, localAddress string) ([]byte, string, error) {
+	config, err := clientcmd.Load([]byte(kubeconfigResponse.KubeConfig))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+
+	context, ok := config.Contexts[config.CurrentContext]
+	if !ok {
+		return nil, "", fmt.Errorf("context %s not found in kubeconfig", config.CurrentContext)
+	}
+	cluster, ok := config.Clusters[context.Cluster]
+	if !ok {
+		return nil, "", fmt.Errorf("cluster %s not found in kubeconfig", context.Cluster)
+	}
+
+	server, err := url.Parse(cluster.Server)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid server %s in kubeconfig: %w", cluster.Server, err)
+	}
+	apiAddress := server.Host
+	if server.Port() == "" {
+		apiAddress = net.JoinHostPort(server.Hostname(), "443")
+	}
+
+	if cluster.TLSServerName == "" {
+		cluster.TLSServerName = server.Hostname()
+	}
+	cluster.Server = "https://" + localAddress
+	// the tunnel is local, a proxy would not reach it
+	cluster.ProxyURL = ""
+
+	data, err := clientcmd.Write(*config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, apiAddress, nil
+}
+
+// forwardTunnel forwards the connections accepted by the listener to the remote address, dialed by dial,
+// until the listener is closed
+func (p *plugin) forwardTunnel(listener net.Listener, dial func(network string, address string) (net.Conn, error), remoteAddress string) {
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer local.Close()
+
+			remote, err := dial("tcp", remoteAddress)
+			if err != nil {
+				p.logger.Warn("failed to reach the Kubernetes API", "address", remoteAddress, "error", err)
+				return
+			}
+			defer remote.Close()
+
+			p.logger.Debug("tunnel connection", "from", local.RemoteAddr(), "to", remoteAddress)
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				io.Copy(remote, local)
+				closeWrite(remote)
+			}()
+			io.Copy(local, remote)
+			closeWrite(local)
+			wg.Wait()
+		}()
+	}
+}
+
+// closeWrite signals the end of the data written to a connection, keeping the other direction open
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
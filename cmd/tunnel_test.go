@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func TestTunnelKubeconfig(t *testing.T) {
+	data, apiAddress, err := tunnelKubeconfig(testKubeconfig("a", testNow), "127.0.0.1:40000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if apiAddress != "10.0.0.1:443" {
+		t.Errorf("api address = %s, want 10.0.0.1:443", apiAddress)
+	}
+
+	config, err := clientcmd.Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster := config.Clusters["a"]
+	if cluster.Server != "https://127.0.0.1:40000" || cluster.TLSServerName != "10.0.0.1" {
+		t.Errorf("cluster entry = %+v", cluster)
+	}
+}
+
+func TestForwardTunnel(t *testing.T) {
+	// the remote side answers the data it receives in upper case
+	remote, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	go func() {
+		conn, err := remote.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		for i := range data {
+			data[i] -= 'a' - 'A'
+		}
+		conn.Write(data)
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	o, _, _ := testOptions(t)
+	go newPlugin(o).forwardTunnel(listener, net.Dial, remote.Addr().String())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte("karbon"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	answer, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(answer) != "KARBON" {
+		t.Errorf("answer = %q, want KARBON", answer)
+	}
+}
@@ -0,0 +1,845 @@
+/*
+Package cmd ui run an interactive dashboard of karbon clusters
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/spf13/cobra"
+)
+
+// uiSource is a Prism Central listed by the dashboard, the global settings or a profile of the config file
+type uiSource struct {
+	profile string
+	nutanix *nutanixCluster
+}
+
+// uiRow is a cluster line of the dashboard
+type uiRow struct {
+	source  *uiSource
+	cluster karbonCluster
+}
+
+// uiRefresh is the result of a cluster list refresh, posted to the event loop
+type uiRefresh struct {
+	rows   []uiRow
+	errors []string
+}
+
+// uiPager is a scrollable text view on top of the cluster list
+type uiPager struct {
+	title  string
+	lines  []string
+	offset int
+}
+
+type prismTask struct {
+	UUID               string `json:"uuid"`
+	OperationType      string `json:"operation_type"`
+	Status             string `json:"status"`
+	PercentageComplete int    `json:"percentage_complete"`
+	CreationTime       string `json:"creation_time"`
+	ProgressMessage    string `json:"progress_message"`
+	EntityReferences   []struct {
+		Kind string `json:"kind"`
+		Name string `json:"name"`
+	} `json:"entity_reference_list"`
+}
+
+type karbonDashboard struct {
+	*plugin
+
+	screen      tcell.Screen
+	sources     []*uiSource
+	rows        []uiRow
+	state       *karbonState
+	selected    int
+	offset      int
+	pager       *uiPager
+	confirm     string
+	confirmRow  uiRow
+	message     string
+	refreshing  bool
+	lastRefresh time.Time
+}
+
+// uiColumns are the columns of the cluster list
+var uiColumns = []string{"PROFILE", "NAME", "STATUS", "VERSION", "API ENDPOINT", "TYPE", "LOGGED IN"}
+
+// uiHelp is the key help of the cluster list
+const uiHelp = "enter:describe  l:login  o:logout  s:ssh  c:copy endpoint  t:tasks  r:refresh  q:quit"
+
+// newUICmd returns the ui command
+func newUICmd(p *plugin) *cobra.Command {
+	uiCmd := &cobra.Command{
+		Use:   "ui",
+		Short: "Interactive dashboard of the k8s clusters of all profiles",
+		Long: `Open an interactive terminal dashboard listing the Karbon clusters of the global settings and of all the profiles
+of the config file (only the selected one with --profile), refreshed periodically.
+
+Keys: enter/d describe, l login, o logout, s SSH to a node, c copy the API endpoint, t running Prism tasks,
+r refresh, q quit.`,
+		Args: cobra.NoArgs,
+		PreRun: func(cmd *cobra.Command, args []string) {
+
+			p.viper.BindPFlag("server", cmd.Flags().Lookup("server"))
+			p.viper.BindPFlag("user", cmd.Flags().Lookup("user"))
+			p.viper.BindPFlag("port", cmd.Flags().Lookup("port"))
+			p.viper.BindPFlag("insecure", cmd.Flags().Lookup("insecure"))
+			p.viper.BindPFlag("keyring", cmd.Flags().Lookup("keyring"))
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			interval, _ := cmd.Flags().GetDuration("refresh")
+			if interval < time.Second {
+				return fmt.Errorf("refresh must be at least 1s")
+			}
+
+			sources, err := p.uiSources()
+			if err != nil {
+				return err
+			}
+
+			// logs on stderr would garble the screen
+			if p.viper.GetString("log-file") == "" {
+				p.logger = slog.New(slog.DiscardHandler)
+			}
+
+			screen, err := tcell.NewScreen()
+			if err != nil {
+				return err
+			}
+			err = screen.Init()
+			if err != nil {
+				return err
+			}
+			defer screen.Fini()
+
+			d := &karbonDashboard{plugin: p, screen: screen, sources: sources}
+			d.run(interval)
+			return nil
+		},
+	}
+
+	user, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+
+	uiCmd.Flags().String("server", "", "Address of the PC to authenticate against")
+
+	uiCmd.Flags().StringP("user", "u", user.Username, "Username to authenticate")
+
+	uiCmd.Flags().Int("port", 9440, "Port to run Application server on")
+
+	uiCmd.Flags().BoolP("insecure", "k", false, "Skip certificate verification (this is insecure)")
+
+	uiCmd.Flags().Bool("keyring", false, "Use keyring to store and retrieve credential")
+
+	uiCmd.Flags().Duration("refresh", 30*time.Second, "Interval between two refreshes of the cluster list")
+
+	return uiCmd
+}
+
+// uiSources returns the Prism Central of the global settings and of every profile, prompting passwords if needed
+func (p *plugin) uiSources() ([]*uiSource, error) {
+	var sources []*uiSource
+
+	selected := p.viper.GetString("profile")
+	if p.viper.GetString("server") != "" {
+		source, err := p.newUISource(selected, nil)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+
+	if selected == "" {
+		profiles := p.viper.GetStringMap("profiles")
+		names := make([]string, 0, len(profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			settings, ok := profiles[name].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			source, err := p.newUISource(name, settings)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, source)
+		}
+	}
+
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("required flag \"server\" not set and no profile in config file")
+	}
+
+	return sources, nil
+}
+
+// newUISource builds the Prism Central connection of a profile, its settings override the global ones
+func (p *plugin) newUISource(profile string, settings map[string]interface{}) (*uiSource, error) {
+	setting := func(key string) interface{} {
+		if value, ok := settings[key]; ok {
+			return value
+		}
+		return p.viper.Get(key)
+	}
+
+	server := fmt.Sprint(setting("server"))
+	if server == "" || setting("server") == nil {
+		return nil, fmt.Errorf("no server set for profile %s", profile)
+	}
+
+	port, err := strconv.Atoi(fmt.Sprint(setting("port")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid port for profile %s: %w", profile, err)
+	}
+
+	insecure, _ := strconv.ParseBool(fmt.Sprint(setting("insecure")))
+	login := fmt.Sprint(setting("user"))
+
+	stringSetting := func(key string) string {
+		if value := setting(key); value != nil {
+			return fmt.Sprint(value)
+		}
+		return ""
+	}
+
+	if profile != "" {
+		fmt.Fprintf(p.ErrOut, "Profile %s (%s)\n", profile, server)
+	}
+
+	password, err := p.getCredentials(server, login)
+	if err != nil {
+		return nil, err
+	}
+
+	return &uiSource{
+		profile: profile,
+		nutanix: &nutanixCluster{
+			plugin:   p,
+			server:   server,
+			login:    login,
+			password: password,
+			port:     port,
+			timeout:  p.viper.GetInt("request-timeout"),
+			insecure: insecure,
+			route: prismRoute{
+				proxyURL:   stringSetting("proxy-url"),
+				sshJump:    stringSetting("ssh-jump"),
+				sshJumpKey: stringSetting("ssh-jump-key"),
+			},
+		},
+	}, nil
+}
+
+// getRunningTasks returns the running and queued tasks of Prism Central
+func (nutanix *nutanixCluster) getRunningTasks() ([]prismTask, error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"kind":   "task",
+		"length": 500,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	responseJSON, err := nutanix.clusterRequest("POST", "/api/nutanix/v3/tasks/list", payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Entities []prismTask `json:"entities"`
+	}
+
+	err = json.Unmarshal(responseJSON, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []prismTask
+	for _, task := range response.Entities {
+		if task.Status == "RUNNING" || task.Status == "QUEUED" {
+			tasks = append(tasks, task)
+		}
+	}
+
+	return tasks, nil
+}
+
+// run is the event loop of the dashboard
+func (d *karbonDashboard) run(interval time.Duration) {
+	d.reloadState()
+	d.refresh()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	go func() {
+		for range ticker.C {
+			d.screen.PostEvent(tcell.NewEventInterrupt(interval))
+		}
+	}()
+
+	for {
+		d.draw()
+
+		switch ev := d.screen.PollEvent().(type) {
+		case nil:
+			return
+		case *tcell.EventResize:
+			d.screen.Sync()
+		case *tcell.EventInterrupt:
+			switch data := ev.Data().(type) {
+			case uiRefresh:
+				d.applyRefresh(data)
+			case time.Duration:
+				d.refresh()
+			}
+		case *tcell.EventKey:
+			if !d.handleKey(ev) {
+				return
+			}
+		}
+	}
+}
+
+// refresh lists the clusters of all the sources in the background
+func (d *karbonDashboard) refresh() {
+	if d.refreshing {
+		return
+	}
+	d.refreshing = true
+
+	sources := d.sources
+	go func() {
+		results := make([][]karbonCluster, len(sources))
+		errs := make([]error, len(sources))
+
+		var wg sync.WaitGroup
+		for i, source := range sources {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i], errs[i] = source.nutanix.listKarbonClusters()
+			}()
+		}
+		wg.Wait()
+
+		var refresh uiRefresh
+		for i, source := range sources {
+			if errs[i] != nil {
+				refresh.errors = append(refresh.errors, fmt.Sprintf("%s: %s", sourceName(source), errs[i]))
+				continue
+			}
+			sort.Slice(results[i], func(a, b int) bool { return results[i][a].Name < results[i][b].Name })
+			for _, cluster := range results[i] {
+				refresh.rows = append(refresh.rows, uiRow{source: source, cluster: cluster})
+			}
+		}
+
+		d.screen.PostEvent(tcell.NewEventInterrupt(refresh))
+	}()
+}
+
+func (d *karbonDashboard) applyRefresh(refresh uiRefresh) {
+	var current string
+	if d.selected < len(d.rows) {
+		current = sourceName(d.rows[d.selected].source) + "/" + d.rows[d.selected].cluster.Name
+	}
+
+	d.rows = refresh.rows
+	d.refreshing = false
+	d.lastRefresh = d.Clock.Now()
+	d.reloadState()
+
+	// keep the selection on the same cluster
+	d.selected = 0
+	for i, row := range d.rows {
+		if sourceName(row.source)+"/"+row.cluster.Name == current {
+			d.selected = i
+		}
+	}
+
+	if len(refresh.errors) > 0 {
+		d.message = strings.Join(refresh.errors, "; ")
+	}
+}
+
+func (d *karbonDashboard) reloadState() {
+	state, err := d.loadState()
+	if err != nil {
+		d.message = err.Error()
+		return
+	}
+	d.state = state
+}
+
+// handleKey processes a key and returns false to quit
+func (d *karbonDashboard) handleKey(ev *tcell.EventKey) bool {
+	if ev.Key() == tcell.KeyCtrlC {
+		return false
+	}
+
+	if d.confirm != "" {
+		// the row of the prompt, a refresh may have changed the list in between
+		if ev.Rune() == 'y' || ev.Rune() == 'Y' {
+			row := d.confirmRow
+			d.runCommand(row.source, logoutArgs(row.cluster.Name, d.loginState(row))...)
+		}
+		d.confirm = ""
+		return true
+	}
+
+	if d.pager != nil {
+		d.handlePagerKey(ev)
+		return true
+	}
+
+	d.message = ""
+	_, height := d.screen.Size()
+	page := max(height-4, 1)
+
+	switch ev.Key() {
+	case tcell.KeyUp:
+		d.selected--
+	case tcell.KeyDown:
+		d.selected++
+	case tcell.KeyPgUp:
+		d.selected -= page
+	case tcell.KeyPgDn:
+		d.selected += page
+	case tcell.KeyHome:
+		d.selected = 0
+	case tcell.KeyEnd:
+		d.selected = len(d.rows) - 1
+	case tcell.KeyEscape:
+		return false
+	case tcell.KeyEnter:
+		d.describe()
+	case tcell.KeyRune:
+		switch ev.Rune() {
+		case 'q':
+			return false
+		case 'k':
+			d.selected--
+		case 'j':
+			d.selected++
+		case 'd':
+			d.describe()
+		case 'l':
+			if row, ok := d.current(); ok {
+				d.runCommand(row.source, append([]string{"login", "--cluster", row.cluster.Name}, serverArgs(row.source)...)...)
+			}
+		case 'o':
+			if row, ok := d.current(); ok {
+				d.confirm = fmt.Sprintf("Logout from cluster %s? (y/n)", row.cluster.Name)
+				d.confirmRow = row
+			}
+		case 's':
+			if row, ok := d.current(); ok {
+				d.runCommand(row.source, append(append([]string{"ssh"}, serverArgs(row.source)...), row.cluster.Name)...)
+			}
+		case 'c':
+			d.copyEndpoint()
+		case 't':
+			d.tasks()
+		case 'r':
+			d.refresh()
+		}
+	}
+
+	d.selected = min(max(d.selected, 0), max(len(d.rows)-1, 0))
+	return true
+}
+
+func (d *karbonDashboard) handlePagerKey(ev *tcell.EventKey) {
+	_, height := d.screen.Size()
+	page := max(height-2, 1)
+
+	switch ev.Key() {
+	case tcell.KeyEscape, tcell.KeyEnter:
+		d.pager = nil
+		return
+	case tcell.KeyUp:
+		d.pager.offset--
+	case tcell.KeyDown:
+		d.pager.offset++
+	case tcell.KeyPgUp:
+		d.pager.offset -= page
+	case tcell.KeyPgDn:
+		d.pager.offset += page
+	case tcell.KeyHome:
+		d.pager.offset = 0
+	case tcell.KeyEnd:
+		d.pager.offset = len(d.pager.lines)
+	case tcell.KeyRune:
+		switch ev.Rune() {
+		case 'q':
+			d.pager = nil
+			return
+		case 'k':
+			d.pager.offset--
+		case 'j':
+			d.pager.offset++
+		}
+	}
+
+	d.pager.offset = min(max(d.pager.offset, 0), max(len(d.pager.lines)-page, 0))
+}
+
+func (d *karbonDashboard) current() (uiRow, bool) {
+	if d.selected >= len(d.rows) {
+		return uiRow{}, false
+	}
+	return d.rows[d.selected], true
+}
+
+// describe shows the cluster object, its nodes and the local login state
+func (d *karbonDashboard) describe() {
+	row, ok := d.current()
+	if !ok {
+		return
+	}
+
+	d.showLoading()
+
+	var lines []string
+	clusterJSON, err := row.source.nutanix.getClusterObject(row.cluster.Name)
+	if err != nil {
+		lines = append(lines, fmt.Sprintf("Error: %s", err))
+	} else {
+		lines = append(lines, strings.Split(string(clusterJSON), "\n")...)
+	}
+
+	lines = append(lines, "", "Nodes:")
+	nodes, err := row.source.nutanix.listKarbonNodes(row.cluster.Name)
+	if err != nil {
+		lines = append(lines, fmt.Sprintf("  Error: %s", err))
+	}
+	for _, node := range nodes {
+		lines = append(lines, fmt.Sprintf("  %-40s %-16s %-20s %s", node.Hostname, node.IPv4Address, node.Pool, node.Category))
+	}
+
+	lines = append(lines, "", "Login:")
+	if entry := d.loginState(row); entry != nil {
+		lines = append(lines,
+			fmt.Sprintf("  kubeconfig:        %s", entry.Kubeconfig),
+			fmt.Sprintf("  kubeconfig expiry: %s", formatTime(entry.KubeconfigExpiry)),
+			fmt.Sprintf("  ssh expiry:        %s", formatTime(entry.SSHExpiry)),
+			fmt.Sprintf("  last update:       %s", formatTime(entry.UpdateTime)))
+	} else {
+		lines = append(lines, "  not logged in")
+	}
+
+	d.pager = &uiPager{title: fmt.Sprintf("Cluster %s (%s)", row.cluster.Name, sourceName(row.source)), lines: lines}
+}
+
+// tasks shows the running tasks of the Prism Central of the selected cluster
+func (d *karbonDashboard) tasks() {
+	row, ok := d.current()
+	if !ok {
+		return
+	}
+
+	d.showLoading()
+
+	tasks, err := row.source.nutanix.getRunningTasks()
+	if err != nil {
+		d.message = err.Error()
+		return
+	}
+
+	lines := []string{fmt.Sprintf("%-36s  %-10s  %4s  %-30s  %-25s  %s", "UUID", "STATUS", "%", "OPERATION", "CREATED", "ENTITIES")}
+	for _, task := range tasks {
+		var entities []string
+		for _, entity := range task.EntityReferences {
+			entities = append(entities, fmt.Sprintf("%s/%s", entity.Kind, entity.Name))
+		}
+		lines = append(lines, fmt.Sprintf("%-36s  %-10s  %3d%%  %-30s  %-25s  %s", task.UUID, task.Status, task.PercentageComplete, task.OperationType, task.CreationTime, strings.Join(entities, ",")))
+		if task.ProgressMessage != "" {
+			lines = append(lines, "    "+task.ProgressMessage)
+		}
+	}
+	if len(tasks) == 0 {
+		lines = append(lines, "", "No running task")
+	}
+
+	d.pager = &uiPager{title: fmt.Sprintf("Running tasks of %s", row.source.nutanix.server), lines: lines}
+}
+
+// copyEndpoint copies the API endpoint of the selected cluster with the OSC 52 terminal sequence
+func (d *karbonDashboard) copyEndpoint() {
+	row, ok := d.current()
+	if !ok || row.cluster.KubeapiServerIpv4Address == "" {
+		return
+	}
+
+	endpoint := row.cluster.KubeapiServerIpv4Address
+	fmt.Fprintf(d.Out, "\x1b]52;c;%s\a", base64.StdEncoding.EncodeToString([]byte(endpoint)))
+	d.message = fmt.Sprintf("API endpoint %s copied to clipboard", endpoint)
+}
+
+// runCommand runs the plugin with the terminal given back, for commands that prompt or open a session
+func (d *karbonDashboard) runCommand(source *uiSource, args ...string) {
+	executable, err := os.Executable()
+	if err != nil {
+		d.message = err.Error()
+		return
+	}
+
+	if source.profile != "" {
+		args = append([]string{"--profile", source.profile}, args...)
+	}
+
+	err = d.screen.Suspend()
+	if err != nil {
+		d.message = err.Error()
+		return
+	}
+
+	child := exec.Command(executable, args...)
+	child.Stdin = d.In
+	child.Stdout = d.Out
+	child.Stderr = d.ErrOut
+
+	// the password is not put in the environment of the child, readable from /proc for its lifetime
+	closePassword, err := passPassword(child, source.nutanix.password)
+	if err == nil {
+		err = child.Start()
+		closePassword()
+	}
+	if err == nil {
+		err = child.Wait()
+	}
+	if err != nil {
+		fmt.Fprintln(d.ErrOut, err)
+	}
+
+	fmt.Fprint(d.ErrOut, "\nPress Enter to return to the dashboard")
+	bufio.NewReader(d.In).ReadString('\n')
+
+	err = d.screen.Resume()
+	if err != nil {
+		d.message = err.Error()
+	}
+
+	d.reloadState()
+	d.refresh()
+}
+
+// serverArgs are the flags selecting the Prism Central of a source without profile
+func serverArgs(source *uiSource) []string {
+	if source.profile != "" {
+		return nil
+	}
+	return []string{
+		"--server", source.nutanix.server,
+		"--user", source.nutanix.login,
+		"--port", strconv.Itoa(source.nutanix.port),
+		fmt.Sprintf("--insecure=%t", source.nutanix.insecure),
+	}
+}
+
+// logoutArgs are the logout arguments of a cluster, with the Prism Central, kubeconfig, merge mode and SSH items of its login
+func logoutArgs(cluster string, entry *clusterState) []string {
+	args := []string{"logout", "--cluster", cluster}
+	if entry == nil {
+		return args
+	}
+
+	args = append(args, "--server", entry.Server, "--kubeconfig", entry.Kubeconfig)
+	if entry.Merge {
+		args = append(args, "--merge")
+	}
+	if entry.SSHAgent {
+		args = append(args, "--ssh-agent")
+	}
+	if entry.SSHFile || len(entry.SSHFiles) > 0 {
+		args = append(args, "--ssh-file")
+	}
+
+	return args
+}
+
+func sourceName(source *uiSource) string {
+	if source.profile == "" {
+		return "-"
+	}
+	return source.profile
+}
+
+// loginState returns the state of a cluster logged in from the same Prism Central
+func (d *karbonDashboard) loginState(row uiRow) *clusterState {
+	if d.state == nil {
+		return nil
+	}
+
+	return d.state.Clusters[stateKey(row.source.nutanix.server, row.cluster.Name)]
+}
+
+func (d *karbonDashboard) showLoading() {
+	d.message = "Loading..."
+	d.draw()
+	d.message = ""
+}
+
+func (d *karbonDashboard) draw() {
+	d.screen.Clear()
+
+	if d.pager != nil {
+		d.drawPager()
+	} else {
+		d.drawList()
+	}
+
+	d.screen.Show()
+}
+
+func (d *karbonDashboard) drawList() {
+	width, height := d.screen.Size()
+	titleStyle := tcell.StyleDefault.Reverse(true)
+	headerStyle := tcell.StyleDefault.Bold(true)
+
+	title := fmt.Sprintf(" kubectl karbon ui - %d cluster(s) - refreshed %s", len(d.rows), d.lastRefresh.Format("15:04:05"))
+	if d.refreshing {
+		title += " - refreshing..."
+	}
+	drawLine(d.screen, 0, width, titleStyle, title)
+
+	now := d.Clock.Now()
+	cells := make([][]string, len(d.rows))
+	for i, row := range d.rows {
+		status := row.cluster.Status
+		if len(status) > 1 && status[0] == 'k' {
+			status = status[1:]
+		}
+
+		login := "-"
+		if entry := d.loginState(row); entry != nil {
+			login = "yes"
+			if !entry.KubeconfigExpiry.IsZero() {
+				if entry.KubeconfigExpiry.After(now) {
+					login = fmt.Sprintf("yes (%s left)", entry.KubeconfigExpiry.Sub(now).Round(time.Minute))
+				} else {
+					login = "expired"
+				}
+			}
+		}
+
+		cells[i] = []string{sourceName(row.source), row.cluster.Name, status, row.cluster.Version,
+			row.cluster.KubeapiServerIpv4Address, row.cluster.MasterConfig.DeploymentType, login}
+	}
+
+	widths := make([]int, len(uiColumns))
+	for i, column := range uiColumns {
+		widths[i] = len(column)
+		for _, row := range cells {
+			widths[i] = max(widths[i], len(row[i]))
+		}
+		widths[i] = min(widths[i], 40) + 2
+	}
+
+	drawLine(d.screen, 1, width, headerStyle, formatColumns(uiColumns, widths))
+
+	listHeight := max(height-3, 1)
+	if d.selected < d.offset {
+		d.offset = d.selected
+	}
+	if d.selected >= d.offset+listHeight {
+		d.offset = d.selected - listHeight + 1
+	}
+
+	for i := d.offset; i < len(cells) && i-d.offset < listHeight; i++ {
+		style := tcell.StyleDefault
+		if i == d.selected {
+			style = style.Reverse(true)
+		}
+		drawLine(d.screen, 2+i-d.offset, width, style, formatColumns(cells[i], widths))
+	}
+
+	footer := uiHelp
+	if d.confirm != "" {
+		footer = d.confirm
+	} else if d.message != "" {
+		footer = d.message
+	}
+	drawLine(d.screen, height-1, width, titleStyle, " "+footer)
+}
+
+func (d *karbonDashboard) drawPager() {
+	width, height := d.screen.Size()
+	titleStyle := tcell.StyleDefault.Reverse(true)
+
+	drawLine(d.screen, 0, width, titleStyle, " "+d.pager.title)
+
+	for i := 0; i < height-2 && d.pager.offset+i < len(d.pager.lines); i++ {
+		drawLine(d.screen, 1+i, width, tcell.StyleDefault, d.pager.lines[d.pager.offset+i])
+	}
+
+	footer := "up/down/pgup/pgdn:scroll  esc/q:back"
+	if d.message != "" {
+		footer = d.message
+	}
+	drawLine(d.screen, height-1, width, titleStyle, " "+footer)
+}
+
+// formatColumns pads or truncates the cells to the column widths
+func formatColumns(cells []string, widths []int) string {
+	var b strings.Builder
+	for i, cell := range cells {
+		if len(cell) > widths[i]-2 {
+			cell = cell[:widths[i]-3] + "~"
+		}
+		fmt.Fprintf(&b, "%-*s", widths[i], cell)
+	}
+	return b.String()
+}
+
+// drawLine writes a line of text, filling the width with the style
+func drawLine(screen tcell.Screen, y int, width int, style tcell.Style, text string) {
+	x := 0
+	for _, r := range text {
+		if x >= width {
+			break
+		}
+		screen.SetContent(x, y, r, nil, style)
+		x++
+	}
+	for ; x < width; x++ {
+		screen.SetContent(x, y, ' ', nil, style)
+	}
+}
@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLogoutArgs(t *testing.T) {
+	for _, test := range []struct {
+		entry *clusterState
+		want  []string
+	}{
+		{nil, []string{"logout", "--cluster", "a"}},
+		{&clusterState{Server: "pc", Kubeconfig: "/home/test/.kube/config", Merge: true, SSHAgent: true}, []string{"logout", "--cluster", "a", "--server", "pc", "--kubeconfig", "/home/test/.kube/config", "--merge", "--ssh-agent"}},
+		{&clusterState{Server: "pc", Kubeconfig: "/home/test/.kube/kubie/a.yaml", SSHFiles: []string{"/home/test/.ssh/a"}}, []string{"logout", "--cluster", "a", "--server", "pc", "--kubeconfig", "/home/test/.kube/kubie/a.yaml", "--ssh-file"}},
+	} {
+		if args := logoutArgs("a", test.entry); !slices.Equal(args, test.want) {
+			t.Errorf("logoutArgs(%+v) = %q, want %q", test.entry, args, test.want)
+		}
+	}
+}
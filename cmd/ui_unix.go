@@ -0,0 +1,47 @@
+//go:build !windows
+
+/*
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// passPassword gives the password to a child process on an inherited pipe, named by passwordFdEnv,
+// the returned function closes the read end once the child is started
+func passPassword(child *exec.Cmd, password string) (func(), error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// the password fits in the pipe buffer, the write does not wait for the child
+	_, err = w.WriteString(password)
+	w.Close()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	// the extra files are the descriptors from 3 in the child
+	child.ExtraFiles = append(child.ExtraFiles, r)
+	child.Env = append(os.Environ(), fmt.Sprintf("%s=%d", passwordFdEnv, 2+len(child.ExtraFiles)))
+
+	return func() { r.Close() }, nil
+}
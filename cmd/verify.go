@@ -0,0 +1,180 @@
+/*
+Package cmd verify check the Kubernetes API is reachable with a new kubeconfig
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/discovery"
+	authenticationv1client "k8s.io/client-go/kubernetes/typed/authentication/v1"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// apiVerification is the result of the calls to the Kubernetes API with a new kubeconfig, also its JSON result
+type apiVerification struct {
+	Server        string   `json:"server"`
+	ServerVersion string   `json:"server_version"`
+	Username      string   `json:"username,omitempty"`
+	Groups        []string `json:"groups,omitempty"`
+	LatencyMs     int64    `json:"latency_ms"`
+}
+
+// verifyKubeAPI calls /version and a SelfSubjectReview with the kubeconfig of a cluster, through the SSH bastion
+// of the route if any, a proxy-url is already in the kubeconfig, it returns the warnings like the version skew
+// with the local kubectl
+func (p *plugin) verifyKubeAPI(kubeconfigResponse *kubeConfig, route prismRoute) (*apiVerification, []string, error) {
+	restConfig, err := clientcmd.RESTConfigFromKubeConfig([]byte(kubeconfigResponse.KubeConfig))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	restConfig.Timeout = time.Duration(p.viper.GetInt("request-timeout")) * time.Second
+
+	if route.sshJump != "" {
+		restConfig.Dial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return p.dialJump(ctx, route, network, address)
+		}
+	}
+
+	verification := &apiVerification{Server: restConfig.Host}
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	start := time.Now()
+	serverVersion, err := discoveryClient.ServerVersion()
+	if err != nil {
+		return nil, nil, fmt.Errorf("kubeconfig written but Kubernetes API %s unreachable: %w", restConfig.Host, err)
+	}
+	latency := time.Since(start)
+	verification.LatencyMs = latency.Milliseconds()
+	verification.ServerVersion = serverVersion.GitVersion
+
+	p.logger.Info("Kubernetes API reachable", "server", restConfig.Host, "version", serverVersion.GitVersion, "latency", latency.Round(time.Millisecond))
+
+	var warnings []string
+
+	authenticationClient, err := authenticationv1client.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	review, err := authenticationClient.SelfSubjectReviews().Create(context.Background(), &authenticationv1.SelfSubjectReview{}, metav1.CreateOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		// SelfSubjectReview is GA since Kubernetes 1.28
+		warnings = append(warnings, fmt.Sprintf("identity not verified, SelfSubjectReview not supported by Kubernetes %s", serverVersion.GitVersion))
+	case err != nil:
+		return nil, nil, fmt.Errorf("kubeconfig written but Kubernetes API %s rejected the credentials: %w", restConfig.Host, err)
+	default:
+		verification.Username = review.Status.UserInfo.Username
+		verification.Groups = review.Status.UserInfo.Groups
+	}
+
+	kubectl, err := p.Kubectl.ClientVersion()
+	if err != nil {
+		p.logger.Info("version skew not checked", "error", err)
+	} else if warning := versionSkewWarning(kubectl, serverVersion); warning != "" {
+		warnings = append(warnings, warning)
+	}
+
+	for _, warning := range warnings {
+		p.logger.Warn(warning, "server", restConfig.Host)
+	}
+
+	return verification, warnings, nil
+}
+
+// pathKubectl is the kubectl of the PATH, its version is only run once
+type pathKubectl struct {
+	once    sync.Once
+	version *version.Info
+	err     error
+}
+
+func (k *pathKubectl) ClientVersion() (*version.Info, error) {
+	k.once.Do(func() {
+		k.version, k.err = kubectlClientVersion()
+	})
+	return k.version, k.err
+}
+
+// kubectlClientVersion runs kubectl version of the PATH and returns its client version
+func kubectlClientVersion() (*version.Info, error) {
+	output, err := exec.Command("kubectl", "version", "--client", "-o", "json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run kubectl version: %w", err)
+	}
+
+	var versions struct {
+		ClientVersion *version.Info `json:"clientVersion"`
+	}
+	err = json.Unmarshal(output, &versions)
+	if err != nil {
+		return nil, err
+	}
+	if versions.ClientVersion == nil {
+		return nil, fmt.Errorf("no client version in kubectl version output")
+	}
+
+	return versions.ClientVersion, nil
+}
+
+// versionSkewWarning returns a warning when kubectl is more than one minor version away from the server,
+// the skew supported by the Kubernetes version skew policy
+func versionSkewWarning(client *version.Info, server *version.Info) string {
+	clientMajor, clientMinor, ok := majorMinor(client)
+	if !ok {
+		return ""
+	}
+	serverMajor, serverMinor, ok := majorMinor(server)
+	if !ok {
+		return ""
+	}
+
+	if clientMajor == serverMajor && clientMinor-serverMinor <= 1 && serverMinor-clientMinor <= 1 {
+		return ""
+	}
+
+	return fmt.Sprintf("kubectl %s is more than one minor version away from Kubernetes %s, the supported version skew", client.GitVersion, server.GitVersion)
+}
+
+// majorMinor returns the major and minor numbers of a version, minors like 28+ of some providers are accepted
+func majorMinor(info *version.Info) (int, int, bool) {
+	major, err := strconv.Atoi(info.Major)
+	if err != nil {
+		return 0, 0, false
+	}
+	minor, err := strconv.Atoi(strings.TrimSuffix(info.Minor, "+"))
+	if err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/version"
+)
+
+func TestVersionSkewWarning(t *testing.T) {
+	server := &version.Info{Major: "1", Minor: "28", GitVersion: "v1.28.3"}
+
+	for _, test := range []struct {
+		client version.Info
+		warn   bool
+	}{
+		{version.Info{Major: "1", Minor: "28"}, false},
+		{version.Info{Major: "1", Minor: "29"}, false},
+		{version.Info{Major: "1", Minor: "27+"}, false},
+		{version.Info{Major: "1", Minor: "30"}, true},
+		{version.Info{Major: "1", Minor: "25"}, true},
+		{version.Info{Major: "", Minor: ""}, false},
+	} {
+		if got := versionSkewWarning(&test.client, server) != ""; got != test.warn {
+			t.Errorf("kubectl %s.%s warns = %v, want %v", test.client.Major, test.client.Minor, got, test.warn)
+		}
+	}
+}
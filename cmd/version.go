@@ -6,7 +6,7 @@ Licensed under the Apache License, Version 2.0 (the "License");
 you may not use this file except in compliance with the License.
 You may obtain a copy of the License at
 
-    http://www.apache.org/licenses/LICENSE-2.0
+	http://www.apache.org/licenses/LICENSE-2.0
 
 Unless required by applicable law or agreed to in writing, software
 distributed under the License is distributed on an "AS IS" BASIS,
@@ -23,21 +23,46 @@ import (
 	"github.com/spf13/cobra"
 )
 
-// versionCmd represents the version command
-var versionCmd = &cobra.Command{
-	Use:   "version",
-	Short: "Prints the version of the plugin",
-	Long:  `Prints the version of the plugin`,
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Printf("kubectl-karbon: version %s (%s)\n", version.Version, version.Commit)
-		if verbose {
-			fmt.Printf("build date:%s by: %s\nplatform: %s/%s\n", version.Date, version.BuiltBy, version.OsName, version.PlatformName)
-		}
-	},
+// versionResult is the JSON result of the version command
+type versionResult struct {
+	Version  string `json:"version"`
+	Commit   string `json:"commit"`
+	Date     string `json:"date"`
+	BuiltBy  string `json:"built_by"`
+	Platform string `json:"platform"`
 }
 
-func init() {
-	rootCmd.AddCommand(versionCmd)
+// newVersionCmd returns the version command
+func newVersionCmd(p *plugin) *cobra.Command {
+	versionCmd := &cobra.Command{
+		Use:   "version",
+		Short: "Prints the version of the plugin",
+		Long:  `Prints the version of the plugin`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if p.jsonOutputEnabled() {
+				p.printJSONOutput(commandOutput{
+					Command: commandName(cmd),
+					Success: true,
+					Result: versionResult{
+						Version:  version.Version,
+						Commit:   version.Commit,
+						Date:     version.Date,
+						BuiltBy:  version.BuiltBy,
+						Platform: fmt.Sprintf("%s/%s", version.OsName, version.PlatformName),
+					},
+				})
+				return nil
+			}
+
+			fmt.Fprintf(p.out, "kubectl-karbon: version %s (%s)\n", version.Version, version.Commit)
+			if p.verbose {
+				fmt.Fprintf(p.out, "build date:%s by: %s\nplatform: %s/%s\n", version.Date, version.BuiltBy, version.OsName, version.PlatformName)
+			}
+			return nil
+		},
+	}
+
+	p.jsonOutputCommand(versionCmd)
 
 	// Here you will define your flags and configuration settings.
 
@@ -48,4 +73,6 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// versionCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	return versionCmd
 }
@@ -0,0 +1,112 @@
+/*
+Package karbontest kubeapi a fake kube-apiserver answering the version and identity of the caller
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package karbontest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// KubeAPIServer is a fake kube-apiserver serving /version and SelfSubjectReview,
+// give its Address as KubeAPIServer of a Cluster so that the kubeconfig points to it
+type KubeAPIServer struct {
+	*httptest.Server
+
+	// Version is the git version of the server, v1.28.3 by default
+	Version string
+}
+
+// NewKubeAPIServer starts a fake kube-apiserver over TLS with a self-signed certificate
+func NewKubeAPIServer() *KubeAPIServer {
+	s := &KubeAPIServer{Version: "v1.28.3"}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Address returns the host:port of the server
+func (s *KubeAPIServer) Address() string {
+	return s.Listener.Addr().String()
+}
+
+func (s *KubeAPIServer) handle(w http.ResponseWriter, r *http.Request) {
+	username, ok := tokenSubject(r.Header.Get("Authorization"))
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","message":"Unauthorized","reason":"Unauthorized","code":401}`))
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/version":
+		major, minor := "", ""
+		parts := strings.Split(strings.TrimPrefix(s.Version, "v"), ".")
+		if len(parts) > 1 {
+			major, minor = parts[0], parts[1]
+		}
+		writeJSON(w, map[string]string{
+			"major":      major,
+			"minor":      minor,
+			"gitVersion": s.Version,
+			"platform":   "linux/amd64",
+		})
+	case r.Method == http.MethodPost && r.URL.Path == "/apis/authentication.k8s.io/v1/selfsubjectreviews":
+		writeJSON(w, map[string]interface{}{
+			"kind":       "SelfSubjectReview",
+			"apiVersion": "authentication.k8s.io/v1",
+			"metadata":   map[string]interface{}{},
+			"status": map[string]interface{}{
+				"userInfo": map[string]interface{}{
+					"username": username,
+					"groups":   []string{"system:authenticated"},
+				},
+			},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// tokenSubject returns the sub claim of the bearer token of the kubeconfigs of the fake Prism Central
+func tokenSubject(authorization string) (string, bool) {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return "", false
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+
+	var claims struct {
+		Sub string `json:"sub"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Sub == "" {
+		return "", false
+	}
+
+	return claims.Sub, true
+}
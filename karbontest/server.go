@@ -0,0 +1,517 @@
+/*
+Package karbontest provides a fake Prism Central serving the Karbon API, for tests and demos
+Copyright © 2021 Christophe Jauffret <christophe@nutanix.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package karbontest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultUsername and DefaultPassword are the credentials accepted by a new server
+const (
+	DefaultUsername = "admin"
+	DefaultPassword = "nutanix/4u"
+)
+
+// Cluster is a Karbon cluster served by the fake
+type Cluster struct {
+	Name           string
+	UUID           string
+	Status         string
+	Version        string
+	KubeAPIServer  string // IP address or host:port of a KubeAPIServer
+	SSHUsername    string // user of the SSH certificate, nutanix by default
+	DeploymentType string
+	NodePools      []NodePool
+}
+
+// NodePool is a node pool of a Karbon cluster
+type NodePool struct {
+	Name     string
+	Category string
+	Nodes    []Node
+}
+
+// Node is a VM of a node pool
+type Node struct {
+	Hostname    string
+	IPv4Address string
+}
+
+// Task is a Prism Central task returned by the tasks list
+type Task struct {
+	UUID               string
+	OperationType      string
+	Status             string
+	PercentageComplete int
+	Entity             string
+}
+
+// failure is an injected error answered to the requests whose path contains pathPart
+type failure struct {
+	pathPart  string
+	status    int
+	remaining int
+}
+
+// Server is a fake Prism Central, it answers the Karbon API with the configured clusters
+type Server struct {
+	*httptest.Server
+
+	// KubeconfigLifetime and SSHLifetime are the validity of the returned credentials, 24h by default
+	KubeconfigLifetime time.Duration
+	SSHLifetime        time.Duration
+
+	mu       sync.Mutex
+	username string
+	password string
+	clusters []Cluster
+	tasks    []Task
+	failures []*failure
+	requests []string
+	caSigner ssh.Signer
+}
+
+// NewServer starts a fake Prism Central over TLS with a self-signed certificate (use insecure mode),
+// serving the clusters
+func NewServer(clusters ...Cluster) *Server {
+	s := NewUnstartedServer(clusters...)
+	s.StartTLS()
+	return s
+}
+
+// NewUnstartedServer returns a fake Prism Central which is not started, to change its listener
+func NewUnstartedServer(clusters ...Cluster) *Server {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("karbontest: failed to generate CA key: %v", err))
+	}
+
+	caSigner, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		panic(fmt.Sprintf("karbontest: failed to create CA signer: %v", err))
+	}
+
+	s := &Server{
+		KubeconfigLifetime: 24 * time.Hour,
+		SSHLifetime:        24 * time.Hour,
+		username:           DefaultUsername,
+		password:           DefaultPassword,
+		caSigner:           caSigner,
+	}
+	for _, cluster := range clusters {
+		s.AddCluster(cluster)
+	}
+
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Listen replaces the listener of an unstarted server to serve on address
+func (s *Server) Listen(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	s.Listener.Close()
+	s.Listener = listener
+	return nil
+}
+
+// DemoClusters returns a set of clusters in various states
+func DemoClusters() []Cluster {
+	return []Cluster{
+		{Name: "demo-prod", Version: "1.28.3-0", DeploymentType: "kMultiMaster", NodePools: demoNodePools("demo-prod", 10, 3, 3)},
+		{Name: "demo-dev", Version: "1.27.9-0", NodePools: demoNodePools("demo-dev", 20, 1, 2)},
+		{Name: "demo-upgrade", Status: "kUpgrading", Version: "1.26.11-0", NodePools: demoNodePools("demo-upgrade", 30, 1, 1)},
+	}
+}
+
+func demoNodePools(cluster string, subnet int, masters int, workers int) []NodePool {
+	pools := []NodePool{
+		{Name: cluster + "-master-pool", Category: "master"},
+		{Name: cluster + "-etcd-pool", Category: "etcd"},
+		{Name: cluster + "-worker-pool", Category: "worker"},
+	}
+
+	for i := 0; i < masters; i++ {
+		pools[0].Nodes = append(pools[0].Nodes, Node{Hostname: fmt.Sprintf("karbon-%s-k8s-master-%d", cluster, i), IPv4Address: fmt.Sprintf("10.0.%d.%d", subnet, 10+i)})
+		pools[1].Nodes = append(pools[1].Nodes, Node{Hostname: fmt.Sprintf("karbon-%s-etcd-%d", cluster, i), IPv4Address: fmt.Sprintf("10.0.%d.%d", subnet, 20+i)})
+	}
+	for i := 0; i < workers; i++ {
+		pools[2].Nodes = append(pools[2].Nodes, Node{Hostname: fmt.Sprintf("karbon-%s-k8s-worker-%d", cluster, i), IPv4Address: fmt.Sprintf("10.0.%d.%d", subnet, 30+i)})
+	}
+
+	return pools
+}
+
+// Host returns the address of the server, for the --server flag
+func (s *Server) Host() string {
+	u, _ := url.Parse(s.URL)
+	return u.Hostname()
+}
+
+// Port returns the port of the server, for the --port flag
+func (s *Server) Port() int {
+	u, _ := url.Parse(s.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return port
+}
+
+// SetCredentials changes the accepted credentials, the others are rejected with 401
+func (s *Server) SetCredentials(username string, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.username = username
+	s.password = password
+}
+
+// AddCluster adds or replaces a cluster, missing fields get defaults
+func (s *Server) AddCluster(cluster Cluster) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cluster.UUID == "" {
+		cluster.UUID = fmt.Sprintf("00000000-0000-4000-8000-%012d", len(s.clusters)+1)
+	}
+	if cluster.Status == "" {
+		cluster.Status = "kActive"
+	}
+	if cluster.Version == "" {
+		cluster.Version = "1.28.3-0"
+	}
+	if cluster.KubeAPIServer == "" {
+		cluster.KubeAPIServer = fmt.Sprintf("10.0.0.%d", len(s.clusters)+1)
+	}
+	if cluster.DeploymentType == "" {
+		cluster.DeploymentType = "kSingleMaster"
+	}
+
+	for i := range s.clusters {
+		if s.clusters[i].Name == cluster.Name {
+			s.clusters[i] = cluster
+			return
+		}
+	}
+	s.clusters = append(s.clusters, cluster)
+}
+
+// RemoveCluster removes a cluster, it is not found anymore
+func (s *Server) RemoveCluster(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.clusters {
+		if s.clusters[i].Name == name {
+			s.clusters = append(s.clusters[:i], s.clusters[i+1:]...)
+			return
+		}
+	}
+}
+
+// AddTask adds a task to the Prism Central tasks list
+func (s *Server) AddTask(task Task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tasks = append(s.tasks, task)
+}
+
+// Fail makes the next count requests whose path contains pathPart answer status, all of them if count is 0
+func (s *Server) Fail(pathPart string, status int, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = append(s.failures, &failure{pathPart: pathPart, status: status, remaining: count})
+}
+
+// ClearFailures removes the injected errors
+func (s *Server) ClearFailures() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = nil
+}
+
+// Requests returns the "METHOD /path" of the requests received
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.requests...)
+}
+
+// CAPublicKey returns the SSH CA public key signing the certs of the clusters
+func (s *Server) CAPublicKey() ssh.PublicKey {
+	return s.caSigner.PublicKey()
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	// the plugin builds paths with a double slash
+	path := "/" + strings.TrimLeft(r.URL.Path, "/")
+
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+path)
+	status := s.injectedFailure(path)
+	username, password := s.username, s.password
+	s.mu.Unlock()
+
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok || user != username || pass != password {
+		http.Error(w, `{"message":"Authentication required"}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && path == "/karbon/v1-beta.1/k8s/clusters":
+		s.listClusters(w)
+	case r.Method == http.MethodPost && path == "/api/nutanix/v3/tasks/list":
+		s.listTasks(w)
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/karbon/v1-beta.1/k8s/clusters/"):
+		name, resource, _ := strings.Cut(strings.TrimPrefix(path, "/karbon/v1-beta.1/k8s/clusters/"), "/")
+		cluster, ok := s.cluster(name)
+		switch {
+		case !ok:
+			http.NotFound(w, r)
+		case resource == "":
+			writeJSON(w, clusterObject(cluster))
+		case resource == "node-pools":
+			writeJSON(w, nodePoolsObject(cluster))
+		default:
+			http.NotFound(w, r)
+		}
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/karbon/v1/k8s/clusters/"):
+		name, resource, _ := strings.Cut(strings.TrimPrefix(path, "/karbon/v1/k8s/clusters/"), "/")
+		cluster, ok := s.cluster(name)
+		switch {
+		case !ok:
+			http.NotFound(w, r)
+		case resource == "kubeconfig":
+			writeJSON(w, map[string]string{"kube_config": s.kubeconfig(cluster)})
+		case resource == "ssh":
+			s.sshCredentials(w, cluster)
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// injectedFailure returns the status of the first injected error matching the path, 0 if none, s.mu must be held
+func (s *Server) injectedFailure(path string) int {
+	for i, f := range s.failures {
+		if !strings.Contains(path, f.pathPart) {
+			continue
+		}
+
+		if f.remaining > 0 {
+			f.remaining--
+			if f.remaining == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		return f.status
+	}
+
+	return 0
+}
+
+func (s *Server) cluster(name string) (Cluster, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, cluster := range s.clusters {
+		if cluster.Name == name {
+			return cluster, true
+		}
+	}
+	return Cluster{}, false
+}
+
+func (s *Server) listClusters(w http.ResponseWriter) {
+	s.mu.Lock()
+	clusters := make([]interface{}, 0, len(s.clusters))
+	for _, cluster := range s.clusters {
+		clusters = append(clusters, clusterObject(cluster))
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, clusters)
+}
+
+func (s *Server) listTasks(w http.ResponseWriter) {
+	s.mu.Lock()
+	entities := make([]interface{}, 0, len(s.tasks))
+	for _, task := range s.tasks {
+		entity := map[string]interface{}{
+			"uuid":                task.UUID,
+			"operation_type":      task.OperationType,
+			"status":              task.Status,
+			"percentage_complete": task.PercentageComplete,
+			"creation_time":       time.Now().UTC().Format(time.RFC3339),
+		}
+		if task.Entity != "" {
+			entity["entity_reference_list"] = []map[string]string{{"kind": "k8s_cluster", "name": task.Entity}}
+		}
+		entities = append(entities, entity)
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, map[string]interface{}{"entities": entities})
+}
+
+func clusterObject(cluster Cluster) map[string]interface{} {
+	return map[string]interface{}{
+		"name":                        cluster.Name,
+		"uuid":                        cluster.UUID,
+		"status":                      cluster.Status,
+		"version":                     cluster.Version,
+		"kubeapi_server_ipv4_address": cluster.KubeAPIServer,
+		"master_config": map[string]interface{}{
+			"deployment_type": cluster.DeploymentType,
+		},
+	}
+}
+
+func nodePoolsObject(cluster Cluster) []interface{} {
+	pools := make([]interface{}, 0, len(cluster.NodePools))
+	for _, pool := range cluster.NodePools {
+		nodes := make([]interface{}, 0, len(pool.Nodes))
+		for _, node := range pool.Nodes {
+			nodes = append(nodes, map[string]string{"hostname": node.Hostname, "ipv4_address": node.IPv4Address})
+		}
+		pools = append(pools, map[string]interface{}{"name": pool.Name, "category": pool.Category, "nodes": nodes})
+	}
+	return pools
+}
+
+// kubeconfig returns a kubeconfig with a token expiring like the Karbon ones
+func (s *Server) kubeconfig(cluster Cluster) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	claims, _ := json.Marshal(map[string]interface{}{
+		"sub": cluster.Name,
+		"exp": time.Now().Add(s.KubeconfigLifetime).Unix(),
+	})
+	token := fmt.Sprintf("%s.%s.%s", header, base64.RawURLEncoding.EncodeToString(claims), "fake")
+
+	return fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: %[1]s
+  cluster:
+    server: https://%[2]s
+    insecure-skip-tls-verify: true
+contexts:
+- name: %[1]s-context
+  context:
+    cluster: %[1]s
+    user: default-%[1]s-token
+current-context: %[1]s-context
+users:
+- name: default-%[1]s-token
+  user:
+    token: %[3]s
+`, cluster.Name, kubeAPIServerAddress(cluster.KubeAPIServer), token)
+}
+
+// kubeAPIServerAddress returns the host:port of a kube-apiserver, on port 443 when not given
+func kubeAPIServerAddress(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(address, "443")
+}
+
+// sshCredentials answers a new key with a user cert signed by the CA of the server
+func (s *Server) sshCredentials(w http.ResponseWriter, cluster Cluster) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	username := cluster.SSHUsername
+	if username == "" {
+		username = "nutanix"
+	}
+
+	now := time.Now()
+	expiry := now.Add(s.SSHLifetime)
+	cert := &ssh.Certificate{
+		Key:             sshPublicKey,
+		CertType:        ssh.UserCert,
+		KeyId:           cluster.Name,
+		ValidPrincipals: []string{username},
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(expiry.Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{"permit-pty": ""},
+		},
+	}
+
+	err = cert.SignCert(rand.Reader, s.caSigner)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	block, err := ssh.MarshalPrivateKey(privateKey, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]string{
+		"private_key": string(pem.EncodeToMemory(block)),
+		"certificate": string(ssh.MarshalAuthorizedKey(cert)),
+		"expiry_time": expiry.UTC().Format(time.RFC3339),
+		"username":    username,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
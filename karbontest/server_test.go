@@ -0,0 +1,165 @@
+package karbontest
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func get(t *testing.T, s *Server, path string, username string, password string) (int, []byte) {
+	t.Helper()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	req, err := http.NewRequest(http.MethodGet, s.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(username, password)
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, body
+}
+
+func TestListClusters(t *testing.T) {
+	s := NewServer(Cluster{Name: "a"}, Cluster{Name: "b", Status: "kUpgrading"})
+	defer s.Close()
+
+	status, body := get(t, s, "//karbon/v1-beta.1/k8s/clusters", DefaultUsername, DefaultPassword)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+
+	var clusters []struct {
+		Name   string `json:"name"`
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(body, &clusters); err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 2 || clusters[0].Name != "a" || clusters[0].Status != "kActive" || clusters[1].Status != "kUpgrading" {
+		t.Errorf("clusters = %+v", clusters)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	s := NewServer(Cluster{Name: "a"})
+	defer s.Close()
+
+	if status, _ := get(t, s, "/karbon/v1-beta.1/k8s/clusters", DefaultUsername, "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("wrong password status = %d, want 401", status)
+	}
+
+	s.SetCredentials("other", "secret")
+	if status, _ := get(t, s, "/karbon/v1-beta.1/k8s/clusters", "other", "secret"); status != http.StatusOK {
+		t.Errorf("new credentials status = %d, want 200", status)
+	}
+}
+
+func TestUnknownCluster(t *testing.T) {
+	s := NewServer(Cluster{Name: "a"})
+	defer s.Close()
+
+	for _, path := range []string{"/karbon/v1/k8s/clusters/b/kubeconfig", "/karbon/v1/k8s/clusters/b/ssh", "/karbon/v1-beta.1/k8s/clusters/b/node-pools"} {
+		if status, _ := get(t, s, path, DefaultUsername, DefaultPassword); status != http.StatusNotFound {
+			t.Errorf("%s status = %d, want 404", path, status)
+		}
+	}
+
+	s.RemoveCluster("a")
+	if status, _ := get(t, s, "/karbon/v1/k8s/clusters/a/kubeconfig", DefaultUsername, DefaultPassword); status != http.StatusNotFound {
+		t.Errorf("removed cluster status = %d, want 404", status)
+	}
+}
+
+func TestFail(t *testing.T) {
+	s := NewServer(Cluster{Name: "a"})
+	defer s.Close()
+
+	s.Fail("/kubeconfig", http.StatusInternalServerError, 2)
+
+	for i, want := range []int{500, 500, 200} {
+		if status, _ := get(t, s, "/karbon/v1/k8s/clusters/a/kubeconfig", DefaultUsername, DefaultPassword); status != want {
+			t.Errorf("request %d status = %d, want %d", i, status, want)
+		}
+	}
+
+	s.Fail("/ssh", http.StatusServiceUnavailable, 0)
+	for i := 0; i < 3; i++ {
+		if status, _ := get(t, s, "/karbon/v1/k8s/clusters/a/ssh", DefaultUsername, DefaultPassword); status != http.StatusServiceUnavailable {
+			t.Errorf("request %d status = %d, want 503", i, status)
+		}
+	}
+
+	s.ClearFailures()
+	if status, _ := get(t, s, "/karbon/v1/k8s/clusters/a/ssh", DefaultUsername, DefaultPassword); status != http.StatusOK {
+		t.Errorf("status after clear = %d, want 200", status)
+	}
+
+	if requests := s.Requests(); len(requests) != 7 || requests[0] != "GET /karbon/v1/k8s/clusters/a/kubeconfig" {
+		t.Errorf("requests = %v", requests)
+	}
+}
+
+func TestSSHCredentials(t *testing.T) {
+	s := NewServer(Cluster{Name: "a"})
+	defer s.Close()
+
+	_, body := get(t, s, "/karbon/v1/k8s/clusters/a/ssh", DefaultUsername, DefaultPassword)
+
+	var credentials struct {
+		PrivateKey  string `json:"private_key"`
+		Certificate string `json:"certificate"`
+		ExpiryTime  string `json:"expiry_time"`
+		Username    string `json:"username"`
+	}
+	if err := json.Unmarshal(body, &credentials); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.ParsePrivateKey([]byte(credentials.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(credentials.Certificate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		t.Fatalf("certificate is a %T", pub)
+	}
+
+	if _, err := ssh.NewCertSigner(cert, signer); err != nil {
+		t.Errorf("cert does not match the key: %v", err)
+	}
+	if string(cert.SignatureKey.Marshal()) != string(s.CAPublicKey().Marshal()) {
+		t.Error("cert not signed by the CA of the server")
+	}
+
+	expiry, err := time.Parse(time.RFC3339, credentials.ExpiryTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiry.Unix() != int64(cert.ValidBefore) {
+		t.Errorf("expiry_time %s does not match the cert", credentials.ExpiryTime)
+	}
+	if credentials.Username != "nutanix" || !strings.Contains(strings.Join(cert.ValidPrincipals, ","), "nutanix") {
+		t.Errorf("username = %s, principals = %v", credentials.Username, cert.ValidPrincipals)
+	}
+}